@@ -0,0 +1,145 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// buildEnvCache keeps a copy of the build environments generated for the
+// recently used boards, so that switching back to a board reuses its
+// compilation database instead of building it again from scratch.
+type buildEnvCache struct {
+	dir     *paths.Path
+	size    int
+	entries []*buildEnvCacheEntry // most recently used first
+}
+
+type buildEnvCacheEntry struct {
+	fqbn     string
+	docsHash map[string]string
+	path     *paths.Path
+}
+
+// newBuildEnvCache creates a cache that keeps at most size build environments
+// in the given folder. A size of zero disables the cache.
+func newBuildEnvCache(dir *paths.Path, size int) *buildEnvCache {
+	return &buildEnvCache{dir: dir, size: size}
+}
+
+// Store copies the build environment in buildPath into the cache, as the one
+// of the given fqbn built from documents with the given hashes. buildPath is
+// left untouched because clangd may be using it. The least recently used
+// environments exceeding the cache size are removed.
+func (c *buildEnvCache) Store(fqbn string, docsHash map[string]string, buildPath *paths.Path) error {
+	if c.size <= 0 {
+		return nil
+	}
+	c.remove(fqbn)
+	entryPath := c.dir.Join(buildEnvCacheFolderName(fqbn))
+	if err := syncDir(buildPath, entryPath); err != nil {
+		entryPath.RemoveAll()
+		return fmt.Errorf("caching build environment: %w", err)
+	}
+	c.entries = append([]*buildEnvCacheEntry{{fqbn: fqbn, docsHash: maps.Clone(docsHash), path: entryPath}}, c.entries...)
+	for len(c.entries) > c.size {
+		c.remove(c.entries[len(c.entries)-1].fqbn)
+	}
+	return nil
+}
+
+// Restore copies the cached build environment of the given fqbn, if any, over
+// the one in buildPath, and returns the hashes of the documents it was built
+// from. The environment is kept in the cache.
+func (c *buildEnvCache) Restore(fqbn string, buildPath *paths.Path) (map[string]string, bool, error) {
+	for _, entry := range c.entries {
+		if entry.fqbn != fqbn {
+			continue
+		}
+		if err := syncDir(entry.path, buildPath); err != nil {
+			return nil, false, fmt.Errorf("restoring build environment: %w", err)
+		}
+		return maps.Clone(entry.docsHash), true, nil
+	}
+	return nil, false, nil
+}
+
+// remove drops the cached build environment of the given fqbn, if any.
+func (c *buildEnvCache) remove(fqbn string) {
+	for i, entry := range c.entries {
+		if entry.fqbn == fqbn {
+			entry.path.RemoveAll()
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// buildEnvCacheFolderName returns the name of the cache folder of the given
+// fqbn, the fqbn itself may contain characters not allowed in file names.
+func buildEnvCacheFolderName(fqbn string) string {
+	hash := sha256.Sum256([]byte(fqbn))
+	return hex.EncodeToString(hash[:8])
+}
+
+// syncDir makes dst a copy of src: the files are overwritten in place, so
+// that dst is never empty, and the files not in src are removed afterwards.
+func syncDir(src, dst *paths.Path) error {
+	if err := dst.MkdirAll(); err != nil {
+		return err
+	}
+	srcFiles, err := src.ReadDir()
+	if err != nil {
+		return err
+	}
+	for _, srcFile := range srcFiles {
+		dstFile := dst.Join(srcFile.Base())
+		if srcFile.IsDir() {
+			if !dstFile.IsDir() {
+				dstFile.RemoveAll()
+			}
+			if err := syncDir(srcFile, dstFile); err != nil {
+				return err
+			}
+		} else {
+			if dstFile.IsDir() {
+				if err := dstFile.RemoveAll(); err != nil {
+					return err
+				}
+			}
+			if err := srcFile.CopyTo(dstFile); err != nil {
+				return err
+			}
+		}
+	}
+	dstFiles, err := dst.ReadDir()
+	if err != nil {
+		return err
+	}
+	for _, dstFile := range dstFiles {
+		if !src.Join(dstFile.Base()).Exist() {
+			if err := dstFile.RemoveAll(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildEnvCache(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	buildPath := tmp.Join("build")
+	build := func(fqbn string) {
+		require.NoError(t, buildPath.MkdirAll())
+		require.NoError(t, buildPath.Join("compile_commands.json").WriteFile([]byte(fqbn)))
+	}
+	builtFor := func() string {
+		data, err := buildPath.Join("compile_commands.json").ReadFile()
+		require.NoError(t, err)
+		return string(data)
+	}
+	cache := newBuildEnvCache(tmp.Join("cache"), 2)
+
+	build("arduino:avr:uno")
+	require.NoError(t, buildPath.Join("sketch").MkdirAll())
+	require.NoError(t, buildPath.Join("sketch", "Sketch.ino.cpp").WriteFile([]byte("uno")))
+	require.NoError(t, cache.Store("arduino:avr:uno", map[string]string{"Sketch.ino": "1"}, buildPath))
+	// The build path is left untouched
+	require.Equal(t, "arduino:avr:uno", builtFor())
+
+	build("arduino:avr:mega")
+	require.NoError(t, buildPath.Join("sketch").RemoveAll())
+	require.NoError(t, buildPath.Join("mega.cache").WriteFile([]byte("mega")))
+	docsHash, restored, err := cache.Restore("arduino:avr:uno", buildPath)
+	require.NoError(t, err)
+	require.True(t, restored)
+	require.Equal(t, map[string]string{"Sketch.ino": "1"}, docsHash)
+	require.Equal(t, "arduino:avr:uno", builtFor())
+	require.True(t, buildPath.Join("sketch", "Sketch.ino.cpp").Exist())
+	require.False(t, buildPath.Join("mega.cache").Exist())
+
+	// The restored environment is kept in the cache
+	build("arduino:avr:mega")
+	_, restored, err = cache.Restore("arduino:avr:uno", buildPath)
+	require.NoError(t, err)
+	require.True(t, restored)
+	require.Equal(t, "arduino:avr:uno", builtFor())
+
+	// The least recently used environments are removed
+	for _, fqbn := range []string{"arduino:avr:uno", "arduino:avr:mega", "arduino:avr:nano"} {
+		build(fqbn)
+		require.NoError(t, cache.Store(fqbn, nil, buildPath))
+	}
+	_, restored, err = cache.Restore("arduino:avr:uno", buildPath)
+	require.NoError(t, err)
+	require.False(t, restored)
+	_, restored, err = cache.Restore("arduino:avr:mega", buildPath)
+	require.NoError(t, err)
+	require.True(t, restored)
+	require.Equal(t, "arduino:avr:mega", builtFor())
+	entries, err := tmp.Join("cache").ReadDir()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestBuildEnvCacheDisabled(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	buildPath := tmp.Join("build")
+	require.NoError(t, buildPath.MkdirAll())
+	cache := newBuildEnvCache(tmp.Join("cache"), 0)
+	require.NoError(t, cache.Store("arduino:avr:uno", nil, buildPath))
+	_, restored, err := cache.Restore("arduino:avr:uno", buildPath)
+	require.NoError(t, err)
+	require.False(t, restored)
+	require.False(t, tmp.Join("cache").Exist())
+}
+
+func TestSwitchBuildEnvironment(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ls.config.BuildCacheSize = 2
+	ls.tempDir = paths.New(t.TempDir())
+	ls.buildPath = ls.buildSketchRoot.Parent()
+	r := &sketchRebuilder{ls: ls}
+	require.NoError(t, ls.buildPath.MkdirAll())
+	require.NoError(t, ls.buildPath.Join("compile_commands.json").WriteFile([]byte("uno")))
+	unoDocsHash := ls.trackedIdeDocsHash()
+	ls.lastBuildSucceeded = true
+	ls.lastBuiltDocsHash = unoDocsHash
+	r.envFqbn = "arduino:avr:uno"
+
+	// Nothing cached for the new board yet: the current environment is kept
+	// until the rebuild
+	upToDate, restored := r.switchBuildEnvironment(testLogger(), r.envFqbn, "arduino:avr:mega", unoDocsHash)
+	require.False(t, upToDate)
+	require.False(t, restored)
+	require.True(t, ls.buildPath.Join("compile_commands.json").Exist())
+	require.NoError(t, ls.buildPath.Join("compile_commands.json").WriteFile([]byte("mega")))
+	r.envFqbn = "arduino:avr:mega"
+
+	// Switching back reuses the previous environment
+	ls.lastBuildSucceeded = false
+	upToDate, restored = r.switchBuildEnvironment(testLogger(), r.envFqbn, "arduino:avr:uno", unoDocsHash)
+	require.True(t, upToDate)
+	require.True(t, restored)
+	data, err := ls.buildPath.Join("compile_commands.json").ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "uno", string(data))
+}
+
+func TestSetInitialBuildFqbn(t *testing.T) {
+	r := &sketchRebuilder{}
+	r.setInitialBuildFqbn("arduino:avr:uno")
+	require.Equal(t, "arduino:avr:uno", r.envFqbn)
+
+	// A rebuild completed in the meantime already knows the current board
+	r.envFqbn = "arduino:avr:mega"
+	r.setInitialBuildFqbn("arduino:avr:uno")
+	require.Equal(t, "arduino:avr:mega", r.envFqbn)
+}
@@ -18,10 +18,14 @@ package ls
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"maps"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
@@ -33,20 +37,30 @@ import (
 	"go.bug.st/json"
 	"go.bug.st/lsp"
 	"go.bug.st/lsp/jsonrpc"
-	"google.golang.org/grpc"
 )
 
 type sketchRebuilder struct {
 	ls      *INOLanguageServer
-	trigger chan chan<- bool
+	trigger chan bool
 	cancel  func()
 	mutex   sync.Mutex
+
+	// pendingCompleted are the channels to close when the next rebuild is done
+	pendingCompleted []chan<- bool
+
+	// fullBuildRequested forces the libraries discovery in the next rebuild
+	fullBuildRequested atomic.Bool
+
+	// envFqbn is the board of the build environment in the build path and
+	// buildCache keeps the ones of the previously used boards
+	envFqbn    string
+	buildCache *buildEnvCache
 }
 
 // newSketchBuilder makes a new SketchRebuilder and returns its pointer
 func newSketchBuilder(ls *INOLanguageServer) *sketchRebuilder {
 	res := &sketchRebuilder{
-		trigger: make(chan chan<- bool, 1),
+		trigger: make(chan bool, 1),
 		cancel:  func() {},
 		ls:      ls,
 	}
@@ -57,12 +71,14 @@ func newSketchBuilder(ls *INOLanguageServer) *sketchRebuilder {
 	return res
 }
 
-func (ls *INOLanguageServer) triggerRebuildAndWait(logger jsonrpc.FunctionLogger) {
+// triggerRebuildAndWait schedules a sketch rebuild and waits for its completion,
+// the write lock is released while waiting and acquired again afterwards.
+func (ls *INOLanguageServer) triggerRebuildAndWait(logger jsonrpc.FunctionLogger, requireClangd bool) {
 	completed := make(chan bool)
 	ls.sketchRebuilder.TriggerRebuild(completed)
 	ls.writeUnlock(logger)
 	<-completed
-	ls.writeLock(logger, true)
+	ls.writeLock(logger, requireClangd)
 }
 
 func (ls *INOLanguageServer) triggerRebuild() {
@@ -75,30 +91,61 @@ func (r *sketchRebuilder) TriggerRebuild(completed chan<- bool) {
 	defer r.mutex.Unlock()
 
 	r.cancel() // Stop possibly already running builds
+	if completed != nil {
+		r.pendingCompleted = append(r.pendingCompleted, completed)
+	}
 	select {
-	case r.trigger <- completed:
+	case r.trigger <- true:
 	default:
+		// A rebuild is already scheduled
 	}
 }
 
+// takePendingCompleted returns the channels to close when the rebuild that
+// is starting is done.
+func (r *sketchRebuilder) takePendingCompleted() []chan<- bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	completed := r.pendingCompleted
+	r.pendingCompleted = nil
+	return completed
+}
+
+// TriggerFullRebuild schedule a sketch rebuild including the libraries
+// discovery, even if it's disabled on rebuilds by configuration
+func (r *sketchRebuilder) TriggerFullRebuild() {
+	r.fullBuildRequested.Store(true)
+	r.TriggerRebuild(nil)
+}
+
+// Cancel stops the running build, if any
+func (r *sketchRebuilder) Cancel() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.cancel()
+}
+
 func (r *sketchRebuilder) rebuilderLoop() {
 	logger := NewLSPFunctionLogger(color.HiMagentaString, "SKETCH REBUILD: ")
 	for {
-		completed := <-r.trigger
+		<-r.trigger
 
 		for {
-			// Concede a 200ms delay to accumulate bursts of changes
+			// Concede a delay (1s by default) to accumulate bursts of changes
 			select {
 			case <-r.trigger:
 				continue
-			case <-time.After(time.Second):
+			case <-time.After(r.ls.config.RebuildDebounce):
 			}
 			break
 		}
 
 		r.ls.progressHandler.Create("arduinoLanguageServerRebuild")
-		r.ls.progressHandler.Begin("arduinoLanguageServerRebuild", &lsp.WorkDoneProgressBegin{Title: "Building sketch"})
+		r.ls.progressHandler.Begin("arduinoLanguageServerRebuild", &lsp.WorkDoneProgressBegin{Title: "Building sketch", Cancellable: true})
 
+		completed := r.takePendingCompleted()
 		ctx, cancel := context.WithCancel(context.Background())
 		r.mutex.Lock()
 		logger.Logf("Sketch rebuild started")
@@ -109,17 +156,58 @@ func (r *sketchRebuilder) rebuilderLoop() {
 			logger.Logf("Error: %s", err)
 		}
 
+		r.mutex.Lock()
+		if ctx.Err() != nil && len(r.trigger) > 0 {
+			// Canceled by a new trigger: wait for the next rebuild
+			r.pendingCompleted = append(completed, r.pendingCompleted...)
+			completed = nil
+		}
+		r.mutex.Unlock()
 		cancel()
 		r.ls.progressHandler.End("arduinoLanguageServerRebuild", &lsp.WorkDoneProgressEnd{Message: "done"})
-		if completed != nil {
-			close(completed)
+		for _, c := range completed {
+			close(c)
 		}
 	}
 }
 
 func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context, logger jsonrpc.FunctionLogger) error {
 	ls := r.ls
-	if success, err := ls.generateBuildEnvironment(ctx, !r.ls.config.SkipLibrariesDiscoveryOnRebuild, logger); err != nil {
+	ls.readLock(logger, false)
+	builtDocsHash := ls.trackedIdeDocsHash()
+	fqbn := ls.config.Fqbn
+	ls.readUnlock(logger)
+
+	fullBuild := r.fullBuildRequested.Swap(false) || !r.ls.config.SkipLibrariesDiscoveryOnRebuild
+	upToDate := false
+	r.mutex.Lock()
+	envFqbn := r.envFqbn
+	r.envFqbn = fqbn
+	r.mutex.Unlock()
+	if envFqbn != "" && envFqbn != fqbn {
+		var restored bool
+		upToDate, restored = r.switchBuildEnvironment(logger, envFqbn, fqbn, builtDocsHash)
+		if !restored {
+			// The libraries used with the new board must be discovered again
+			fullBuild = true
+		}
+	}
+
+	var success bool
+	var err error
+	if upToDate {
+		logger.Logf("Reusing the cached build environment for %s", fqbn)
+		success = true
+	} else {
+		success, err = ls.generateBuildEnvironment(ctx, fullBuild, "arduinoLanguageServerRebuild", logger)
+	}
+	ls.writeLock(logger, false)
+	ls.lastBuildSucceeded = err == nil && success
+	if ls.lastBuildSucceeded {
+		ls.lastBuiltDocsHash = builtDocsHash
+	}
+	ls.writeUnlock(logger)
+	if err != nil {
 		return err
 	} else if !success {
 		return fmt.Errorf("build failed")
@@ -135,10 +223,14 @@ func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context
 	default:
 	}
 
-	if cppContent, err := ls.buildSketchCpp.ReadFile(); err == nil {
+	if err := ls.updateBuildSketchCpp(logger); err != nil {
+		return errors.WithMessage(err, "reading generated cpp file from sketch")
+	}
+	if cppContent, err := readPreprocessedSketch(ls.buildSketchCpp); err == nil {
 		oldVersion := ls.sketchMapper.CppText.Version
 		ls.sketchMapper = sourcemapper.CreateInoMapper(cppContent)
 		ls.sketchMapper.CppText.Version = oldVersion + 1
+		ls.recordInoVersions()
 		ls.sketchMapper.DebugLogAll()
 	} else {
 		return errors.WithMessage(err, "reading generated cpp file from sketch")
@@ -171,10 +263,76 @@ func (r *sketchRebuilder) doRebuildArduinoPreprocessedSketch(ctx context.Context
 		return err
 	}
 
+	// Replay the other tracked sketch files: their copy in the build path has been
+	// regenerated and clangd may have lost track of them
+	if ls.sketchDocsClosedInClangd {
+		return nil
+	}
+	if err := ls.openSketchDocsInClangd(logger); err != nil {
+		logger.Logf("error reinitializing clangd: %s", err)
+		return err
+	}
 	return nil
 }
 
-func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullBuild bool, logger jsonrpc.FunctionLogger) (bool, error) {
+// setInitialBuildFqbn records the board of the build environment produced by
+// the initial build, so that it's cached when the board is changed later.
+func (r *sketchRebuilder) setInitialBuildFqbn(fqbn string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.envFqbn == "" {
+		r.envFqbn = fqbn
+	}
+}
+
+// switchBuildEnvironment copies the build environment of the previous board into
+// the build cache and restores the one of the given fqbn, if cached. upToDate is
+// true if the restored environment was built from documents with the given hashes.
+func (r *sketchRebuilder) switchBuildEnvironment(logger jsonrpc.FunctionLogger, prevFqbn, fqbn string, docsHash map[string]string) (upToDate, restored bool) {
+	ls := r.ls
+	if r.buildCache == nil {
+		r.buildCache = newBuildEnvCache(ls.tempDir.Join("buildcache"), ls.config.BuildCacheSize)
+	}
+
+	ls.readLock(logger, false)
+	lastBuildSucceeded := ls.lastBuildSucceeded
+	lastBuiltDocsHash := ls.lastBuiltDocsHash
+	ls.readUnlock(logger)
+	if lastBuildSucceeded {
+		if err := r.buildCache.Store(prevFqbn, lastBuiltDocsHash, ls.buildPath); err != nil {
+			logger.Logf("Error caching the build environment of %s: %s", prevFqbn, err)
+		}
+	}
+
+	cachedDocsHash, restored, err := r.buildCache.Restore(fqbn, ls.buildPath)
+	if err != nil {
+		logger.Logf("Error restoring the build environment of %s: %s", fqbn, err)
+	}
+	if !restored {
+		return false, false
+	}
+	logger.Logf("Restored the cached build environment of %s", fqbn)
+	return maps.Equal(cachedDocsHash, docsHash), true
+}
+
+// trackedIdeDocsHash returns the hash of the content of each tracked document,
+// indexed by path.
+func (ls *INOLanguageServer) trackedIdeDocsHash() map[string]string {
+	res := map[string]string{}
+	for path, doc := range ls.trackedIdeDocs {
+		res[path] = docContentHash(doc.Text)
+	}
+	return res
+}
+
+func docContentHash(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateBuildEnvironment runs the build to produce the preprocessed sketch and the
+// compilation database, the build output is reported using the given progress token.
+func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullBuild bool, progressToken string, logger jsonrpc.FunctionLogger) (bool, error) {
 	var buildPath *paths.Path
 	if fullBuild {
 		buildPath = ls.fullBuildPath
@@ -186,33 +344,19 @@ func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullB
 	ls.readLock(logger, false)
 	sketchRoot := ls.sketchRoot
 	config := ls.config
+	fqbn := ls.config.Fqbn
 	type overridesFile struct {
 		Overrides map[string]string `json:"overrides"`
 	}
-	data := overridesFile{Overrides: map[string]string{}}
-	for uri, trackedFile := range ls.trackedIdeDocs {
-		rel, err := paths.New(uri).RelFrom(sketchRoot)
-		if err != nil {
-			ls.readUnlock(logger)
-			return false, errors.WithMessage(err, "dumping tracked files")
-		}
-		data.Overrides[rel.String()] = trackedFile.Text
-	}
+	data := overridesFile{Overrides: sketchSourceOverrides(logger, sketchRoot, ls.trackedIdeDocs)}
 	ls.readUnlock(logger)
 
 	var success bool
+	var compilerErr string
 	if config.CliPath == nil {
-		// Establish a connection with the arduino-cli gRPC server
-		conn, err := grpc.Dial(config.CliDaemonAddress, grpc.WithInsecure(), grpc.WithBlock())
-		if err != nil {
-			return false, fmt.Errorf("error connecting to arduino-cli rpc server: %w", err)
-		}
-		defer conn.Close()
-		client := rpc.NewArduinoCoreServiceClient(conn)
-
 		compileReq := &rpc.CompileRequest{
 			Instance:                      &rpc.Instance{Id: int32(config.CliInstanceNumber)},
-			Fqbn:                          config.Fqbn,
+			Fqbn:                          fqbn,
 			SketchPath:                    sketchRoot.String(),
 			SourceOverride:                data.Overrides,
 			BuildPath:                     buildPath.String(),
@@ -223,35 +367,44 @@ func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullB
 		compileReqJSON, _ := json.MarshalIndent(compileReq, "", "  ")
 		logger.Logf("Running build with: %s", string(compileReqJSON))
 
-		compRespStream, err := client.Compile(context.Background(), compileReq)
-		if err != nil {
-			return false, fmt.Errorf("error running compile: %w", err)
-		}
-
-		// Loop and consume the server stream until all the operations are done.
-		stdout := ""
-		stderr := ""
-		for {
-			compResp, err := compRespStream.Recv()
-			if err == io.EOF {
-				success = true
-				logger.Logf("Compile successful!")
-				break
-			}
+		err := ls.callCliDaemon(ctx, logger, func(client rpc.ArduinoCoreServiceClient) error {
+			compRespStream, err := client.Compile(ctx, compileReq)
 			if err != nil {
-				logger.Logf("build stdout:")
-				logger.Logf(stdout)
-				logger.Logf("build stderr:")
-				logger.Logf(stderr)
-				return false, fmt.Errorf("error running compile: %w", err)
+				return fmt.Errorf("error running compile: %w", err)
 			}
 
-			if resp := compResp.GetOutStream(); resp != nil {
-				stdout += string(resp)
-			}
-			if resperr := compResp.GetErrStream(); resperr != nil {
-				stderr += string(resperr)
+			// Loop and consume the server stream until all the operations are done.
+			stdout := ""
+			stderr := ""
+			defer func() { compilerErr = stderr }()
+			progress := &buildProgressWriter{progressHandler: ls.progressHandler, token: progressToken}
+			for {
+				compResp, err := compRespStream.Recv()
+				if err == io.EOF {
+					success = true
+					logger.Logf("Compile successful!")
+					return nil
+				}
+				if err != nil {
+					logger.Logf("build stdout:")
+					logger.Logf(stdout)
+					logger.Logf("build stderr:")
+					logger.Logf(stderr)
+					return fmt.Errorf("error running compile: %w", err)
+				}
+
+				if resp := compResp.GetOutStream(); resp != nil {
+					stdout += string(resp)
+					progress.Write(resp)
+				}
+				if resperr := compResp.GetErrStream(); resperr != nil {
+					stderr += string(resperr)
+				}
 			}
+		})
+		if err != nil {
+			ls.reportMissingCore(logger, fqbn, err.Error())
+			return false, err
 		}
 
 	} else {
@@ -271,19 +424,8 @@ func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullB
 		}
 
 		// Run arduino-cli to perform the build
-		args := []string{
-			"--config-file", config.CliConfigPath.String(),
-			"compile",
-			"--fqbn", config.Fqbn,
-			"--only-compilation-database",
-			"--source-override", overridesJSON.String(),
-			"--build-path", buildPath.String(),
-			"--format", "json",
-		}
-		if !fullBuild {
-			args = append(args, "--skip-libraries-discovery")
-		}
-		args = append(args, sketchRoot.String())
+		jsonArgs := ls.cliJSONOutputArgs(logger)
+		args := cliCompileArgs(config.CliConfigPath, fqbn, overridesJSON, buildPath, sketchRoot, fullBuild, jsonArgs)
 
 		cmd, err := paths.NewProcessFromPath(nil, config.CliPath, args...)
 		if err != nil {
@@ -294,6 +436,7 @@ func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullB
 		cmd.SetDirFromPath(sketchRoot)
 		logger.Logf("running: %s", strings.Join(args, " "))
 		if err := cmd.RunWithinContext(ctx); err != nil {
+			ls.reportMissingCore(logger, fqbn, cmdOutput.String())
 			return false, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
 		}
 
@@ -313,15 +456,159 @@ func (ls *INOLanguageServer) generateBuildEnvironment(ctx context.Context, fullB
 		}
 		logger.Logf("arduino-cli output: %s", cmdOutput)
 		success = res.Success
+		compilerErr = res.CompilerErr
 	}
 
 	if fullBuild {
 		ls.CopyFullBuildResults(logger, buildPath)
-		return ls.generateBuildEnvironment(ctx, false, logger)
+		return ls.generateBuildEnvironment(ctx, false, progressToken, logger)
 	}
 
 	// TODO: do canonicalization directly in `arduino-cli`
-	canonicalizeCompileCommandsJSON(buildPath.Join("compile_commands.json"))
+	if err := canonicalizeCompileCommandsJSON(buildPath.Join("compile_commands.json"), ls.config.Defines, logger); err != nil {
+		logger.Logf("error canonicalizing compile_commands.json: %s", err)
+		ls.reportBuildEnvironmentError(logger, err, compilerErr)
+		return false, err
+	}
 
+	if success {
+		ls.writeLock(logger, false)
+		ls.buildEnvErrorReported = ""
+		ls.writeUnlock(logger)
+	}
 	return success, nil
 }
+
+// reportBuildEnvironmentError notifies the user that the build environment
+// could not be prepared. The notification is sent once for each distinct error,
+// until a build succeeds.
+func (ls *INOLanguageServer) reportBuildEnvironmentError(logger jsonrpc.FunctionLogger, err error, compilerErr string) {
+	ls.writeLock(logger, false)
+	reported := ls.buildEnvErrorReported == err.Error()
+	ls.buildEnvErrorReported = err.Error()
+	ls.writeUnlock(logger)
+	if reported {
+		return
+	}
+
+	msg := "Could not prepare the sketch build environment: " + err.Error()
+	if compilerErr != "" {
+		msg += "\n" + compilerErr
+	}
+	ls.showMessage(logger, lsp.MessageTypeError, msg)
+}
+
+// missingCoreMessage returns the message for the user if the build output
+// reports that the core of the given board is not installed, otherwise it
+// returns an empty string.
+func missingCoreMessage(fqbn, buildOutput string) string {
+	if !strings.Contains(strings.ToLower(buildOutput), "platform not installed") {
+		return ""
+	}
+	coreID, err := fqbnCoreID(fqbn)
+	if err != nil {
+		return ""
+	}
+	return "Editor support may be inaccurate because the core `" + coreID + "` for the board `" + fqbn + "` is not installed." +
+		" Use the Boards Manager or run `arduino-cli core install " + coreID + "` to install it."
+}
+
+// reportMissingCore notifies the user if the build failed because the core of
+// the board is not installed. The notification is sent once for each board.
+func (ls *INOLanguageServer) reportMissingCore(logger jsonrpc.FunctionLogger, fqbn, buildOutput string) {
+	msg := missingCoreMessage(fqbn, buildOutput)
+	if msg == "" {
+		return
+	}
+	logger.Logf("%s", msg)
+
+	ls.writeLock(logger, false)
+	reported := ls.missingCoreReported == fqbn
+	ls.missingCoreReported = fqbn
+	ls.writeUnlock(logger)
+	if !reported {
+		go func() {
+			defer streams.CatchAndLogPanic()
+			ls.showMessage(logger, lsp.MessageTypeError, msg)
+		}()
+	}
+}
+
+// sketchSourceOverrides returns the content of the tracked documents that must
+// override the files of the sketch during the build, indexed by path relative to
+// the sketch root. The documents outside the sketch are skipped.
+func sketchSourceOverrides(logger jsonrpc.FunctionLogger, sketchRoot *paths.Path, trackedIdeDocs map[string]lsp.TextDocumentItem) map[string]string {
+	overrides := map[string]string{}
+	for path, trackedFile := range trackedIdeDocs {
+		if inside, err := paths.New(path).IsInsideDir(sketchRoot); err != nil {
+			logger.Logf("source override skipped for %s: could not determine if inside the sketch %s: %s", path, sketchRoot, err)
+			continue
+		} else if !inside {
+			logger.Logf("source override skipped for %s: not inside the sketch %s", path, sketchRoot)
+			continue
+		}
+		rel, err := paths.New(path).RelFrom(sketchRoot)
+		if err != nil {
+			logger.Logf("source override skipped for %s: could not make it relative to %s: %s", path, sketchRoot, err)
+			continue
+		}
+		logger.Logf("source override for %s (%d bytes)", rel, len(trackedFile.Text))
+		overrides[rel.String()] = trackedFile.Text
+	}
+	return overrides
+}
+
+// buildProgressWriter splits the build output in lines and forwards the most
+// significant ones as progress reports.
+type buildProgressWriter struct {
+	progressHandler *progressProxyHandler
+	token           string
+	buffer          []byte
+}
+
+// Write implements io.Writer
+func (w *buildProgressWriter) Write(data []byte) (int, error) {
+	w.buffer = append(w.buffer, data...)
+	for {
+		idx := bytes.IndexByte(w.buffer, '\n')
+		if idx == -1 {
+			break
+		}
+		line := strings.TrimSpace(string(w.buffer[:idx]))
+		w.buffer = w.buffer[idx+1:]
+		if isBuildProgressLine(line) {
+			w.progressHandler.Report(w.token, &lsp.WorkDoneProgressReport{Message: line})
+		}
+	}
+	return len(data), nil
+}
+
+// isBuildProgressLine returns true if the given line of build output describes
+// a build step (like "Compiling library ...") instead of a compiler invocation.
+func isBuildProgressLine(line string) bool {
+	for _, prefix := range []string{"Detecting ", "Generating ", "Compiling ", "Linking "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cliCompileArgs returns the arguments to run arduino-cli to generate the
+// compilation database of the sketch, jsonArgs are the flags to get the
+// output in JSON format supported by the installed arduino-cli.
+func cliCompileArgs(cliConfigPath *paths.Path, fqbn string, overridesJSON, buildPath, sketchRoot *paths.Path, fullBuild bool, jsonArgs []string) []string {
+	args := []string{
+		"--config-file", cliConfigPath.String(),
+		"compile",
+		"--fqbn", fqbn,
+		"--only-compilation-database",
+		"--source-override", overridesJSON.String(),
+		"--build-path", buildPath.String(),
+	}
+	args = append(args, jsonArgs...)
+	if !fullBuild {
+		args = append(args, "--skip-libraries-discovery")
+	}
+	return append(args, sketchRoot.String())
+}
@@ -0,0 +1,96 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+	"go.bug.st/lsp"
+)
+
+func TestSketchSourceOverrides(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	sketchRoot := tmp.Join("Sketch")
+	doc := func(p *paths.Path, text string) lsp.TextDocumentItem {
+		return lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(p), Text: text}
+	}
+	trackedIdeDocs := map[string]lsp.TextDocumentItem{}
+	for p, text := range map[*paths.Path]string{
+		sketchRoot.Join("Sketch.ino"):         "void setup() {}\nvoid loop() {}\n",
+		sketchRoot.Join("src", "helper.h"):    "int helper();\n",
+		tmp.Join("libraries", "Lib", "Lib.h"): "// library file opened in the editor\n",
+	} {
+		trackedIdeDocs[p.String()] = doc(p, text)
+	}
+
+	overrides := sketchSourceOverrides(testLogger(), sketchRoot, trackedIdeDocs)
+	require.Equal(t, map[string]string{
+		"Sketch.ino":                          "void setup() {}\nvoid loop() {}\n",
+		paths.New("src", "helper.h").String(): "int helper();\n",
+	}, overrides)
+}
+
+func TestMissingCoreMessage(t *testing.T) {
+	require.Equal(t,
+		"Editor support may be inaccurate because the core `esp32:esp32` for the board `esp32:esp32:esp32s3:CDCOnBoot=cdc` is not installed."+
+			" Use the Boards Manager or run `arduino-cli core install esp32:esp32` to install it.",
+		missingCoreMessage("esp32:esp32:esp32s3:CDCOnBoot=cdc", `{"error": "Error during build: Platform 'esp32:esp32' not found: platform not installed"}`))
+	require.Empty(t, missingCoreMessage("arduino:avr:uno", "Error during build: exit status 1"))
+	require.Empty(t, missingCoreMessage("", "platform not installed"))
+}
+
+func TestReportBuildEnvironmentError(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ideOut := newTestIDEConnection(ls)
+	logger := testLogger()
+
+	// The same error is reported only once...
+	ls.reportBuildEnvironmentError(logger, errors.New("invalid compile_commands.json"), "")
+	ls.reportBuildEnvironmentError(logger, errors.New("invalid compile_commands.json"), "")
+	require.Equal(t, 1, strings.Count(ideOut.String(), "window/showMessage"))
+
+	// ...a different one is reported again
+	ls.reportBuildEnvironmentError(logger, errors.New("compile_commands.json not found"), "")
+	require.Equal(t, 2, strings.Count(ideOut.String(), "window/showMessage"))
+
+	// and, after a successful build, the first one too
+	ls.buildEnvErrorReported = ""
+	ls.reportBuildEnvironmentError(logger, errors.New("compile_commands.json not found"), "")
+	require.Equal(t, 3, strings.Count(ideOut.String(), "window/showMessage"))
+}
+
+func TestTriggerRebuildKeepsAllCompleted(t *testing.T) {
+	r := &sketchRebuilder{trigger: make(chan bool, 1), cancel: func() {}}
+	canceled := 0
+	var completed []chan<- bool
+	for i := 0; i < 3; i++ {
+		c := make(chan bool)
+		completed = append(completed, c)
+		r.cancel = func() { canceled++ }
+		r.TriggerRebuild(c)
+	}
+	r.TriggerRebuild(nil)
+
+	// A single rebuild is scheduled but all the callers are notified
+	require.Len(t, r.trigger, 1)
+	require.Equal(t, 4, canceled)
+	require.Equal(t, completed, r.takePendingCompleted())
+	require.Empty(t, r.takePendingCompleted())
+}
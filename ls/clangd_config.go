@@ -0,0 +1,60 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/arduino/go-paths-helper"
+	"gopkg.in/yaml.v3"
+)
+
+// sketchClangdConfig returns the fragments of the .clangd configuration file in
+// the given sketch folder, ready to be appended to the clangd configuration in
+// the build path. The CompilationDatabase settings are removed because the
+// compilation database is always the one generated in the build path.
+func sketchClangdConfig(sketchRoot *paths.Path) (string, error) {
+	data, err := sketchRoot.Join(".clangd").ReadFile()
+	if err != nil {
+		return "", err
+	}
+
+	res := ""
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var fragment map[string]interface{}
+		if err := decoder.Decode(&fragment); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("parsing %s: %w", sketchRoot.Join(".clangd"), err)
+		}
+		if fragment == nil {
+			continue
+		}
+		if compileFlags, ok := fragment["CompileFlags"].(map[string]interface{}); ok {
+			delete(compileFlags, "CompilationDatabase")
+		}
+		out, err := yaml.Marshal(fragment)
+		if err != nil {
+			return "", err
+		}
+		res += "---\n" + string(out)
+	}
+	return res, nil
+}
@@ -0,0 +1,44 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketchClangdConfig(t *testing.T) {
+	sketchRoot := paths.New(t.TempDir())
+	_, err := sketchClangdConfig(sketchRoot)
+	require.Error(t, err)
+
+	require.NoError(t, sketchRoot.Join(".clangd").WriteFile([]byte(`CompileFlags:
+  Add: [-I/opt/include]
+  CompilationDatabase: /somewhere/else
+---
+Diagnostics:
+  Suppress: [pragma_unknown]
+`)))
+	conf, err := sketchClangdConfig(sketchRoot)
+	require.NoError(t, err)
+	require.Equal(t, "---\nCompileFlags:\n    Add:\n        - -I/opt/include\n---\nDiagnostics:\n    Suppress:\n        - pragma_unknown\n", conf)
+
+	require.NoError(t, sketchRoot.Join(".clangd").WriteFile([]byte("CompileFlags: [")))
+	_, err = sketchClangdConfig(sketchRoot)
+	require.Error(t, err)
+}
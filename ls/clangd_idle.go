@@ -0,0 +1,113 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"time"
+
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+// clangdIdleWatcher stops clangd, to free the memory used by its index, when
+// no requests are received for the configured ClangdIdleTimeout. clangd is
+// started again by the next request that needs it (see writeLock).
+func (ls *INOLanguageServer) clangdIdleWatcher(logger jsonrpc.FunctionLogger, closing <-chan bool) {
+	timeout := ls.config.ClangdIdleTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+		}
+		if ls.clangdIdleTime() < timeout {
+			continue
+		}
+
+		ls.writeLock(logger, false)
+		if ls.Clangd != nil && ls.clangdIdleTime() >= timeout {
+			logger.Logf("No activity for %s, stopping clangd", timeout)
+			ls.stopClangd()
+		}
+		ls.writeUnlock(logger)
+	}
+}
+
+// stopClangd stops clangd, it's started again by the next request that needs
+// it. It must be called with the write lock held.
+func (ls *INOLanguageServer) stopClangd() {
+	ls.Clangd.stoppedForInactivity.Store(true)
+	ls.Clangd.Close()
+	ls.Clangd = nil
+	ls.clangdStoppedForInactivity = true
+}
+
+func (ls *INOLanguageServer) clangdIdleTime() time.Duration {
+	return time.Since(time.Unix(0, ls.clangdLastActivity.Load()))
+}
+
+// restartClangd starts again clangd after it has been stopped for inactivity
+// and opens again all the tracked documents. It must be called with the write
+// lock held: the lock is released while clangd is initialized, meanwhile the
+// other requests that need clangd wait for it in writeLock.
+func (ls *INOLanguageServer) restartClangd(logger jsonrpc.FunctionLogger) {
+	logger.Logf("Restarting clangd")
+	ls.clangdRestarting = true
+	defer ls.clangdStarted.Broadcast()
+
+	clangd := newClangdLSPClient(logger, ls.clangdDataFolder, ls)
+	logger.Logf(yellow.Sprintf("unlocked (restarting clangd)"))
+	ls.dataMux.Unlock()
+	err := ls.initializeClangd(logger, clangd)
+	ls.dataMux.Lock()
+	logger.Logf(yellow.Sprintf("locked (restarting clangd)"))
+	ls.clangdRestarting = false
+	if err != nil {
+		logger.Logf("error restarting clangd: %s", err)
+		clangd.stoppedForInactivity.Store(true)
+		clangd.Close()
+		return
+	}
+	ls.Clangd = clangd
+	ls.clangdStoppedForInactivity = false
+
+	inoOpened := false
+	for _, ideTextDocItem := range ls.trackedIdeDocs {
+		if ls.sketchDocIsClosedInClangd(ideTextDocItem.URI) {
+			continue
+		}
+		// All the .ino files are mapped into the same .ino.cpp
+		if ideTextDocItem.URI.Ext() == ".ino" {
+			if inoOpened {
+				continue
+			}
+			inoOpened = true
+		}
+		clangTextDocItem, err := ls.ide2ClangTextDocumentItem(logger, ideTextDocItem)
+		if err != nil {
+			logger.Logf("error converting tracked document %s: %s", ideTextDocItem.URI, err)
+			continue
+		}
+		if err := ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
+			TextDocument: clangTextDocItem,
+		}); err != nil {
+			logger.Logf("error opening %s in clangd: %s", ideTextDocItem.URI, err)
+			return
+		}
+	}
+}
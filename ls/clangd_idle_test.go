@@ -0,0 +1,90 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClangdIdleWatcherStopsClangd(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	clangdIn := newTestClangdClient(ls)
+	clangd := ls.Clangd
+	ls.config.ClangdIdleTimeout = 40 * time.Millisecond
+	ls.clangdLastActivity.Store(time.Now().UnixNano())
+
+	// The loggers are created before starting the goroutines, they reset the color settings
+	logger := testLogger()
+	idleLogger := testLogger()
+	closing := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		ls.clangdIdleWatcher(idleLogger, closing)
+		close(stopped)
+	}()
+	// Wait for the watcher to stop, it must not log during the other tests
+	defer func() { <-stopped }()
+	defer close(closing)
+
+	require.Eventually(t, func() bool {
+		ls.readLock(logger, false)
+		defer ls.readUnlock(logger)
+		return ls.Clangd == nil
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, ls.clangdStoppedForInactivity)
+	require.True(t, clangd.stoppedForInactivity.Load())
+	require.Contains(t, clangdIn.String(), `"method":"exit"`)
+}
+
+func TestWaitClangdRestart(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ls.clangdStarted = sync.NewCond(&ls.dataMux)
+	ls.Clangd = nil
+	ls.clangdStoppedForInactivity = true
+	// Another request is restarting clangd, the lock is released meanwhile
+	ls.clangdRestarting = true
+
+	logger := testLogger()
+	locked := make(chan bool)
+	go func() {
+		ls.readLock(logger, true)
+		started := ls.Clangd != nil
+		ls.readUnlock(logger)
+		locked <- started
+	}()
+	select {
+	case <-locked:
+		require.FailNow(t, "the request didn't wait for clangd")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ls.dataMux.Lock()
+	ls.clangdRestarting = false
+	ls.clangdStoppedForInactivity = false
+	ls.Clangd = &clangdLSPClient{conn: &fakeClangdConn{}, ls: ls}
+	ls.clangdStarted.Broadcast()
+	ls.dataMux.Unlock()
+	select {
+	case started := <-locked:
+		require.True(t, started)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the request is still waiting for clangd")
+	}
+}
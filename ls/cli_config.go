@@ -0,0 +1,192 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arduino/go-paths-helper"
+	"go.bug.st/json"
+	"go.bug.st/lsp/jsonrpc"
+	"gopkg.in/yaml.v3"
+)
+
+// runArduinoCLI runs arduino-cli with the configured config file and returns
+// its standard output.
+func (ls *INOLanguageServer) runArduinoCLI(logger jsonrpc.FunctionLogger, args ...string) ([]byte, error) {
+	args = append([]string{"--config-file", ls.config.CliConfigPath.String()}, args...)
+	cmd, err := paths.NewProcessFromPath(nil, ls.config.CliPath, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %s", strings.Join(args, " "), err)
+	}
+	cmdOutput := &bytes.Buffer{}
+	cmd.RedirectStdoutTo(cmdOutput)
+	logger.Logf("running: %s", strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running %s: %s", strings.Join(args, " "), err)
+	}
+	return cmdOutput.Bytes(), nil
+}
+
+// cliJSONOutputArgs returns the flags that make arduino-cli print its output in
+// JSON format. Newer arduino-cli versions use `--json` while the older ones only
+// understand `--format json`: the installed version is detected on the first
+// call and the result is reused for all the subsequent invocations.
+func (ls *INOLanguageServer) cliJSONOutputArgs(logger jsonrpc.FunctionLogger) []string {
+	ls.cliJSONOutputArgsOnce.Do(func() {
+		ls.cliJSONOutputArgsCache = ls.detectCliJSONOutputArgs(logger)
+		logger.Logf("arduino-cli JSON output flags: %s", strings.Join(ls.cliJSONOutputArgsCache, " "))
+	})
+	return ls.cliJSONOutputArgsCache
+}
+
+func (ls *INOLanguageServer) detectCliJSONOutputArgs(logger jsonrpc.FunctionLogger) []string {
+	out, err := ls.runArduinoCLI(logger, "version", "--format", "json")
+	if err != nil {
+		// `--format` may have been removed, check if `--json` works instead
+		if _, err := ls.runArduinoCLI(logger, "version", "--json"); err == nil {
+			return []string{"--json"}
+		}
+		logger.Logf("could not detect arduino-cli version: %s", err)
+		return []string{"--format", "json"}
+	}
+	version, err := parseCliVersion(out)
+	if err != nil {
+		logger.Logf("could not detect arduino-cli version: %s", err)
+		return []string{"--format", "json"}
+	}
+	logger.Logf("detected arduino-cli version %s", version)
+	return cliJSONOutputArgsForVersion(version)
+}
+
+// parseCliVersion parses the output of `arduino-cli version --format json`
+func parseCliVersion(out []byte) (string, error) {
+	var res struct {
+		VersionString string `json:"VersionString"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", fmt.Errorf("parsing arduino-cli output: %w", err)
+	}
+	if res.VersionString == "" {
+		return "", fmt.Errorf("parsing arduino-cli output: version not found")
+	}
+	return res.VersionString, nil
+}
+
+// cliJSONOutputArgsForVersion returns the JSON output flags supported by the
+// given arduino-cli version. Development builds (for example "git-snapshot" or
+// "nightly-20240101") are assumed to be recent.
+func cliJSONOutputArgsForVersion(version string) []string {
+	major, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	if n, err := strconv.Atoi(major); err == nil && n < 1 {
+		return []string{"--format", "json"}
+	}
+	return []string{"--json"}
+}
+
+// dataFolderFromArduinoCLIProcess returns the Arduino data folder configured in
+// arduino-cli. The output of the config commands changed across the arduino-cli
+// versions so, in order:
+//   - `config get directories.data` (arduino-cli >= 1.0)
+//   - `config dump` (older versions)
+//   - the directories.data key read directly from the config file
+//
+// are tried until one succeeds.
+func (ls *INOLanguageServer) dataFolderFromArduinoCLIProcess(logger jsonrpc.FunctionLogger) (string, error) {
+	jsonArgs := ls.cliJSONOutputArgs(logger)
+
+	out, err := ls.runArduinoCLI(logger, append([]string{"config", "get", "directories.data"}, jsonArgs...)...)
+	if err == nil {
+		var dataDir string
+		if dataDir, err = parseConfigGetDataDir(out); err == nil {
+			return dataDir, nil
+		}
+	}
+	logger.Logf("could not get the data folder with `config get`, trying `config dump`: %v", err)
+
+	out, err = ls.runArduinoCLI(logger, append([]string{"config", "dump"}, jsonArgs...)...)
+	if err == nil {
+		var dataDir string
+		if dataDir, err = parseConfigDumpDataDir(out); err == nil {
+			return dataDir, nil
+		}
+	}
+	logger.Logf("could not get the data folder with `config dump`, reading the config file: %v", err)
+
+	dataDir, err := readDataDirFromConfigFile(ls.config.CliConfigPath)
+	if err != nil {
+		return "", fmt.Errorf("error getting arduino data dir: %w", err)
+	}
+	return dataDir, nil
+}
+
+// parseConfigGetDataDir parses the output of `arduino-cli config get directories.data --json`
+func parseConfigGetDataDir(out []byte) (string, error) {
+	var res string
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", fmt.Errorf("parsing arduino-cli output: %w", err)
+	}
+	if res == "" {
+		return "", fmt.Errorf("parsing arduino-cli output: empty data dir")
+	}
+	return res, nil
+}
+
+type cliConfigDirectories struct {
+	Directories struct {
+		Data string `json:"data" yaml:"data"`
+	} `json:"directories" yaml:"directories"`
+}
+
+// parseConfigDumpDataDir parses the output of `arduino-cli config dump --json`, the
+// configuration is wrapped in a "config" object since arduino-cli 1.0.
+func parseConfigDumpDataDir(out []byte) (string, error) {
+	var res struct {
+		cliConfigDirectories
+		Config *cliConfigDirectories `json:"config"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", fmt.Errorf("parsing arduino-cli output: %w", err)
+	}
+	dataDir := res.Directories.Data
+	if res.Config != nil && res.Config.Directories.Data != "" {
+		dataDir = res.Config.Directories.Data
+	}
+	if dataDir == "" {
+		return "", fmt.Errorf("parsing arduino-cli output: data dir not found")
+	}
+	return dataDir, nil
+}
+
+// readDataDirFromConfigFile reads the directories.data key from the given
+// arduino-cli YAML config file.
+func readDataDirFromConfigFile(configFile *paths.Path) (string, error) {
+	data, err := configFile.ReadFile()
+	if err != nil {
+		return "", err
+	}
+	var res cliConfigDirectories
+	if err := yaml.Unmarshal(data, &res); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", configFile, err)
+	}
+	if res.Directories.Data == "" {
+		return "", fmt.Errorf("directories.data not set in %s", configFile)
+	}
+	return res.Directories.Data, nil
+}
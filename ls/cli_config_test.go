@@ -0,0 +1,113 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigGetDataDir(t *testing.T) {
+	res, err := parseConfigGetDataDir([]byte(`"/home/user/.arduino15"` + "\n"))
+	require.NoError(t, err)
+	require.Equal(t, "/home/user/.arduino15", res)
+
+	_, err = parseConfigGetDataDir([]byte(`""`))
+	require.Error(t, err)
+	_, err = parseConfigGetDataDir([]byte(`Error: unknown command "get"`))
+	require.Error(t, err)
+}
+
+func TestParseConfigDumpDataDir(t *testing.T) {
+	// arduino-cli >= 1.0
+	res, err := parseConfigDumpDataDir([]byte(`{"config":{"directories":{"data":"/home/user/.arduino15"}}}`))
+	require.NoError(t, err)
+	require.Equal(t, "/home/user/.arduino15", res)
+
+	// arduino-cli < 1.0
+	res, err = parseConfigDumpDataDir([]byte(`{"directories":{"data":"/opt/arduino15","user":"/home/user/Arduino"}}`))
+	require.NoError(t, err)
+	require.Equal(t, "/opt/arduino15", res)
+
+	_, err = parseConfigDumpDataDir([]byte(`{"config":{}}`))
+	require.Error(t, err)
+}
+
+func TestReadDataDirFromConfigFile(t *testing.T) {
+	tmp, err := paths.MkTempDir("", "cli-config")
+	require.NoError(t, err)
+	defer tmp.RemoveAll()
+
+	configFile := tmp.Join("arduino-cli.yaml")
+	require.NoError(t, configFile.WriteFile([]byte("board_manager:\n  additional_urls: []\ndirectories:\n  data: /home/user/.arduino15\n  user: /home/user/Arduino\n")))
+	res, err := readDataDirFromConfigFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, "/home/user/.arduino15", res)
+
+	require.NoError(t, configFile.WriteFile([]byte("board_manager:\n  additional_urls: []\n")))
+	_, err = readDataDirFromConfigFile(configFile)
+	require.Error(t, err)
+
+	_, err = readDataDirFromConfigFile(tmp.Join("missing.yaml"))
+	require.Error(t, err)
+}
+
+func TestParseCliVersion(t *testing.T) {
+	version, err := parseCliVersion([]byte(`{"Application":"arduino-cli","VersionString":"1.0.3","Commit":"abcdef0","Status":"alpha","Date":"2024-07-22T00:00:00Z"}`))
+	require.NoError(t, err)
+	require.Equal(t, "1.0.3", version)
+
+	_, err = parseCliVersion([]byte(`{"Application":"arduino-cli"}`))
+	require.Error(t, err)
+	_, err = parseCliVersion([]byte(`arduino-cli  Version: 1.0.3`))
+	require.Error(t, err)
+}
+
+func TestCliJSONOutputArgsForVersion(t *testing.T) {
+	require.Equal(t, []string{"--format", "json"}, cliJSONOutputArgsForVersion("0.35.3"))
+	require.Equal(t, []string{"--json"}, cliJSONOutputArgsForVersion("1.0.0"))
+	require.Equal(t, []string{"--json"}, cliJSONOutputArgsForVersion("v1.1.0-rc.1"))
+	require.Equal(t, []string{"--json"}, cliJSONOutputArgsForVersion("git-snapshot"))
+	require.Equal(t, []string{"--json"}, cliJSONOutputArgsForVersion("nightly-20240101"))
+}
+
+func TestCliJSONOutputArgsDetectedOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake arduino-cli is a shell script")
+	}
+	tmp := paths.New(t.TempDir())
+	calls := tmp.Join("calls")
+	cli := tmp.Join("arduino-cli")
+	// Simulate an arduino-cli that doesn't know the --format flag
+	script := "#!/bin/sh\necho \"$@\" >> '" + calls.String() + "'\n" +
+		"for arg in \"$@\"; do [ \"$arg\" = \"--format\" ] && exit 1; done\n" +
+		"echo '{\"VersionString\":\"1.0.0\"}'\n"
+	require.NoError(t, cli.WriteFile([]byte(script)))
+	require.NoError(t, os.Chmod(cli.String(), 0755))
+
+	ls := &INOLanguageServer{config: &Config{CliPath: cli, CliConfigPath: tmp.Join("arduino-cli.yaml")}}
+	require.Equal(t, []string{"--json"}, ls.cliJSONOutputArgs(testLogger()))
+	require.Equal(t, []string{"--json"}, ls.cliJSONOutputArgs(testLogger()))
+
+	data, err := calls.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "--config-file "+tmp.Join("arduino-cli.yaml").String()+" version --format json\n"+
+		"--config-file "+tmp.Join("arduino-cli.yaml").String()+" version --json\n", string(data))
+}
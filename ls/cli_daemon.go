@@ -0,0 +1,164 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
+	"github.com/arduino/arduino-language-server/streams"
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// cliDaemonDialOptions returns the grpc.DialOptions required to connect to the
+// arduino-cli daemon with the configured credentials. An insecure connection is
+// used only if neither a TLS certificate nor a token has been configured.
+func (ls *INOLanguageServer) cliDaemonDialOptions() ([]grpc.DialOption, error) {
+	opts := []grpc.DialOption{}
+	if certFile := ls.config.CliDaemonTLSCert; certFile != nil {
+		creds, err := credentials.NewClientTLSFromFile(certFile.String(), "")
+		if err != nil {
+			return nil, fmt.Errorf("loading arduino-cli daemon TLS certificate: %w", err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else if ls.config.CliDaemonToken != "" {
+		// A token must not be sent in clear text: use TLS with the system root CAs
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if token := ls.config.CliDaemonToken; token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(&cliDaemonTokenCredentials{token: token}))
+	}
+	return opts, nil
+}
+
+// cliDaemonTokenCredentials adds a bearer token to every call made to the arduino-cli daemon
+type cliDaemonTokenCredentials struct {
+	token string
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials
+func (c *cliDaemonTokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials
+func (c *cliDaemonTokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// cliDaemonMaxAttempts is the number of times a call to the arduino-cli daemon is
+// attempted before giving up when the daemon is unavailable.
+const cliDaemonMaxAttempts = 4
+
+// cliDaemonDialTimeout is the maximum time allowed to establish the connection
+// to the arduino-cli daemon in a single attempt. Without it, dialing a daemon
+// that is not ready would block until the request is cancelled.
+const cliDaemonDialTimeout = 5 * time.Second
+
+// cliDaemonConnection returns the connection to the arduino-cli daemon, a new
+// connection is dialed if there isn't one already established.
+func (ls *INOLanguageServer) cliDaemonConnection(ctx context.Context) (*grpc.ClientConn, error) {
+	ls.cliDaemonMux.Lock()
+	defer ls.cliDaemonMux.Unlock()
+
+	if ls.cliDaemonConn != nil {
+		return ls.cliDaemonConn, nil
+	}
+	dialOpts, err := ls.cliDaemonDialOptions()
+	if err != nil {
+		return nil, err
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, cliDaemonDialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, ls.config.CliDaemonAddress, append(dialOpts, grpc.WithBlock())...)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, fmt.Errorf("error connecting to arduino-cli rpc server at %s: no answer after %s", ls.config.CliDaemonAddress, cliDaemonDialTimeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("error connecting to arduino-cli rpc server: %w", err)
+	}
+	ls.cliDaemonConn = conn
+	return conn, nil
+}
+
+// closeCliDaemonConnection closes the given connection to the arduino-cli daemon,
+// the next call to cliDaemonConnection will dial a new one.
+func (ls *INOLanguageServer) closeCliDaemonConnection(conn *grpc.ClientConn) {
+	ls.cliDaemonMux.Lock()
+	defer ls.cliDaemonMux.Unlock()
+
+	if conn == nil || ls.cliDaemonConn != conn {
+		return
+	}
+	_ = conn.Close()
+	ls.cliDaemonConn = nil
+}
+
+// callCliDaemon runs the given function with a client for the arduino-cli daemon.
+// If the daemon is unavailable (for example because it has been restarted) the
+// connection is dialed again and the call is retried with an exponential backoff.
+func (ls *INOLanguageServer) callCliDaemon(ctx context.Context, logger jsonrpc.FunctionLogger, call func(rpc.ArduinoCoreServiceClient) error) error {
+	backoff := 500 * time.Millisecond
+	var err error
+	for attempt := 1; ; attempt++ {
+		var conn *grpc.ClientConn
+		conn, err = ls.cliDaemonConnection(ctx)
+		if err == nil {
+			err = call(rpc.NewArduinoCoreServiceClient(conn))
+			if status.Code(err) != codes.Unavailable {
+				ls.cliDaemonMux.Lock()
+				ls.cliDaemonUnreachableReported = false
+				ls.cliDaemonMux.Unlock()
+				return err
+			}
+			ls.closeCliDaemonConnection(conn)
+		}
+		if ctx.Err() != nil || attempt == cliDaemonMaxAttempts {
+			break
+		}
+
+		logger.Logf("arduino-cli daemon unavailable, retrying in %s: %s", backoff, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	// Notify the user only once, until the daemon comes back
+	ls.cliDaemonMux.Lock()
+	reported := ls.cliDaemonUnreachableReported
+	ls.cliDaemonUnreachableReported = true
+	ls.cliDaemonMux.Unlock()
+	if !reported && ctx.Err() == nil {
+		go func() {
+			defer streams.CatchAndLogPanic()
+			ls.showMessage(logger, lsp.MessageTypeError, "Editor support is not available because the Arduino CLI daemon at "+ls.config.CliDaemonAddress+" is unreachable.")
+		}()
+	}
+	return err
+}
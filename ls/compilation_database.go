@@ -16,11 +16,14 @@
 package ls
 
 import (
+	"fmt"
+	"path/filepath"
 	"runtime"
 	"strings"
 
 	"github.com/arduino/go-paths-helper"
 	"go.bug.st/json"
+	"go.bug.st/lsp/jsonrpc"
 )
 
 // compilationDatabase represents a compile_commands.json content
@@ -61,27 +64,185 @@ func (db *compilationDatabase) save() error {
 	return nil
 }
 
-func canonicalizeCompileCommandsJSON(compileCommandsJSONPath *paths.Path) {
+// canonicalizeCompileCommandsJSON makes the given compile_commands.json usable by
+// clangd, the given user defines (in the form NAME or NAME=VALUE) are added to
+// each compile command.
+func canonicalizeCompileCommandsJSON(compileCommandsJSONPath *paths.Path, defines []string, logger jsonrpc.FunctionLogger) error {
 	// TODO: do canonicalization directly in `arduino-cli`
 
 	compileCommands, err := loadCompilationDatabase(compileCommandsJSONPath)
 	if err != nil {
-		panic("could not find compile_commands.json")
+		return fmt.Errorf("could not load compile_commands.json: %w", err)
 	}
-	for i, cmd := range compileCommands.Contents {
-		if len(cmd.Arguments) == 0 {
-			panic("invalid empty argument field in compile_commands.json")
+	defineFlags := defineArguments(defines)
+	contents := []compileCommand{}
+	for _, cmd := range compileCommands.Contents {
+		if len(cmd.Arguments) > 0 {
+			cmd.Arguments[0] = canonicalizeCompilerPath(cmd.Arguments[0])
+			if runtime.GOOS == "windows" {
+				// Wrapper scripts may invoke other tools later in the command line
+				for i, arg := range cmd.Arguments[1:] {
+					cmd.Arguments[i+1] = withExecutableExtension(arg, cmd.Directory)
+				}
+			}
+			// Added last to override the defines of the build
+			cmd.Arguments = append(cmd.Arguments, defineFlags...)
+		} else if compiler, rest, ok := splitCompilerFromCommand(cmd.Command); ok {
+			// The command line is kept as is (it may contain @response files),
+			// only the compiler is replaced
+			if runtime.GOOS == "windows" {
+				// Wrapper scripts may invoke other tools later in the command line
+				rest = withExecutableExtensions(rest, cmd.Directory)
+			}
+			cmd.Command = quoteCommandArgument(canonicalizeCompilerPath(compiler)) + rest
+			for _, define := range defineFlags {
+				cmd.Command += " " + quoteCommandArgument(define)
+			}
+		} else {
+			logger.Logf("skipping entry with empty arguments in compile_commands.json: %s", cmd.File)
+			continue
 		}
+		contents = append(contents, cmd)
+	}
+	compileCommands.Contents = contents
 
-		// clangd requires full path to compiler (including extension .exe on Windows!)
-		compilerPath := paths.New(cmd.Arguments[0]).Canonical()
-		compiler := compilerPath.String()
-		if runtime.GOOS == "windows" && strings.ToLower(compilerPath.Ext()) != ".exe" {
-			compiler += ".exe"
+	// Save back compile_commands.json with OS native file separator and extension
+	return compileCommands.save()
+}
+
+// defineArguments returns the compiler arguments for the given defines, in the
+// form NAME or NAME=VALUE (an optional -D prefix is ignored).
+func defineArguments(defines []string) []string {
+	res := []string{}
+	for _, define := range defines {
+		define = strings.TrimPrefix(strings.TrimSpace(define), "-D")
+		if define == "" {
+			continue
 		}
-		compileCommands.Contents[i].Arguments[0] = compiler
+		res = append(res, "-D"+define)
 	}
+	return res
+}
 
-	// Save back compile_commands.json with OS native file separator and extension
-	compileCommands.save()
+// canonicalizeCompilerPath returns the full path to the compiler, clangd requires
+// it (including extension .exe on Windows!)
+func canonicalizeCompilerPath(compiler string) string {
+	compilerPath := paths.New(compiler).Canonical()
+	res := compilerPath.String()
+	if runtime.GOOS == "windows" && strings.ToLower(compilerPath.Ext()) != ".exe" {
+		res += ".exe"
+	}
+	return res
+}
+
+// withExecutableExtension adds the .exe extension to the given argument if it's
+// the path (absolute or relative to dir) of an executable without extension,
+// otherwise returns the argument unchanged.
+func withExecutableExtension(arg, dir string) string {
+	if arg == "" || strings.HasPrefix(arg, "-") || filepath.Ext(arg) != "" {
+		return arg
+	}
+	exe := paths.New(arg + ".exe")
+	if !exe.IsAbs() && dir != "" {
+		exe = paths.New(dir).JoinPath(exe)
+	}
+	if exe.IsNotDir() {
+		return arg + ".exe"
+	}
+	return arg
+}
+
+// withExecutableExtensions applies withExecutableExtension to each argument of
+// the given command line, everything else in the command line is kept as is.
+func withExecutableExtensions(command, dir string) string {
+	res := strings.Builder{}
+	for command != "" {
+		arg := strings.TrimLeft(command, " \t")
+		res.WriteString(command[:len(command)-len(arg)])
+		if arg == "" {
+			break
+		}
+		if quote := arg[0]; quote == '"' || quote == '\'' {
+			end := strings.IndexByte(arg[1:], quote)
+			if end == -1 {
+				// Malformed command line
+				res.WriteString(arg)
+				break
+			}
+			res.WriteByte(quote)
+			res.WriteString(withExecutableExtension(arg[1:end+1], dir))
+			res.WriteByte(quote)
+			command = arg[end+2:]
+			continue
+		}
+		end := strings.IndexAny(arg, " \t")
+		if end == -1 {
+			end = len(arg)
+		}
+		res.WriteString(withExecutableExtension(arg[:end], dir))
+		command = arg[end:]
+	}
+	return res.String()
+}
+
+// splitCompilerFromCommand splits the command string of a compile_commands.json
+// entry in the compiler (unquoted) and the rest of the command line. It returns
+// false if the command is empty or malformed.
+func splitCompilerFromCommand(command string) (string, string, bool) {
+	command = strings.TrimLeft(command, " \t")
+	if command == "" {
+		return "", "", false
+	}
+	if quote := command[0]; quote == '"' || quote == '\'' {
+		end := strings.IndexByte(command[1:], quote)
+		if end == -1 {
+			return "", "", false
+		}
+		return command[1 : end+1], command[end+2:], true
+	}
+	if end := strings.IndexAny(command, " \t"); end != -1 {
+		return command[:end], command[end:], true
+	}
+	return command, "", true
+}
+
+// quoteCommandArgument quotes the given argument of a command string if needed,
+// the embedded quotes and backslashes are escaped as expected by clangd (that
+// parses the command with the Windows syntax on Windows).
+func quoteCommandArgument(arg string) string {
+	if runtime.GOOS == "windows" {
+		return quoteWindowsCommandArgument(arg)
+	}
+	if !strings.ContainsAny(arg, " \t'\"\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// quoteWindowsCommandArgument quotes the given argument with the Windows
+// syntax: the backslashes are escaped only if they precede a quote.
+func quoteWindowsCommandArgument(arg string) string {
+	if !strings.ContainsAny(arg, " \t'\"") {
+		return arg
+	}
+	res := strings.Builder{}
+	res.WriteByte('"')
+	backslashes := 0
+	for _, c := range []byte(arg) {
+		switch c {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			res.WriteString(strings.Repeat(`\`, 2*backslashes+1))
+		default:
+			res.WriteString(strings.Repeat(`\`, backslashes))
+		}
+		backslashes = 0
+		res.WriteByte(c)
+	}
+	// The closing quote follows the trailing backslashes
+	res.WriteString(strings.Repeat(`\`, 2*backslashes))
+	res.WriteByte('"')
+	return res.String()
 }
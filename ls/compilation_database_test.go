@@ -0,0 +1,199 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalizeCompileCommandsJSON(t *testing.T) {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST: ")
+	tmp := paths.New(t.TempDir())
+	compileCommandsJSON := tmp.Join("compile_commands.json")
+	require.NoError(t, compileCommandsJSON.WriteFile([]byte(`[
+  {
+    "directory": "/tmp/build",
+    "arguments": ["/usr/bin/avr-g++", "-c", "sketch.ino.cpp"],
+    "file": "/tmp/build/sketch/sketch.ino.cpp"
+  },
+  {
+    "directory": "/tmp/build",
+    "file": "/tmp/build/core/main.cpp"
+  }
+]`)))
+
+	require.NoError(t, canonicalizeCompileCommandsJSON(compileCommandsJSON, nil, logger))
+
+	db, err := loadCompilationDatabase(compileCommandsJSON)
+	require.NoError(t, err)
+	require.Len(t, db.Contents, 1)
+	require.Equal(t, "/tmp/build/sketch/sketch.ino.cpp", db.Contents[0].File)
+	require.Equal(t, []string{"-c", "sketch.ino.cpp"}, db.Contents[0].Arguments[1:])
+}
+
+func TestCanonicalizeMissingCompileCommandsJSON(t *testing.T) {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST: ")
+	missing := paths.New(t.TempDir()).Join("compile_commands.json")
+	require.Error(t, canonicalizeCompileCommandsJSON(missing, nil, logger))
+}
+
+func TestCanonicalizeCompileCommandsJSONCommandForm(t *testing.T) {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST: ")
+	tmp := paths.New(t.TempDir())
+	compileCommandsJSON := tmp.Join("compile_commands.json")
+	require.NoError(t, compileCommandsJSON.WriteFile([]byte(`[
+  {
+    "directory": "/tmp/build",
+    "command": "/usr/bin/avr-g++ @/tmp/build/response.txt -c sketch.ino.cpp",
+    "file": "/tmp/build/sketch/sketch.ino.cpp"
+  },
+  {
+    "directory": "/tmp/build",
+    "command": "\"/opt/my tools/avr-g++\" -c main.cpp",
+    "file": "/tmp/build/core/main.cpp"
+  },
+  {
+    "directory": "/tmp/build",
+    "command": "  ",
+    "file": "/tmp/build/core/empty.cpp"
+  }
+]`)))
+
+	require.NoError(t, canonicalizeCompileCommandsJSON(compileCommandsJSON, nil, logger))
+
+	db, err := loadCompilationDatabase(compileCommandsJSON)
+	require.NoError(t, err)
+	require.Len(t, db.Contents, 2)
+	require.Empty(t, db.Contents[0].Arguments)
+	require.Equal(t, quoteCommandArgument(canonicalizeCompilerPath("/usr/bin/avr-g++"))+" @/tmp/build/response.txt -c sketch.ino.cpp", db.Contents[0].Command)
+	require.Equal(t, `"`+canonicalizeCompilerPath("/opt/my tools/avr-g++")+`" -c main.cpp`, db.Contents[1].Command)
+}
+
+func TestSplitCompilerFromCommand(t *testing.T) {
+	for _, test := range []struct {
+		command, compiler, rest string
+	}{
+		{"gcc -c a.c", "gcc", " -c a.c"},
+		{"  gcc", "gcc", ""},
+		{`"C:\Program Files\gcc.exe" @args.txt`, `C:\Program Files\gcc.exe`, " @args.txt"},
+		{`'/opt/my tools/gcc' -c a.c`, "/opt/my tools/gcc", " -c a.c"},
+	} {
+		compiler, rest, ok := splitCompilerFromCommand(test.command)
+		require.True(t, ok, test.command)
+		require.Equal(t, test.compiler, compiler, test.command)
+		require.Equal(t, test.rest, rest, test.command)
+	}
+	for _, command := range []string{"", "  ", `"unterminated -c a.c`} {
+		_, _, ok := splitCompilerFromCommand(command)
+		require.False(t, ok, command)
+	}
+}
+
+func TestQuoteCommandArgument(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		require.Equal(t, "-DDEBUG", quoteCommandArgument("-DDEBUG"))
+		require.Equal(t, `"-DGREETING=hello world"`, quoteCommandArgument("-DGREETING=hello world"))
+		require.Equal(t, `"-DGREETING=\"hello\""`, quoteCommandArgument(`-DGREETING="hello"`))
+		require.Equal(t, `"-DPATH=C:\\temp"`, quoteCommandArgument(`-DPATH=C:\temp`))
+	}
+
+	require.Equal(t, `C:\tools\avr-g++.exe`, quoteWindowsCommandArgument(`C:\tools\avr-g++.exe`))
+	require.Equal(t, `"C:\Program Files\avr-g++.exe"`, quoteWindowsCommandArgument(`C:\Program Files\avr-g++.exe`))
+	require.Equal(t, `"-DGREETING=\"hello\""`, quoteWindowsCommandArgument(`-DGREETING="hello"`))
+	require.Equal(t, `"-DQUOTE=\\\"a b"`, quoteWindowsCommandArgument(`-DQUOTE=\"a b`))
+	require.Equal(t, `"C:\Program Files\\"`, quoteWindowsCommandArgument(`C:\Program Files\`))
+}
+
+func TestWithExecutableExtension(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	require.NoError(t, tmp.Join("objcopy.exe").WriteFile([]byte{}))
+	require.NoError(t, tmp.Join("tools").MkdirAll())
+	require.NoError(t, tmp.Join("tools", "size.exe").WriteFile([]byte{}))
+
+	objcopy := tmp.Join("objcopy").String()
+	require.Equal(t, objcopy+".exe", withExecutableExtension(objcopy, ""))
+	require.Equal(t, "tools/size.exe", withExecutableExtension("tools/size", tmp.String()))
+	require.Equal(t, "tools/size", withExecutableExtension("tools/size", ""))
+	require.Equal(t, "-c", withExecutableExtension("-c", tmp.String()))
+	require.Equal(t, "sketch.ino.cpp", withExecutableExtension("sketch.ino.cpp", tmp.String()))
+	require.Equal(t, "tools", withExecutableExtension("tools", tmp.String()))
+
+	// Command form: only the arguments are changed, the separators and the quotes are kept
+	require.Equal(t, ` -c  tools/size.exe "tools/size.exe" @response.txt`, withExecutableExtensions(` -c  tools/size "tools/size" @response.txt`, tmp.String()))
+	require.Equal(t, ` -c "tools/size`, withExecutableExtensions(` -c "tools/size`, tmp.String()))
+	require.Equal(t, "", withExecutableExtensions("", tmp.String()))
+}
+
+func TestCanonicalizeCompileCommandsJSONOnWindows(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("the .exe extension is added only on Windows")
+	}
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST: ")
+	tmp := paths.New(t.TempDir())
+	compiler := tmp.Join("avr-g++")
+	wrapped := tmp.Join("avr-objcopy")
+	require.NoError(t, paths.New(wrapped.String()+".exe").WriteFile([]byte{}))
+	compileCommandsJSON := tmp.Join("compile_commands.json")
+	db := &compilationDatabase{
+		File: compileCommandsJSON,
+		Contents: []compileCommand{{
+			Directory: tmp.String(),
+			Arguments: []string{compiler.String(), "-c", "sketch.ino.cpp", wrapped.String()},
+			File:      tmp.Join("sketch.ino.cpp").String(),
+		}},
+	}
+	require.NoError(t, db.save())
+
+	require.NoError(t, canonicalizeCompileCommandsJSON(compileCommandsJSON, nil, logger))
+
+	db, err := loadCompilationDatabase(compileCommandsJSON)
+	require.NoError(t, err)
+	require.Len(t, db.Contents, 1)
+	require.Equal(t, compiler.Canonical().String()+".exe", db.Contents[0].Arguments[0])
+	require.Equal(t, []string{"-c", "sketch.ino.cpp", wrapped.String() + ".exe"}, db.Contents[0].Arguments[1:])
+}
+
+func TestCanonicalizeCompileCommandsJSONWithDefines(t *testing.T) {
+	logger := NewLSPFunctionLogger(color.HiWhiteString, "TEST: ")
+	tmp := paths.New(t.TempDir())
+	compileCommandsJSON := tmp.Join("compile_commands.json")
+	require.NoError(t, compileCommandsJSON.WriteFile([]byte(`[
+  {
+    "directory": "/tmp/build",
+    "arguments": ["/usr/bin/avr-g++", "-DF_CPU=16000000L", "-c", "sketch.ino.cpp"],
+    "file": "/tmp/build/sketch/sketch.ino.cpp"
+  },
+  {
+    "directory": "/tmp/build",
+    "command": "/usr/bin/avr-gcc -c main.c",
+    "file": "/tmp/build/core/main.c"
+  }
+]`)))
+
+	defines := []string{"DEBUG", "F_CPU=8000000L", "-DGREETING=hello world", " "}
+	require.NoError(t, canonicalizeCompileCommandsJSON(compileCommandsJSON, defines, logger))
+
+	db, err := loadCompilationDatabase(compileCommandsJSON)
+	require.NoError(t, err)
+	require.Len(t, db.Contents, 2)
+	require.Equal(t, []string{"-DF_CPU=16000000L", "-c", "sketch.ino.cpp", "-DDEBUG", "-DF_CPU=8000000L", "-DGREETING=hello world"}, db.Contents[0].Arguments[1:])
+	require.Equal(t, quoteCommandArgument(canonicalizeCompilerPath("/usr/bin/avr-gcc"))+` -c main.c -DDEBUG -DF_CPU=8000000L "-DGREETING=hello world"`, db.Contents[1].Command)
+}
@@ -0,0 +1,79 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var fqbnSegmentRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// ValidateFqbn checks that the given FQBN is in the form
+// VENDOR:ARCHITECTURE:BOARD_ID[:MENU_ID=OPTION_ID[,MENU2_ID=OPTION_ID...]]
+func ValidateFqbn(fqbn string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid FQBN '%s': %s (expected format is VENDOR:ARCHITECTURE:BOARD_ID[:MENU_ID=OPTION_ID[,MENU2_ID=OPTION_ID...]], for example arduino:avr:uno)", fqbn, reason)
+	}
+
+	segments := strings.SplitN(fqbn, ":", 4)
+	if len(segments) < 3 {
+		return invalid("missing board identifier")
+	}
+	for i, name := range []string{"vendor", "architecture", "board identifier"} {
+		if !fqbnSegmentRegexp.MatchString(segments[i]) {
+			return invalid("malformed " + name)
+		}
+	}
+	if len(segments) == 4 {
+		for _, option := range strings.Split(segments[3], ",") {
+			key, value, ok := strings.Cut(option, "=")
+			if !ok || !fqbnSegmentRegexp.MatchString(key) || !fqbnSegmentRegexp.MatchString(value) {
+				return invalid("malformed board option '" + option + "'")
+			}
+		}
+	}
+	return nil
+}
+
+// fqbnWithBoardOptions returns the given FQBN with the board options replaced
+// by the given ones (in the form MENU_ID=OPTION_ID[,MENU2_ID=OPTION_ID...]).
+// If options is empty the board options are removed.
+func fqbnWithBoardOptions(fqbn, options string) (string, error) {
+	segments := strings.SplitN(fqbn, ":", 4)
+	if len(segments) < 3 {
+		return "", ValidateFqbn(fqbn)
+	}
+	res := strings.Join(segments[:3], ":")
+	if options != "" {
+		res += ":" + options
+	}
+	if err := ValidateFqbn(res); err != nil {
+		return "", err
+	}
+	return res, nil
+}
+
+// fqbnCoreID returns the identifier of the core (platform) of the given FQBN,
+// in the form VENDOR:ARCHITECTURE (for example arduino:avr).
+func fqbnCoreID(fqbn string) (string, error) {
+	if err := ValidateFqbn(fqbn); err != nil {
+		return "", err
+	}
+	segments := strings.SplitN(fqbn, ":", 3)
+	return segments[0] + ":" + segments[1], nil
+}
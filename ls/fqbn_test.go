@@ -0,0 +1,98 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFqbn(t *testing.T) {
+	for _, fqbn := range []string{
+		"arduino:avr:uno",
+		"arduino:mbed:nanorp2040connect",
+		"esp32:esp32:esp32s3:CDCOnBoot=cdc",
+		"arduino:avr:nano:cpu=atmega328old",
+		"arduino:avr:mega:cpu=atmega2560,other=opt-1.2",
+	} {
+		require.NoError(t, ValidateFqbn(fqbn), fqbn)
+	}
+	for _, fqbn := range []string{
+		"",
+		"arduino",
+		"arduino:avr",
+		"arduino:avr:",
+		"arduino::uno",
+		"arduino:avr:uno:",
+		"arduino:avr:uno:cpu",
+		"arduino:avr:uno:cpu=",
+		"arduino:avr:uno:cpu=atmega328,",
+		"arduino avr uno",
+	} {
+		require.Error(t, ValidateFqbn(fqbn), fqbn)
+	}
+}
+
+func TestFqbnWithBoardOptions(t *testing.T) {
+	fqbn, err := fqbnWithBoardOptions("arduino:avr:nano", "cpu=atmega328old")
+	require.NoError(t, err)
+	require.Equal(t, "arduino:avr:nano:cpu=atmega328old", fqbn)
+
+	fqbn, err = fqbnWithBoardOptions("arduino:avr:nano:cpu=atmega328old", "cpu=atmega168")
+	require.NoError(t, err)
+	require.Equal(t, "arduino:avr:nano:cpu=atmega168", fqbn)
+
+	fqbn, err = fqbnWithBoardOptions("arduino:avr:nano:cpu=atmega328old", "")
+	require.NoError(t, err)
+	require.Equal(t, "arduino:avr:nano", fqbn)
+
+	_, err = fqbnWithBoardOptions("arduino:avr:nano", "cpu")
+	require.Error(t, err)
+	_, err = fqbnWithBoardOptions("arduino:avr", "cpu=atmega168")
+	require.Error(t, err)
+}
+
+func TestCliCompileArgsKeepsBoardOptions(t *testing.T) {
+	args := cliCompileArgs(
+		paths.New("arduino-cli.yaml"),
+		"arduino:avr:nano:cpu=atmega328old",
+		paths.New("overrides.json"),
+		paths.New("build"),
+		paths.New("sketch"),
+		false,
+		[]string{"--json"})
+	require.Contains(t, args, "arduino:avr:nano:cpu=atmega328old")
+	for i, arg := range args {
+		if arg == "--fqbn" {
+			require.Equal(t, "arduino:avr:nano:cpu=atmega328old", args[i+1])
+		}
+	}
+}
+
+func TestFqbnCoreID(t *testing.T) {
+	coreID, err := fqbnCoreID("arduino:avr:uno")
+	require.NoError(t, err)
+	require.Equal(t, "arduino:avr", coreID)
+
+	coreID, err = fqbnCoreID("esp32:esp32:esp32s3:CDCOnBoot=cdc")
+	require.NoError(t, err)
+	require.Equal(t, "esp32:esp32", coreID)
+
+	_, err = fqbnCoreID("arduino:avr")
+	require.Error(t, err)
+}
@@ -0,0 +1,225 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/go-paths-helper"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+// newTestSketchServer returns a language server initialized with a preprocessed
+// sketch, without clangd. The returned URIs are the .ino opened in the IDE and
+// the corresponding preprocessed .ino.cpp.
+//
+//	.ino.cpp line -> .ino line
+//	 5 void setup();        (preprocessed prototype of line 1)
+//	 7 void loop();         (preprocessed prototype of line 5)
+//	 9 void setup() {       -> 1
+//	10   int unused = 0;    -> 2
+//	11 }                    -> 3
+//	13 void loop() {        -> 5
+//	14 }                    -> 6
+func newTestSketchServer(t *testing.T) (*INOLanguageServer, lsp.DocumentURI, lsp.DocumentURI) {
+	tmp := paths.New(t.TempDir()).Canonical()
+	sketchRoot := tmp.Join("Sketch")
+	buildSketchRoot := tmp.Join("build", "sketch")
+	require.NoError(t, sketchRoot.MkdirAll())
+	require.NoError(t, buildSketchRoot.MkdirAll())
+
+	ino := sketchRoot.Join("Sketch.ino")
+	inoText := "\nvoid setup() {\n  int unused = 0;\n}\n\nvoid loop() {\n}\n"
+	require.NoError(t, ino.WriteFile([]byte(inoText)))
+
+	line := func(n int) string { return "#line " + strconv.Itoa(n) + " " + strconv.Quote(ino.String()) }
+	cppText := strings.Join([]string{
+		"#include <Arduino.h>",
+		line(1),
+		line(1),
+		"",
+		line(2),
+		"void setup();",
+		line(6),
+		"void loop();",
+		line(2),
+		"void setup() {",
+		"  int unused = 0;",
+		"}",
+		"",
+		"void loop() {",
+		"}",
+		"",
+	}, "\n")
+	cpp := buildSketchRoot.Join("Sketch.ino.cpp")
+	require.NoError(t, cpp.WriteFile([]byte(cppText)))
+
+	inoURI := lsp.NewDocumentURIFromPath(ino)
+	ls := &INOLanguageServer{
+		config:          &Config{},
+		sketchRoot:      sketchRoot,
+		sketchName:      "Sketch",
+		buildSketchRoot: buildSketchRoot,
+		buildSketchCpp:  cpp,
+		sketchMapper:    sourcemapper.CreateInoMapper([]byte(cppText)),
+		trackedIdeDocs: map[string]lsp.TextDocumentItem{
+			ino.String(): {URI: inoURI, LanguageID: "cpp", Version: 1, Text: inoText},
+		},
+	}
+	return ls, inoURI, lsp.NewDocumentURIFromPath(cpp)
+}
+
+// newTestClangdClient connects the language server to a fake clangd: the
+// returned buffer collects all the messages sent to it.
+func newTestClangdClient(ls *INOLanguageServer) *bytes.Buffer {
+	clangdIn := &bytes.Buffer{}
+	client := &clangdLSPClient{ls: ls}
+	client.conn = lsp.NewClient(strings.NewReader(""), clangdIn, client)
+	ls.Clangd = client
+	ls.sketchRebuilder = &sketchRebuilder{
+		trigger: make(chan bool, 1),
+		cancel:  func() {},
+		ls:      ls,
+	}
+	return clangdIn
+}
+
+// testIDEOutput collects the messages sent to a fake IDE, it can be read while
+// the language server writes to it.
+type testIDEOutput struct {
+	mux  sync.Mutex
+	data bytes.Buffer
+}
+
+func (o *testIDEOutput) Write(p []byte) (int, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.data.Write(p)
+}
+
+func (o *testIDEOutput) String() string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.data.String()
+}
+
+func (o *testIDEOutput) Reset() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.data.Reset()
+}
+
+// newTestIDEConnection connects the language server to a fake IDE: the
+// returned output collects all the messages sent to it.
+func newTestIDEConnection(ls *INOLanguageServer) *testIDEOutput {
+	out := &testIDEOutput{}
+	ls.IDE = &IDELSPServer{ls: ls}
+	ls.IDE.conn = lsp.NewServer(strings.NewReader(""), out, ls.IDE)
+	return out
+}
+
+// fakeClangdConn is a ClangdConn that answers with canned responses, the
+// methods not overridden panic if called.
+type fakeClangdConn struct {
+	ClangdConn
+	hover               func(*lsp.HoverParams) *lsp.Hover
+	hoverParams         *lsp.HoverParams
+	signatureHelp       func(*lsp.SignatureHelpParams) *lsp.SignatureHelp
+	signatureHelpParams *lsp.SignatureHelpParams
+	highlights          []lsp.DocumentHighlight
+	codeActions         []lsp.CommandOrCodeAction
+	rangeFormatting     []lsp.TextEdit
+	completion          *lsp.CompletionList
+	completionHook      func(ctx context.Context)
+	formatting          []lsp.TextEdit
+	formattingOptions   lsp.FormattingOptions
+	definition          []lsp.Location
+	closed              []lsp.DocumentURI
+	opened              []lsp.TextDocumentItem
+	changed             []*lsp.DidChangeTextDocumentParams
+	trace               []lsp.TraceValue
+}
+
+func (c *fakeClangdConn) SetTrace(param *lsp.SetTraceParams) error {
+	c.trace = append(c.trace, param.Value)
+	return nil
+}
+
+func (c *fakeClangdConn) TextDocumentDidOpen(param *lsp.DidOpenTextDocumentParams) error {
+	c.opened = append(c.opened, param.TextDocument)
+	return nil
+}
+
+func (c *fakeClangdConn) TextDocumentDidChange(param *lsp.DidChangeTextDocumentParams) error {
+	c.changed = append(c.changed, param)
+	return nil
+}
+
+func (c *fakeClangdConn) TextDocumentDidClose(param *lsp.DidCloseTextDocumentParams) error {
+	c.closed = append(c.closed, param.TextDocument.URI)
+	return nil
+}
+
+func (c *fakeClangdConn) TextDocumentHover(ctx context.Context, param *lsp.HoverParams) (*lsp.Hover, *jsonrpc.ResponseError, error) {
+	c.hoverParams = param
+	return c.hover(param), nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentSignatureHelp(ctx context.Context, param *lsp.SignatureHelpParams) (*lsp.SignatureHelp, *jsonrpc.ResponseError, error) {
+	c.signatureHelpParams = param
+	return c.signatureHelp(param), nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentDocumentHighlight(ctx context.Context, param *lsp.DocumentHighlightParams) ([]lsp.DocumentHighlight, *jsonrpc.ResponseError, error) {
+	return c.highlights, nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentCodeAction(ctx context.Context, param *lsp.CodeActionParams) ([]lsp.CommandOrCodeAction, *jsonrpc.ResponseError, error) {
+	return c.codeActions, nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentRangeFormatting(ctx context.Context, param *lsp.DocumentRangeFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError, error) {
+	return c.rangeFormatting, nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentCompletion(ctx context.Context, param *lsp.CompletionParams) (*lsp.CompletionList, *jsonrpc.ResponseError, error) {
+	if c.completionHook != nil {
+		c.completionHook(ctx)
+	}
+	return c.completion, nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentFormatting(ctx context.Context, param *lsp.DocumentFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError, error) {
+	c.formattingOptions = param.Options
+	return c.formatting, nil, nil
+}
+
+func (c *fakeClangdConn) TextDocumentDefinition(ctx context.Context, param *lsp.DefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError, error) {
+	return c.definition, nil, nil, nil
+}
+
+func testLogger() *FunctionLogger {
+	return NewLSPFunctionLogger(color.HiWhiteString, "TEST: ")
+}
@@ -0,0 +1,116 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.bug.st/json"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+// maxInitializeRequestSize is the maximum size of the initialize request
+// kept by the initializeRequestReader.
+const maxInitializeRequestSize = 1024 * 1024
+
+// initializeRequestReader reads the IDE input and keeps the body of the first
+// message, the initialize request: go.bug.st/lsp drops the client
+// capabilities it doesn't know about.
+type initializeRequestReader struct {
+	in io.Reader
+
+	mux  sync.Mutex
+	head []byte
+	done bool
+	body []byte
+}
+
+func (r *initializeRequestReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.done || n == 0 {
+		return n, err
+	}
+	r.head = append(r.head, p[:n]...)
+	if body, ok := firstMessageBody(r.head); ok {
+		r.body = body
+		r.head = nil
+		r.done = true
+	} else if len(r.head) > maxInitializeRequestSize {
+		r.head = nil
+		r.done = true
+	}
+	return n, err
+}
+
+// initializeRequest returns the body of the initialize request, or nil if it
+// has not been read.
+func (r *initializeRequestReader) initializeRequest() []byte {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.body
+}
+
+// firstMessageBody returns the body of the first JSON-RPC message in data,
+// ok is false if the message is not complete yet.
+func firstMessageBody(data []byte) (body []byte, ok bool) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		return nil, false
+	}
+	length := -1
+	for _, line := range strings.Split(string(data[:headerEnd]), "\r\n") {
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			continue
+		}
+		if l, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			length = l
+		}
+	}
+	bodyStart := headerEnd + 4
+	if length < 0 || len(data) < bodyStart+length {
+		return nil, false
+	}
+	return bytes.Clone(data[bodyStart : bodyStart+length]), true
+}
+
+// storeIDEExtraCapabilities decodes, from the raw initialize request, the
+// client capabilities not available in go.bug.st/lsp.
+func (ls *INOLanguageServer) storeIDEExtraCapabilities(logger jsonrpc.FunctionLogger, initializeRequest []byte) {
+	var req struct {
+		Method string `json:"method"`
+		Params struct {
+			Capabilities struct {
+				TextDocument struct {
+					Diagnostic struct {
+						DynamicRegistration bool `json:"dynamicRegistration"`
+					} `json:"diagnostic"`
+				} `json:"textDocument"`
+			} `json:"capabilities"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(initializeRequest, &req); err != nil || req.Method != "initialize" {
+		logger.Logf("extra client capabilities not available")
+		return
+	}
+	ls.ideDiagnosticRegistration.Store(req.Params.Capabilities.TextDocument.Diagnostic.DynamicRegistration)
+}
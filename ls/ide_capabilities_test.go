@@ -0,0 +1,69 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.bug.st/lsp"
+)
+
+func TestInitializeRequestReader(t *testing.T) {
+	body := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{"textDocument":{"diagnostic":{"dynamicRegistration":true}}}}}`
+	next := `{"jsonrpc":"2.0","method":"initialized","params":{}}`
+	input := "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body +
+		"Content-Length: " + strconv.Itoa(len(next)) + "\r\n\r\n" + next
+
+	// The request is kept even if it's read one byte at a time
+	r := &initializeRequestReader{in: iotest.OneByteReader(strings.NewReader(input))}
+	read, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, input, string(read))
+	require.Equal(t, body, string(r.initializeRequest()))
+
+	ls, _, _ := newTestSketchServer(t)
+	ls.storeIDEExtraCapabilities(testLogger(), r.initializeRequest())
+	require.True(t, ls.ideDiagnosticRegistration.Load())
+
+	// An incomplete request is not kept
+	r = &initializeRequestReader{in: strings.NewReader(input[:len(input)/3])}
+	_, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.Nil(t, r.initializeRequest())
+}
+
+func TestPullDiagnosticsCapabilities(t *testing.T) {
+	ls, _, cppURI := newTestSketchServer(t)
+	ls.config.DiagnosticsMode = DiagnosticsModePull
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	ideOut := newTestIDEConnection(ls)
+
+	// The IDE doesn't support the dynamic registration: the pull diagnostics are not registered
+	ls.storeIDEExtraCapabilities(testLogger(), []byte(`{"method":"initialize","params":{"capabilities":{}}}`))
+	require.False(t, ls.ideDiagnosticRegistration.Load())
+	ls.ideInitialized(testLogger(), "test")
+
+	// The updated diagnostics are only stored, waiting for the IDE to pull them
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Diagnostics: []lsp.Diagnostic{}})
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, ideOut.String())
+}
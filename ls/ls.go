@@ -16,17 +16,23 @@
 package ls
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf16"
 
 	rpc "github.com/arduino/arduino-cli/rpc/cc/arduino/cli/commands/v1"
 	"github.com/arduino/arduino-language-server/globals"
@@ -34,13 +40,11 @@ import (
 	"github.com/arduino/arduino-language-server/streams"
 	"github.com/arduino/go-paths-helper"
 	"github.com/fatih/color"
-	"github.com/pkg/errors"
 	"go.bug.st/json"
 	"go.bug.st/lsp"
 	"go.bug.st/lsp/jsonrpc"
 	"go.bug.st/lsp/textedits"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 // INOLanguageServer is a JSON-RPC handler that delegates messages to clangd.
@@ -49,57 +53,135 @@ type INOLanguageServer struct {
 	IDE    *IDELSPServer
 	Clangd *clangdLSPClient
 
-	progressHandler           *progressProxyHandler
-	closing                   chan bool
-	removeTempMutex           sync.Mutex
-	clangdStarted             *sync.Cond
-	dataMux                   sync.RWMutex
-	tempDir                   *paths.Path
-	buildPath                 *paths.Path
-	buildSketchRoot           *paths.Path
-	buildSketchCpp            *paths.Path
-	fullBuildPath             *paths.Path
-	sketchRoot                *paths.Path
-	sketchName                string
-	sketchMapper              *sourcemapper.SketchMapper
-	sketchTrackedFilesCount   int
-	trackedIdeDocs            map[string]lsp.TextDocumentItem
-	ideInoDocsWithDiagnostics map[lsp.DocumentURI]bool
-	sketchRebuilder           *sketchRebuilder
+	progressHandler            *progressProxyHandler
+	closing                    chan bool
+	removeTempMutex            sync.Mutex
+	formatterConfigMux         sync.Mutex
+	formatterConfigLocks       map[string]*sync.Mutex
+	lastFormattingOptions      lsp.FormattingOptions
+	clangdStarted              *sync.Cond
+	clangdDataFolder           *paths.Path
+	clangdInitializeParams     *lsp.InitializeParams
+	clangdLastActivity         atomic.Int64
+	clangdTraceValue           atomic.Value
+	clangdStoppedForInactivity bool
+	clangdRestarting           bool
+	ideSnippetSupport          bool
+	initialized                bool
+	initializeResult           *lsp.InitializeResult
+	ideInitializedOnce         sync.Once
+	dataMux                    sync.RWMutex
+	tempDir                    *paths.Path
+	buildPath                  *paths.Path
+	buildSketchRoot            *paths.Path
+	buildSketchCpp             *paths.Path
+	fullBuildPath              *paths.Path
+	sketchRoot                 *paths.Path
+	sketchName                 string
+	sketchMapper               *sourcemapper.SketchMapper
+	sketchTrackedFilesCount    int
+	sketchDocsClosedInClangd   bool
+	trackedIdeDocs             map[string]lsp.TextDocumentItem
+	ideInoDocsWithDiagnostics  map[lsp.DocumentURI]bool
+	inoVersionsByCppVersion    map[int]map[lsp.DocumentURI]int
+	ideDocsDiagnosticsMux      sync.Mutex
+	ideDocsDiagnostics         map[lsp.DocumentURI][]lsp.Diagnostic
+	ideDiagnosticRegistration  atomic.Bool
+	sketchRebuilder            *sketchRebuilder
+	lastBuildSucceeded         bool
+	missingCoreReported        string
+	buildEnvErrorReported      string
+	lastBuiltDocsHash          map[string]string
+	activeCompletionsMux       sync.Mutex
+	activeCompletions          map[lsp.DocumentURI]*activeCompletion
+
+	cliDaemonMux                 sync.Mutex
+	cliDaemonConn                *grpc.ClientConn
+	cliDaemonUnreachableReported bool
+
+	cliJSONOutputArgsOnce  sync.Once
+	cliJSONOutputArgsCache []string
 }
 
 // Config describes the language server configuration.
 type Config struct {
 	Fqbn                            string
+	Programmer                      string
 	CliPath                         *paths.Path
 	CliConfigPath                   *paths.Path
 	ClangdPath                      *paths.Path
+	ClangdIndexPath                 *paths.Path
+	ClangdError                     error
 	CliDaemonAddress                string
+	CliDaemonTLSCert                *paths.Path
+	CliDaemonToken                  string
 	CliInstanceNumber               int
 	FormatterConf                   *paths.Path
+	ClangFormatPath                 *paths.Path
+	DisableFormatOverride           bool
+	HideUnderscoreCompletions       bool
+	MaxCompletions                  int
+	DisableSnippets                 bool
 	EnableLogging                   bool
+	LogClangdStderr                 bool
 	SkipLibrariesDiscoveryOnRebuild bool
 	DisableRealTimeDiagnostics      bool
+	DiagnosticsMode                 string
+	KeepClosedDocsDiagnostics       bool
+	KeepTempFiles                   bool
+	FullDocumentSync                bool
+	FormatOnSave                    bool
+	HoverShowSourceLocation         bool
+	ClangdIdleTimeout               time.Duration
+	SuppressedDiagnostics           []string
+	RebuildIgnore                   []string
+	BuildCacheSize                  int
+	EnableClangdConfig              bool
+	Defines                         []string
+	RebuildDebounce                 time.Duration
 	Jobs                            int
 }
 
+// Diagnostics modes: the diagnostics are pushed to the IDE with
+// textDocument/publishDiagnostics, pulled by the IDE with textDocument/diagnostic,
+// or both.
+const (
+	DiagnosticsModePush = "push"
+	DiagnosticsModePull = "pull"
+	DiagnosticsModeBoth = "both"
+)
+
+// pushDiagnostics returns true if the diagnostics should be published to the IDE.
+func (config *Config) pushDiagnostics() bool {
+	return config.DiagnosticsMode != DiagnosticsModePull
+}
+
+// pullDiagnostics returns true if the IDE may pull the diagnostics.
+func (config *Config) pullDiagnostics() bool {
+	return config.DiagnosticsMode == DiagnosticsModePull || config.DiagnosticsMode == DiagnosticsModeBoth
+}
+
 var yellow = color.New(color.FgHiYellow)
 
 func (ls *INOLanguageServer) writeLock(logger jsonrpc.FunctionLogger, requireClangd bool) {
+	if requireClangd {
+		ls.clangdLastActivity.Store(time.Now().UnixNano())
+	}
 	ls.dataMux.Lock()
 	logger.Logf(yellow.Sprintf("write-locked"))
-	if requireClangd && ls.Clangd == nil {
+	if requireClangd && ls.Clangd == nil && ls.clangdStoppedForInactivity && !ls.clangdRestarting {
+		ls.restartClangd(logger)
+	} else if requireClangd && ls.Clangd == nil {
 		// if clangd is not started...
 		logger.Logf("(throttled: waiting for clangd)")
 		logger.Logf(yellow.Sprintf("unlocked (waiting clangd)"))
 		ls.clangdStarted.Wait()
 		logger.Logf(yellow.Sprintf("locked (waiting clangd)"))
-
-		if ls.Clangd == nil {
-			logger.Logf("clangd startup failed: quitting Language server")
-			ls.Close()
-			os.Exit(2)
-		}
+	}
+	if requireClangd && ls.Clangd == nil {
+		logger.Logf("clangd startup failed: quitting Language server")
+		ls.Close()
+		os.Exit(2)
 	}
 }
 
@@ -109,6 +191,9 @@ func (ls *INOLanguageServer) writeUnlock(logger jsonrpc.FunctionLogger) {
 }
 
 func (ls *INOLanguageServer) readLock(logger jsonrpc.FunctionLogger, requireClangd bool) {
+	if requireClangd {
+		ls.clangdLastActivity.Store(time.Now().UnixNano())
+	}
 	ls.dataMux.RLock()
 	logger.Logf(yellow.Sprintf("read-locked"))
 
@@ -144,6 +229,13 @@ func NewINOLanguageServer(stdin io.Reader, stdout io.Writer, config *Config) *IN
 	}
 	ls.clangdStarted = sync.NewCond(&ls.dataMux)
 	ls.sketchRebuilder = newSketchBuilder(ls)
+	if config.ClangdIdleTimeout > 0 {
+		idleLogger := NewLSPFunctionLogger(color.HiBlueString, "CLANGD IDLE: ")
+		go func() {
+			defer streams.CatchAndLogPanic()
+			ls.clangdIdleWatcher(idleLogger, ls.closing)
+		}()
+	}
 
 	if tmp, err := paths.MkTempDir("", "arduino-language-server"); err != nil {
 		log.Fatalf("Could not create temp folder: %s", err)
@@ -179,11 +271,208 @@ func NewINOLanguageServer(stdin io.Reader, stdout io.Writer, config *Config) *IN
 	return ls
 }
 
-func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.InitializeParams) (*lsp.InitializeResult, *jsonrpc.ResponseError) {
-	ls.writeLock(logger, false)
-	ls.sketchRoot = ideParams.RootURI.AsPath()
+// startClangd starts and initializes clangd.
+func (ls *INOLanguageServer) startClangd(logger jsonrpc.FunctionLogger, dataFolder *paths.Path) error {
+	clangd := newClangdLSPClient(logger, dataFolder, ls)
+	ls.Clangd = clangd
+	return ls.initializeClangd(logger, clangd)
+}
+
+// initializeClangd runs the given clangd client and initializes it.
+func (ls *INOLanguageServer) initializeClangd(logger jsonrpc.FunctionLogger, clangd *clangdLSPClient) error {
+	ls.clangdLastActivity.Store(time.Now().UnixNano())
+	go func() {
+		defer streams.CatchAndLogPanic()
+		clangd.Run()
+		if clangd.stoppedForInactivity.Load() {
+			logger.Logf("clangd stopped for inactivity")
+			return
+		}
+		logger.Logf("Lost connection with clangd!")
+		ls.Close()
+	}()
+
+	// Send initialization command to clangd (1 sec. timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	clangInitializeParams := *ls.clangdInitializeParams
+	clangInitializeParams.RootPath = ls.buildSketchRoot.String()
+	clangInitializeParams.RootURI = lsp.NewDocumentURIFromPath(ls.buildSketchRoot)
+	if clangInitializeResult, clangErr, err := clangd.conn.Initialize(ctx, &clangInitializeParams); err != nil {
+		return fmt.Errorf("error initializing clangd: %v", err)
+	} else if clangErr != nil {
+		return fmt.Errorf("error initializing clangd: %v", clangErr.AsError())
+	} else {
+		logger.Logf("clangd successfully started: %s", string(lsp.EncodeMessage(clangInitializeResult)))
+	}
+
+	if err := clangd.conn.Initialized(&lsp.InitializedParams{}); err != nil {
+		return fmt.Errorf("error sending initialized notification to clangd: %v", err)
+	}
+
+	// Apply the trace level set by the IDE before clangd was (re)started
+	if traceValue, ok := ls.clangdTraceValue.Load().(lsp.TraceValue); ok {
+		if err := clangd.conn.SetTrace(&lsp.SetTraceParams{Value: traceValue}); err != nil {
+			return fmt.Errorf("error sending setTrace to clangd: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkSketchMainFile verifies that sketchRoot is an Arduino sketch, it must
+// contain at least one .ino file. The actual main file is chosen by arduino-cli
+// during the build (see findPreprocessedSketch).
+func checkSketchMainFile(sketchRoot *paths.Path) error {
+	inoFiles, err := sketchRoot.ReadDir(paths.FilterOutDirectories(), paths.FilterSuffixes(".ino"))
+	if err != nil || len(inoFiles) == 0 {
+		return fmt.Errorf("%s is not an Arduino sketch: there is no .ino file in the folder, language features are not available", sketchRoot)
+	}
+	return nil
+}
+
+// findPreprocessedSketch returns the preprocessed sketch generated by arduino-cli
+// in buildSketchRoot. All the .ino files are merged in a single <main-file>.ino.cpp,
+// the name of the main file may differ from the name of the sketch folder (for
+// example during a rename or if the sketch is opened through a symlink).
+func findPreprocessedSketch(buildSketchRoot *paths.Path) (*paths.Path, error) {
+	candidates, err := buildSketchRoot.ReadDir(paths.FilterOutDirectories(), paths.FilterSuffixes(".ino.cpp"))
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) != 1 {
+		return nil, fmt.Errorf("could not find the preprocessed sketch in %s (%d candidates found)", buildSketchRoot, len(candidates))
+	}
+	return candidates[0], nil
+}
+
+// maxPreprocessedSketchSize is the maximum size of the preprocessed sketch, a
+// bigger file can't be the result of a sane build.
+var maxPreprocessedSketchSize int64 = 32 * 1024 * 1024
+
+// preprocessedSketchReadTimeout is the maximum time allowed to read the
+// preprocessed sketch.
+var preprocessedSketchReadTimeout = 10 * time.Second
+
+// readPreprocessedSketch reads the preprocessed sketch generated by the build,
+// failing with a clear error if the file is not a regular file (like a fifo or a
+// symlink loop), if it's too big or if it can't be read in a reasonable time.
+func readPreprocessedSketch(cpp *paths.Path) ([]byte, error) {
+	info, err := cpp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading preprocessed sketch: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("reading preprocessed sketch: %s is not a regular file", cpp)
+	}
+	if info.Size() > maxPreprocessedSketchSize {
+		return nil, fmt.Errorf("reading preprocessed sketch: %s is too big (%d bytes, max %d)", cpp, info.Size(), maxPreprocessedSketchSize)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := cpp.Open()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer f.Close()
+		// The file may grow after the size check
+		data, err := io.ReadAll(io.LimitReader(f, maxPreprocessedSketchSize+1))
+		if err == nil && int64(len(data)) > maxPreprocessedSketchSize {
+			err = fmt.Errorf("%s is too big (max %d bytes)", cpp, maxPreprocessedSketchSize)
+		}
+		done <- result{data: data, err: err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, fmt.Errorf("reading preprocessed sketch: %w", res.err)
+		}
+		return res.data, nil
+	case <-time.After(preprocessedSketchReadTimeout):
+		return nil, fmt.Errorf("reading preprocessed sketch: timeout reading %s", cpp)
+	}
+}
+
+// updateBuildSketchCpp updates buildSketchCpp with the preprocessed sketch
+// generated by the last build. It must be called with the write lock held.
+func (ls *INOLanguageServer) updateBuildSketchCpp(logger jsonrpc.FunctionLogger) error {
+	buildSketchCpp, err := findPreprocessedSketch(ls.buildSketchRoot)
+	if err != nil {
+		return err
+	}
+	if !buildSketchCpp.EquivalentTo(ls.buildSketchCpp) {
+		logger.Logf("preprocessed sketch is %s", buildSketchCpp)
+		ls.buildSketchCpp = buildSketchCpp
+		ls.sketchName = strings.TrimSuffix(buildSketchCpp.Base(), ".ino.cpp")
+	}
+	return nil
+}
+
+// setSketchRoot sets the sketch folder from the root URI sent by the IDE, the
+// caller must hold the write lock. The path of the URI is percent-decoded
+// (for folders like "My Sketch") and cleaned from trailing slashes, so the
+// sketch name is the last element of the folder.
+func (ls *INOLanguageServer) setSketchRoot(rootURI lsp.DocumentURI) {
+	ls.sketchRoot = canonicalDocumentPath(rootURI)
 	ls.sketchName = ls.sketchRoot.Base()
 	ls.buildSketchCpp = ls.buildSketchRoot.Join(ls.sketchName + ".ino.cpp")
+}
+
+// clientCapabilitiesSummary returns a one-line description of the IDE and of
+// the capabilities that most often cause integration problems.
+func clientCapabilitiesSummary(ideParams *lsp.InitializeParams) string {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	client := "unknown"
+	if info := ideParams.ClientInfo; info != nil {
+		client = info.Name
+		if info.Version != nil {
+			client += " " + *info.Version
+		}
+	}
+	caps := ideParams.Capabilities
+	semanticTokens := caps.TextDocument != nil && caps.TextDocument.SemanticTokens != nil
+	workspaceFolders := caps.Workspace != nil && caps.Workspace.WorkspaceFolders
+	workDoneProgress := caps.Window != nil && caps.Window.WorkDoneProgress != nil && *caps.Window.WorkDoneProgress
+	folders := 0
+	if ideParams.WorkspaceFolders != nil {
+		folders = len(*ideParams.WorkspaceFolders)
+	}
+	return fmt.Sprintf("client=%s snippets=%s semanticTokens=%s workspaceFolders=%s (%d folders) workDoneProgress=%s",
+		client,
+		yesNo(clientSupportsSnippets(ideParams)),
+		yesNo(semanticTokens),
+		yesNo(workspaceFolders), folders,
+		yesNo(workDoneProgress))
+}
+
+func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.InitializeParams) (*lsp.InitializeResult, *jsonrpc.ResponseError) {
+	ls.writeLock(logger, false)
+	if ls.initialized {
+		// The workbench is already being initialized: don't start it again
+		res := ls.initializeResult
+		ls.writeUnlock(logger)
+		if res == nil {
+			logger.Logf("initialize request received while the previous one is in progress")
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidRequest, Message: "initialize request already received"}
+		}
+		logger.Logf("initialize request received twice: returning the previous result")
+		return res, nil
+	}
+	ls.initialized = true
+	ls.setSketchRoot(ideParams.RootURI)
+	logger.Logf("sketch root: %s", ls.sketchRoot)
+	logger.Logf("client capabilities: %s", clientCapabilitiesSummary(ideParams))
+	ls.ideSnippetSupport = clientSupportsSnippets(ideParams)
 	ls.writeUnlock(logger)
 
 	go func() {
@@ -195,7 +484,36 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 		logger := NewLSPFunctionLogger(color.HiCyanString, "INIT --- ")
 		logger.Logf("initializing workbench: %s", ideParams.RootURI)
 
-		if success, err := ls.generateBuildEnvironment(context.Background(), true, logger); err != nil {
+		if err := checkSketchMainFile(ls.sketchRoot); err != nil {
+			logger.Logf("error: %s", err)
+			ls.showMessage(logger, lsp.MessageTypeError, err.Error())
+			return
+		}
+		if err := ls.config.ClangdError; err != nil {
+			logger.Logf("error: %s", err)
+			ls.showMessage(logger, lsp.MessageTypeError, "Could not start editor support: "+err.Error())
+			return
+		}
+
+		ls.readLock(logger, false)
+		initialBuildFqbn := ls.config.Fqbn
+		initialBuildDocsHash := ls.trackedIdeDocsHash()
+		ls.readUnlock(logger)
+
+		// The initial build is not cancellable: clangd can't be started without it
+		ls.progressHandler.Create("arduinoLanguageServerInit")
+		ls.progressHandler.Begin("arduinoLanguageServerInit", &lsp.WorkDoneProgressBegin{Title: "Building sketch"})
+		success, err := ls.generateBuildEnvironment(context.Background(), true, "arduinoLanguageServerInit", logger)
+		ls.progressHandler.End("arduinoLanguageServerInit", &lsp.WorkDoneProgressEnd{Message: "done"})
+
+		ls.writeLock(logger, false)
+		ls.lastBuildSucceeded = err == nil && success
+		if ls.lastBuildSucceeded {
+			ls.lastBuiltDocsHash = initialBuildDocsHash
+			ls.sketchRebuilder.setInitialBuildFqbn(initialBuildFqbn)
+		}
+		ls.writeUnlock(logger)
+		if err != nil {
 			logger.Logf("error starting clang: %s", err)
 			return
 		} else if !success {
@@ -203,11 +521,21 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 			return
 		}
 
-		if inoCppContent, err := ls.buildSketchCpp.ReadFile(); err == nil {
+		ls.writeLock(logger, false)
+		err = ls.updateBuildSketchCpp(logger)
+		ls.writeUnlock(logger)
+		if err != nil {
+			logger.Logf("error starting clang: %s", err)
+			return
+		}
+
+		if inoCppContent, err := readPreprocessedSketch(ls.buildSketchCpp); err == nil {
 			ls.sketchMapper = sourcemapper.CreateInoMapper(inoCppContent)
 			ls.sketchMapper.CppText.Version = 1
+			ls.recordInoVersions()
 		} else {
-			logger.Logf("error starting clang: reading generated cpp file from sketch: %s", err)
+			logger.Logf("error starting clang: %s", err)
+			ls.showMessage(logger, lsp.MessageTypeError, "Could not start editor support: "+err.Error())
 			return
 		}
 
@@ -219,32 +547,12 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 		}
 
 		// Start clangd
-		ls.Clangd = newClangdLSPClient(logger, dataFolder, ls)
-		go func() {
-			defer streams.CatchAndLogPanic()
-			ls.Clangd.Run()
-			logger.Logf("Lost connection with clangd!")
-			ls.Close()
-		}()
-
-		// Send initialization command to clangd (1 sec. timeout)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		clangInitializeParams := *ideParams
-		clangInitializeParams.RootPath = ls.buildSketchRoot.String()
-		clangInitializeParams.RootURI = lsp.NewDocumentURIFromPath(ls.buildSketchRoot)
-		if clangInitializeResult, clangErr, err := ls.Clangd.conn.Initialize(ctx, &clangInitializeParams); err != nil {
-			logger.Logf("error initializing clangd: %v", err)
-			return
-		} else if clangErr != nil {
-			logger.Logf("error initializing clangd: %v", clangErr.AsError())
-			return
-		} else {
-			logger.Logf("clangd successfully started: %s", string(lsp.EncodeMessage(clangInitializeResult)))
-		}
-
-		if err := ls.Clangd.conn.Initialized(&lsp.InitializedParams{}); err != nil {
-			logger.Logf("error sending initialized notification to clangd: %v", err)
+		ls.writeLock(logger, false)
+		ls.clangdDataFolder = dataFolder
+		ls.clangdInitializeParams = ideParams
+		ls.writeUnlock(logger)
+		if err := ls.startClangd(logger, dataFolder); err != nil {
+			logger.Logf("%s", err)
 			return
 		}
 
@@ -311,11 +619,18 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 		✓	},
 		✓	"workspaceSymbolProvider": {}
 	*/
+	// The full-text changes are converted to incremental changes before being
+	// forwarded to clangd (see convertFullTextChanges).
+	textDocumentSyncKind := lsp.TextDocumentSyncKindIncremental
+	if ls.config.FullDocumentSync {
+		textDocumentSyncKind = lsp.TextDocumentSyncKindFull
+	}
 	resp := &lsp.InitializeResult{
 		Capabilities: lsp.ServerCapabilities{
 			TextDocumentSync: &lsp.TextDocumentSyncOptions{
-				OpenClose: true,
-				Change:    lsp.TextDocumentSyncKindIncremental,
+				OpenClose:         true,
+				Change:            textDocumentSyncKind,
+				WillSaveWaitUntil: ls.config.FormatOnSave,
 				Save: &lsp.SaveOptions{
 					IncludeText: true,
 				},
@@ -346,7 +661,7 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 					"info",
 				},
 			},
-			// DocumentLinkProvider:            &lsp.DocumentLinkOptions{ResolveProvider: false},
+			DocumentLinkProvider:            &lsp.DocumentLinkOptions{ResolveProvider: false},
 			DocumentFormattingProvider:      &lsp.DocumentFormattingOptions{},
 			DocumentRangeFormattingProvider: &lsp.DocumentRangeFormattingOptions{},
 			// SelectionRangeProvider:          &lsp.SelectionRangeRegistrationOptions{},
@@ -384,6 +699,10 @@ func (ls *INOLanguageServer) initializeReqFromIDE(ctx context.Context, logger js
 		},
 	}
 	logger.Logf("initialization parameters: %s", string(lsp.EncodeMessage(resp)))
+	ls.writeLock(logger, false)
+	ls.initializeResult = resp
+	ls.writeUnlock(logger)
+	ls.waitInitializedNotification(logger, initializedNotificationTimeout)
 	return resp, nil
 }
 
@@ -399,9 +718,56 @@ func (ls *INOLanguageServer) shutdownReqFromIDE(ctx context.Context, logger json
 	return nil
 }
 
+// completionEditRange is the conversion of the edit range of completion items:
+// valid is false if the range can't be used in the IDE document.
+type completionEditRange struct {
+	ideRange lsp.Range
+	valid    bool
+}
+
+// activeCompletion is a completion request that is being served for a document.
+type activeCompletion struct {
+	cancel context.CancelFunc
+}
+
+// startCompletion registers a completion request for the given document,
+// canceling the previous one still running for the same document: while typing
+// fast only the last completion is useful. The returned function must be
+// called when the request is completed.
+func (ls *INOLanguageServer) startCompletion(ctx context.Context, logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	completion := &activeCompletion{cancel: cancel}
+
+	ls.activeCompletionsMux.Lock()
+	if ls.activeCompletions == nil {
+		ls.activeCompletions = map[lsp.DocumentURI]*activeCompletion{}
+	}
+	if prev := ls.activeCompletions[ideURI]; prev != nil {
+		logger.Logf("canceling the previous completion request for %s", ideURI)
+		prev.cancel()
+	}
+	ls.activeCompletions[ideURI] = completion
+	ls.activeCompletionsMux.Unlock()
+
+	return ctx, func() {
+		ls.activeCompletionsMux.Lock()
+		if ls.activeCompletions[ideURI] == completion {
+			delete(ls.activeCompletions, ideURI)
+		}
+		ls.activeCompletionsMux.Unlock()
+		cancel()
+	}
+}
+
 func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.CompletionParams) (*lsp.CompletionList, *jsonrpc.ResponseError) {
+	ctx, completionDone := ls.startCompletion(ctx, logger, ideParams.TextDocument.URI)
+	defer completionDone()
+
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
 
 	clangTextDocPositionParams, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
@@ -422,6 +788,10 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 		ls.Close()
 		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
 	}
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		// Superseded by a newer completion request (or canceled by the IDE)
+		return nil, respErr
+	}
 	if clangErr != nil {
 		logger.Logf("clangd response error: %v", clangErr.AsError())
 		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
@@ -430,33 +800,56 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 	ideCompletionList := &lsp.CompletionList{
 		IsIncomplete: clangCompletionList.IsIncomplete,
 	}
+	// clangd uses the same edit range for all the items of a completion list:
+	// remap it to the ino once, instead of converting identical data per item.
+	// (go.bug.st/lsp doesn't decode CompletionList.itemDefaults, so the shared
+	// range can't be moved there)
+	ideEditRanges := map[lsp.Range]completionEditRange{}
 	for _, clangItem := range clangCompletionList.Items {
-		if strings.HasPrefix(clangItem.InsertText, "_") {
-			// XXX: Should be really ignored?
+		if max := ls.config.MaxCompletions; max > 0 && len(ideCompletionList.Items) >= max {
+			// Let the client query again as the user types more
+			logger.Logf("completion list truncated to %d items", max)
+			ideCompletionList.IsIncomplete = true
+			break
+		}
+		if ls.isHiddenCompletionItem(clangItem) {
 			continue
 		}
 
+		// The conversion depends only on the range, except for the edits starting
+		// with a newline (see cpp2inoTextEdit)
+		cacheableEdit := clangItem.TextEdit != nil && !strings.HasPrefix(clangItem.TextEdit.NewText, "\n")
 		var ideTextEdit *lsp.TextEdit
-		if clangItem.TextEdit != nil {
-			if ideURI, _ideTextEdit, isPreprocessed, err := ls.cpp2inoTextEdit(logger, clangParams.TextDocument.URI, *clangItem.TextEdit); err != nil {
-				logger.Logf("Error converting textedit: %s", err)
-				return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
-			} else if ideURI != ideParams.TextDocument.URI || isPreprocessed {
-				err := fmt.Errorf("text edit is in preprocessed section or is mapped to another file")
-				logger.Logf("Error converting textedit: %s", err)
-				return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
-			} else {
-				ideTextEdit = &_ideTextEdit
+		if clangItem.TextEdit == nil {
+			// nothing to convert
+		} else if editRange, ok := ideEditRanges[clangItem.TextEdit.Range]; ok && cacheableEdit {
+			if !editRange.valid {
+				continue
+			}
+			ideTextEdit = &lsp.TextEdit{Range: editRange.ideRange, NewText: clangItem.TextEdit.NewText}
+		} else {
+			ideURI, _ideTextEdit, isPreprocessed, err := ls.cpp2inoTextEdit(logger, clangParams.TextDocument.URI, *clangItem.TextEdit)
+			valid := err == nil && ideURI == ideParams.TextDocument.URI && !isPreprocessed
+			if cacheableEdit {
+				ideEditRanges[clangItem.TextEdit.Range] = completionEditRange{ideRange: _ideTextEdit.Range, valid: valid}
+			}
+			if err != nil {
+				logger.Logf("Error converting textedit, skipping item %s: %s", clangItem.Label, err)
+				continue
+			} else if !valid {
+				logger.Logf("Text edit is in preprocessed section or is mapped to another file, skipping item %s", clangItem.Label)
+				continue
 			}
+			ideTextEdit = &_ideTextEdit
 		}
 		var ideAdditionalTextEdits []lsp.TextEdit
 		if len(clangItem.AdditionalTextEdits) > 0 {
-			_ideAdditionalTextEdits, err := ls.cland2IdeTextEdits(logger, clangParams.TextDocument.URI, clangItem.AdditionalTextEdits)
+			_ideAdditionalTextEdits, err := ls.clang2IdeCompletionAdditionalTextEdits(logger, clangParams.TextDocument.URI, ideParams.TextDocument.URI, clangItem.AdditionalTextEdits)
 			if err != nil {
-				logger.Logf("Error converting textedit: %s", err)
-				return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+				logger.Logf("Error converting additional textedits, skipping item %s: %s", clangItem.Label, err)
+				continue
 			}
-			ideAdditionalTextEdits = _ideAdditionalTextEdits[ideParams.TextDocument.URI]
+			ideAdditionalTextEdits = _ideAdditionalTextEdits
 		}
 
 		var ideCommand *lsp.Command
@@ -488,6 +881,12 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 			TextEdit:            ideTextEdit,
 			AdditionalTextEdits: ideAdditionalTextEdits,
 		})
+		if !ls.snippetsEnabled() {
+			convertSnippetToPlainText(&ideCompletionList.Items[len(ideCompletionList.Items)-1])
+		}
+	}
+	if ideDoc, ok := ls.trackedIdeDocs[ideParams.TextDocument.URI.AsPath().String()]; ok {
+		removeDuplicatedIncludeEdits(ls.completionIncludesContext(ideDoc), ideCompletionList.Items)
 	}
 	logger.Logf("<-- completion(%d items)", len(ideCompletionList.Items))
 	return ideCompletionList, nil
@@ -496,6 +895,9 @@ func (ls *INOLanguageServer) textDocumentCompletionReqFromIDE(ctx context.Contex
 func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.HoverParams) (*lsp.Hover, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
 
 	clangTextDocPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
@@ -523,6 +925,13 @@ func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, lo
 		return nil, nil
 	}
 
+	// Hovers on the code generated by the Arduino preprocessor (like the
+	// function prototypes) are misleading for the user: suppress them.
+	clangDefinitions := ls.hoverDefinitions(ctx, logger, clangParams)
+	if ls.clangLocationsInPreprocessedSection(logger, clangDefinitions) {
+		logger.Logf("hovered symbol defined in the preprocessed section of the sketch, ignored")
+		return nil, nil
+	}
 	var ideRange *lsp.Range
 	if clangResp.Range != nil {
 		_, r, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangParams.TextDocument.URI, *clangResp.Range)
@@ -532,6 +941,7 @@ func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, lo
 			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
 		}
 		if inPreprocessed {
+			logger.Logf("hover on preprocessed section of the sketch, ignored")
 			return nil, nil
 		}
 		ideRange = &r
@@ -540,14 +950,78 @@ func (ls *INOLanguageServer) textDocumentHoverReqFromIDE(ctx context.Context, lo
 		Contents: clangResp.Contents,
 		Range:    ideRange,
 	}
+	if ls.config.HoverShowSourceLocation {
+		if location := ls.hoverSourceLocation(logger, clangDefinitions); location != "" {
+			if ideResp.Contents.Kind == lsp.MarkupKindMarkdown {
+				ideResp.Contents.Value += "\n\n---\nDefined in `" + location + "`"
+			} else {
+				ideResp.Contents.Value += "\n\nDefined in " + location
+			}
+		}
+	}
 	logger.Logf("Hover content: %s", strconv.Quote(ideResp.Contents.Value))
 	return &ideResp, nil
 }
 
+// hoverDefinitions returns the clangd locations of the definition of the
+// hovered symbol, or nil if clangd can't find it. The caller must hold the read lock.
+func (ls *INOLanguageServer) hoverDefinitions(ctx context.Context, logger jsonrpc.FunctionLogger, clangParams *lsp.HoverParams) []lsp.Location {
+	clangLocations, _, clangErr, err := ls.Clangd.conn.TextDocumentDefinition(ctx, &lsp.DefinitionParams{
+		TextDocumentPositionParams: clangParams.TextDocumentPositionParams,
+	})
+	if err != nil || clangErr != nil {
+		logger.Logf("error looking up the definition of the hovered symbol: %v %v", err, clangErr)
+		return nil
+	}
+	return clangLocations
+}
+
+// clangLocationsInPreprocessedSection returns true if all the given clangd
+// locations are in the code generated by the Arduino preprocessor.
+func (ls *INOLanguageServer) clangLocationsInPreprocessedSection(logger jsonrpc.FunctionLogger, clangLocations []lsp.Location) bool {
+	if len(clangLocations) == 0 {
+		return false
+	}
+	for _, clangLocation := range clangLocations {
+		if !ls.clangURIRefersToIno(clangLocation.URI) {
+			return false
+		}
+		if _, inPreprocessed, err := ls.clang2IdeLocation(logger, clangLocation); err != nil || !inPreprocessed {
+			return false
+		}
+	}
+	return true
+}
+
+// hoverSourceLocation returns the sketch tab and line (like "Tab.ino:12") where
+// the hovered symbol is defined, or an empty string if the definition is not
+// in a sketch tab. The caller must hold the read lock.
+func (ls *INOLanguageServer) hoverSourceLocation(logger jsonrpc.FunctionLogger, clangLocations []lsp.Location) string {
+	for _, clangLocation := range clangLocations {
+		if !ls.clangURIRefersToIno(clangLocation.URI) {
+			continue
+		}
+		ideLocation, inPreprocessed, err := ls.clang2IdeLocation(logger, clangLocation)
+		if err != nil || inPreprocessed || ideLocation.URI.Ext() != ".ino" {
+			continue
+		}
+		return fmt.Sprintf("%s:%d", ideLocation.URI.AsPath().Base(), ideLocation.Range.Start.Line+1)
+	}
+	return ""
+}
+
 func (ls *INOLanguageServer) textDocumentSignatureHelpReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.SignatureHelpParams) (*lsp.SignatureHelp, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
+
+	return ls.signatureHelp(ctx, logger, ideParams)
+}
 
+// signatureHelp forwards a signatureHelp request to clangd, the caller must hold the read lock.
+func (ls *INOLanguageServer) signatureHelp(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.SignatureHelpParams) (*lsp.SignatureHelp, *jsonrpc.ResponseError) {
 	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
 		logger.Logf("Error: %s", err)
@@ -570,14 +1044,73 @@ func (ls *INOLanguageServer) textDocumentSignatureHelpReqFromIDE(ctx context.Con
 		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
 	}
 
-	// No need to convert back to inoSignatureHelp
+	// No need to convert back to inoSignatureHelp: the response carries no
+	// locations, the active signature/parameter are indexes into the response
+	// itself and parameter labels are either strings or offsets in the
+	// signature label.
 	ideSignatureHelp := clangSignatureHelp
 	return ideSignatureHelp, nil
 }
 
+func (ls *INOLanguageServer) parameterHintsReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.TextDocumentPositionParams) (*ArduinoParameterHintsResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, true)
+	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
+
+	signatureHelp, respErr := ls.signatureHelp(ctx, logger, &lsp.SignatureHelpParams{TextDocumentPositionParams: *ideParams})
+	if respErr != nil {
+		return nil, respErr
+	}
+	if signatureHelp == nil || len(signatureHelp.Signatures) == 0 {
+		return nil, nil
+	}
+
+	activeSignature := 0
+	if idx := signatureHelp.ActiveSignature; idx != nil && *idx >= 0 && *idx < len(signatureHelp.Signatures) {
+		activeSignature = *idx
+	}
+	signature := signatureHelp.Signatures[activeSignature]
+	res := &ArduinoParameterHintsResult{
+		Signature:  signature.Label,
+		Parameters: []string{},
+	}
+	for _, param := range signature.Parameters {
+		res.Parameters = append(res.Parameters, signatureParameterLabel(signature.Label, param.Label))
+	}
+	if signature.ActiveParameter != nil {
+		res.ActiveParameter = *signature.ActiveParameter
+	} else if signatureHelp.ActiveParameter != nil {
+		res.ActiveParameter = *signatureHelp.ActiveParameter
+	}
+	return res, nil
+}
+
+// signatureParameterLabel returns the label of a signature parameter: the label
+// may be a plain string or a [start, end] pair of UTF-16 offsets in the signature label.
+func signatureParameterLabel(signatureLabel string, paramLabel json.RawMessage) string {
+	var label string
+	if err := json.Unmarshal(paramLabel, &label); err == nil {
+		return label
+	}
+	var offsets [2]int
+	if err := json.Unmarshal(paramLabel, &offsets); err != nil {
+		return ""
+	}
+	utf16Label := utf16.Encode([]rune(signatureLabel))
+	if offsets[0] < 0 || offsets[0] > offsets[1] || offsets[1] > len(utf16Label) {
+		return ""
+	}
+	return string(utf16.Decode(utf16Label[offsets[0]:offsets[1]]))
+}
+
 func (ls *INOLanguageServer) textDocumentDefinitionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, nil, respErr
+	}
 
 	clangTextDocPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
@@ -613,7 +1146,11 @@ func (ls *INOLanguageServer) textDocumentDefinitionReqFromIDE(ctx context.Contex
 
 	var ideLocationLinks []lsp.LocationLink
 	if clangLocationLinks != nil {
-		panic("unimplemented")
+		ideLocationLinks, err = ls.clang2IdeLocationLinksArray(logger, clangTextDocPosition.TextDocument.URI, clangLocationLinks)
+		if err != nil {
+			logger.Logf("Error: %v", err)
+			return nil, nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		}
 	}
 
 	return ideLocations, ideLocationLinks, nil
@@ -668,6 +1205,9 @@ func (ls *INOLanguageServer) textDocumentTypeDefinitionReqFromIDE(ctx context.Co
 func (ls *INOLanguageServer) textDocumentImplementationReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.ImplementationParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, nil, respErr
+	}
 
 	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
@@ -712,6 +1252,9 @@ func (ls *INOLanguageServer) textDocumentImplementationReqFromIDE(ctx context.Co
 func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentHighlightParams) ([]lsp.DocumentHighlight, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
 
 	clangTextDocumentPosition, err := ls.ide2ClangTextDocumentPositionParams(logger, ideParams.TextDocumentPositionParams)
 	if err != nil {
@@ -749,7 +1292,7 @@ func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context
 		}
 		if err != nil {
 			logger.Logf("ERROR converting highlight %s:%s: %s", clangURI, clangHighlight.Range, err)
-			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
 		}
 		ideHighlights = append(ideHighlights, ideHighlight)
 	}
@@ -759,6 +1302,9 @@ func (ls *INOLanguageServer) textDocumentDocumentHighlightReqFromIDE(ctx context
 func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentSymbolParams) ([]lsp.DocumentSymbol, []lsp.SymbolInformation, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, nil, respErr
+	}
 
 	// Convert request for clang
 	clangTextDocument, err := ls.ide2ClangTextDocumentIdentifier(logger, ideParams.TextDocument)
@@ -805,6 +1351,9 @@ func (ls *INOLanguageServer) textDocumentDocumentSymbolReqFromIDE(ctx context.Co
 func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.CodeActionParams) ([]lsp.CommandOrCodeAction, *jsonrpc.ResponseError) {
 	ls.readLock(logger, true)
 	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
 
 	ideTextDocument := ideParams.TextDocument
 	ideURI := ideTextDocument.URI
@@ -843,7 +1392,7 @@ func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Contex
 
 	// TODO: Create a function for this one?
 	ideCommandsOrCodeActions := []lsp.CommandOrCodeAction{}
-	if clangCommandsOrCodeActions != nil {
+	if clangCommandsOrCodeActions == nil {
 		return ideCommandsOrCodeActions, nil
 	}
 	logger.Logf("    <-- codeAction(%d elements)", len(clangCommandsOrCodeActions))
@@ -871,10 +1420,102 @@ func (ls *INOLanguageServer) textDocumentCodeActionReqFromIDE(ctx context.Contex
 	return ideCommandsOrCodeActions, nil
 }
 
+var quotedIncludeRegexp = regexp.MustCompile(`^\s*#\s*include\s*"([^"]+)"`)
+
+func (ls *INOLanguageServer) textDocumentDocumentLinkReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentLinkParams) ([]lsp.DocumentLink, *jsonrpc.ResponseError) {
+	// clangd is not needed, the sketch mapper is enough
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
+
+	ideURI := ideParams.TextDocument.URI
+	ideDoc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !ok || ls.sketchMapper == nil || !ls.ideURIIsPartOfTheSketch(ideURI) {
+		return []lsp.DocumentLink{}, nil
+	}
+
+	// The other tabs of the sketch are the .ino files listed in the #line directives
+	tabs := map[string]*paths.Path{}
+	for _, inoFile := range ls.sketchMapper.InoFiles() {
+		inoPath := paths.New(inoFile)
+		if !inoPath.EquivalentTo(ideURI.AsPath()) {
+			tabs[inoPath.Base()] = inoPath
+		}
+	}
+
+	tabNames := make([]string, 0, len(tabs))
+	for name := range tabs {
+		tabNames = append(tabNames, name)
+	}
+	slices.Sort(tabNames)
+
+	links := []lsp.DocumentLink{}
+	addLink := func(line int, text string, idx int, target string, targetPath *paths.Path) {
+		start := len(utf16.Encode([]rune(text[:idx])))
+		end := start + len(utf16.Encode([]rune(target)))
+		links = append(links, lsp.DocumentLink{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: line, Character: start},
+				End:   lsp.Position{Line: line, Character: end},
+			},
+			Target: lsp.NewDocumentURIFromPath(targetPath),
+		})
+	}
+	for line, text := range strings.Split(ideDoc.Text, "\n") {
+		// #include "OtherTab.h" -> link to the sketch file, searched like the
+		// compiler does: first in the folder of the including document
+		if m := quotedIncludeRegexp.FindStringSubmatchIndex(text); m != nil {
+			include := text[m[2]:m[3]]
+			for _, dir := range []*paths.Path{ideURI.AsPath().Parent(), ls.sketchRoot} {
+				if target := dir.Join(include); target.Exist() {
+					addLink(line, text, m[2], include, target)
+					break
+				}
+			}
+			continue
+		}
+		// References to another tab, like "see OtherTab.ino" -> link to the tab
+		for _, name := range tabNames {
+			for _, idx := range wordOccurrences(text, name) {
+				addLink(line, text, idx, name, tabs[name])
+			}
+		}
+	}
+	logger.Logf("<-- documentLink(%d links)", len(links))
+	return links, nil
+}
+
+// wordOccurrences returns the byte offsets of the occurrences of word in text
+// that are not part of a longer identifier.
+func wordOccurrences(text, word string) []int {
+	isIdentifierChar := func(c byte) bool {
+		return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+	}
+	res := []int{}
+	for offset := 0; word != ""; {
+		idx := strings.Index(text[offset:], word)
+		if idx == -1 {
+			break
+		}
+		start, end := offset+idx, offset+idx+len(word)
+		if (start == 0 || !isIdentifierChar(text[start-1])) && (end == len(text) || !isIdentifierChar(text[end])) {
+			res = append(res, start)
+		}
+		offset = end
+	}
+	return res
+}
+
 func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
 
+	ls.lastFormattingOptions = ideParams.Options
 	ideTextDocument := ideParams.TextDocument
 	ideURI := ideTextDocument.URI
 
@@ -885,27 +1526,37 @@ func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Contex
 	}
 	clangURI := clangTextDocument.URI
 
-	cleanup, err := ls.createClangdFormatterConfig(logger, clangURI)
+	formatURI, cleanup, err := ls.createClangdFormatterConfig(logger, ideURI, clangURI)
 	if err != nil {
 		logger.Logf("Error: %s", err)
 		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
 	}
 	defer cleanup()
 
-	clangParams := &lsp.DocumentFormattingParams{
-		WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
-		Options:                ideParams.Options,
-		TextDocument:           clangTextDocument,
-	}
-	clangEdits, clangErr, err := ls.Clangd.conn.TextDocumentFormatting(ctx, clangParams)
-	if err != nil {
-		logger.Logf("clangd communication error: %v", err)
-		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
-	}
-	if clangErr != nil {
-		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+	var clangEdits []lsp.TextEdit
+	if ls.config.ClangFormatPath != nil {
+		clangEdits, err = ls.clangFormatTextEdits(ctx, logger, ideURI, clangURI, formatURI, nil)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		}
+	} else {
+		clangParams := &lsp.DocumentFormattingParams{
+			WorkDoneProgressParams: ideParams.WorkDoneProgressParams,
+			Options:                ideParams.Options,
+			TextDocument:           lsp.TextDocumentIdentifier{URI: formatURI},
+		}
+		var clangErr *jsonrpc.ResponseError
+		clangEdits, clangErr, err = ls.Clangd.conn.TextDocumentFormatting(ctx, clangParams)
+		if err != nil {
+			logger.Logf("clangd communication error: %v", err)
+			ls.Close()
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		}
+		if clangErr != nil {
+			logger.Logf("clangd response error: %v", clangErr.AsError())
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		}
 	}
 
 	if clangEdits == nil {
@@ -929,7 +1580,11 @@ func (ls *INOLanguageServer) textDocumentFormattingReqFromIDE(ctx context.Contex
 func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.DocumentRangeFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
+	if respErr := requestCancelledError(ctx); respErr != nil {
+		return nil, respErr
+	}
 
+	ls.lastFormattingOptions = ideParams.Options
 	ideURI := ideParams.TextDocument.URI
 	clangURI, clangRange, err := ls.ide2ClangRange(logger, ideURI, ideParams.Range)
 	if err != nil {
@@ -943,22 +1598,33 @@ func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.C
 		Range:                  clangRange,
 	}
 
-	cleanup, e := ls.createClangdFormatterConfig(logger, clangURI)
-	if e != nil {
+	formatURI, cleanup, err := ls.createClangdFormatterConfig(logger, ideURI, clangURI)
+	if err != nil {
 		logger.Logf("cannot create formatter config file: %v", err)
 		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
 	}
 	defer cleanup()
+	clangParams.TextDocument.URI = formatURI
 
-	clangEdits, clangErr, err := ls.Clangd.conn.TextDocumentRangeFormatting(ctx, clangParams)
-	if err != nil {
-		logger.Logf("clangd communication error: %v", err)
-		ls.Close()
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
-	}
-	if clangErr != nil {
-		logger.Logf("clangd response error: %v", clangErr.AsError())
-		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+	var clangEdits []lsp.TextEdit
+	if ls.config.ClangFormatPath != nil {
+		clangEdits, err = ls.clangFormatTextEdits(ctx, logger, ideURI, clangURI, formatURI, &clangRange)
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		}
+	} else {
+		var clangErr *jsonrpc.ResponseError
+		clangEdits, clangErr, err = ls.Clangd.conn.TextDocumentRangeFormatting(ctx, clangParams)
+		if err != nil {
+			logger.Logf("clangd communication error: %v", err)
+			ls.Close()
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
+		}
+		if clangErr != nil {
+			logger.Logf("clangd response error: %v", clangErr.AsError())
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: clangErr.AsError().Error()}
+		}
 	}
 
 	if clangEdits == nil {
@@ -979,12 +1645,105 @@ func (ls *INOLanguageServer) textDocumentRangeFormattingReqFromIDE(ctx context.C
 	return inoEdits, nil
 }
 
+func (ls *INOLanguageServer) textDocumentWillSaveWaitUntilReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.WillSaveTextDocumentParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
+	if !ls.config.FormatOnSave {
+		return []lsp.TextEdit{}, nil
+	}
+
+	// The request doesn't carry formatting options: reuse the ones of the last
+	// formatting request, if any, otherwise the .clang-format rules only apply
+	ls.readLock(logger, false)
+	options := ls.lastFormattingOptions
+	ls.readUnlock(logger)
+	if options == nil {
+		options = lsp.FormattingOptions{}
+	}
+	ideEdits, respErr := ls.textDocumentFormattingReqFromIDE(ctx, logger, &lsp.DocumentFormattingParams{
+		TextDocument: ideParams.RextDocument, // sic, the field name is misspelled in go.bug.st/lsp
+		Options:      options,
+	})
+	if respErr != nil {
+		return nil, respErr
+	}
+	if ideEdits == nil {
+		return []lsp.TextEdit{}, nil
+	}
+	return ideEdits, nil
+}
+
 func (ls *INOLanguageServer) initializedNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.InitializedParams) {
 	logger.Logf("Notification is not propagated to clangd")
+	ls.ideInitialized(logger, "initialized notification received")
+}
+
+// initializedNotificationTimeout is how long to wait for the initialized
+// notification after the initialize response: some clients never send it.
+const initializedNotificationTimeout = 5 * time.Second
+
+// waitInitializedNotification proceeds as if the initialized notification was
+// received if it doesn't arrive within the given timeout.
+func (ls *INOLanguageServer) waitInitializedNotification(logger jsonrpc.FunctionLogger, timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		defer streams.CatchAndLogPanic()
+		ls.ideInitialized(logger, fmt.Sprintf("initialized notification not received after %s, proceeding anyway", timeout))
+	})
+}
+
+// ideInitialized runs, only once, the actions that require the IDE to be
+// initialized (like the requests sent to the IDE).
+func (ls *INOLanguageServer) ideInitialized(logger jsonrpc.FunctionLogger, reason string) {
+	ls.ideInitializedOnce.Do(func() {
+		logger.Logf("IDE initialized: %s", reason)
+		if !ls.config.pullDiagnostics() {
+			return
+		}
+		// The DiagnosticProvider server capability is not available in go.bug.st/lsp,
+		// the pull diagnostics are registered dynamically instead.
+		if !ls.ideDiagnosticRegistration.Load() {
+			logger.Logf("the IDE doesn't support the dynamic registration of the pull diagnostics")
+			return
+		}
+		go ls.registerPullDiagnostics(logger)
+	})
+}
+
+// registerPullDiagnostics asks the IDE to pull the diagnostics with
+// textDocument/diagnostic requests.
+func (ls *INOLanguageServer) registerPullDiagnostics(logger jsonrpc.FunctionLogger) {
+	defer streams.CatchAndLogPanic()
+
+	registerOptions, err := json.Marshal(map[string]interface{}{
+		"documentSelector": []map[string]string{
+			{"language": "ino"},
+			{"language": "c"},
+			{"language": "cpp"},
+		},
+		"interFileDependencies": true,
+		"workspaceDiagnostics":  false,
+	})
+	if err != nil {
+		logger.Logf("error registering pull diagnostics: %s", err)
+		return
+	}
+	respErr, err := ls.IDE.conn.ClientRegisterCapability(context.Background(), &lsp.RegistrationParams{
+		Registrations: []lsp.Registration{{
+			ID:              "arduino-language-server-diagnostics",
+			Method:          "textDocument/diagnostic",
+			RegisterOptions: registerOptions,
+		}},
+	})
+	if err != nil {
+		logger.Logf("error registering pull diagnostics: %s", err)
+	} else if respErr != nil {
+		logger.Logf("error registering pull diagnostics: %s", respErr.AsError())
+	}
 }
 
 func (ls *INOLanguageServer) exitNotifFromIDE(logger jsonrpc.FunctionLogger) {
-	ls.Clangd.conn.Exit()
+	// clangd may not be running if the initialization failed
+	if ls.Clangd != nil {
+		ls.Clangd.conn.Exit()
+	}
 	logger.Logf("Arduino Language Server is exiting.")
 	ls.Close()
 }
@@ -993,7 +1752,17 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
-	ideTextDocItem := ideParam.TextDocument
+	ls.openIdeDocument(logger, ideParam.TextDocument)
+}
+
+// openIdeDocument starts tracking the given document and opens it in clangd.
+func (ls *INOLanguageServer) openIdeDocument(logger jsonrpc.FunctionLogger, ideTextDocItem lsp.TextDocumentItem) {
+	if _, tracked := ls.trackedIdeDocs[ideTextDocItem.URI.AsPath().String()]; tracked {
+		// Some editors send a didOpen for each view of the same document
+		logger.Logf("Document already opened, ignoring duplicate didOpen: %s", ideTextDocItem.URI)
+		return
+	}
+
 	clangURI, _, err := ls.ide2ClangDocumentURI(logger, ideTextDocItem.URI)
 	if err != nil {
 		logger.Logf("Error: %s", err)
@@ -1002,7 +1771,7 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 
 	if ls.ideURIIsPartOfTheSketch(ideTextDocItem.URI) {
 		if !clangURI.AsPath().Exist() {
-			ls.triggerRebuildAndWait(logger)
+			ls.triggerRebuildAndWait(logger, true)
 		}
 	}
 
@@ -1019,23 +1788,15 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 			logger.Logf("Clang already notified, do not notify it anymore")
 			return
 		}
+	} else if ls.sketchDocIsClosedInClangd(ideTextDocItem.URI) {
+		logger.Logf("No .ino opened, the document will be sent to clangd with the sketch")
+		return
 	}
 
-	clangTextDocItem := lsp.TextDocumentItem{
-		URI: clangURI,
-	}
-	if ls.clangURIRefersToIno(clangURI) {
-		clangTextDocItem.LanguageID = "cpp"
-		clangTextDocItem.Text = ls.sketchMapper.CppText.Text
-		clangTextDocItem.Version = ls.sketchMapper.CppText.Version
-	} else {
-		clangText, err := clangURI.AsPath().ReadFile()
-		if err != nil {
-			logger.Logf("Error opening sketch file %s: %s", clangURI.AsPath(), err)
-		}
-		clangTextDocItem.LanguageID = ideTextDocItem.LanguageID
-		clangTextDocItem.Version = ideTextDocItem.Version
-		clangTextDocItem.Text = string(clangText)
+	clangTextDocItem, err := ls.ide2ClangTextDocumentItem(logger, ideTextDocItem)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return
 	}
 
 	if err := ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
@@ -1045,6 +1806,16 @@ func (ls *INOLanguageServer) textDocumentDidOpenNotifFromIDE(logger jsonrpc.Func
 		logger.Logf("Error sending notification to clangd server: %v", err)
 		logger.Logf("Please restart the language server.")
 		ls.Close()
+		return
+	}
+
+	if ideTextDocItem.URI.Ext() == ".ino" && ls.sketchDocsClosedInClangd {
+		// The other documents of the sketch have been closed with the last .ino
+		if err := ls.openSketchDocsInClangd(logger); err != nil {
+			logger.Logf("Error sending notification to clangd server: %v", err)
+			logger.Logf("Please restart the language server.")
+			ls.Close()
+		}
 	}
 }
 
@@ -1052,7 +1823,7 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
-	ls.triggerRebuild()
+	ls.triggerRebuildForDocument(logger, ideParams.TextDocument.URI)
 
 	logger.Logf("didChange(%s)", ideParams.TextDocument)
 	for _, change := range ideParams.ContentChanges {
@@ -1071,9 +1842,25 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 
 	// Apply the change to the tracked sketch file.
 	trackedIdeDocID := ideTextDocIdentifier.URI.AsPath().String()
+	if _, ok := ls.trackedIdeDocs[trackedIdeDocID]; !ok {
+		// Some editors do not send a didOpen for all the buffers: start tracking
+		// the document as it is on disk, the changes are applied below.
+		ideTextDocItem, err := untrackedIdeDocument(ideParams)
+		if err != nil {
+			logger.Logf("Error: %s: %s", &UnknownURIError{ideTextDocIdentifier.URI}, err)
+			return
+		}
+		logger.Logf("didChange of untracked document, start tracking it: %s", ideTextDocIdentifier.URI)
+		ls.openIdeDocument(logger, ideTextDocItem)
+	}
+	var ideChanges []lsp.TextDocumentContentChangeEvent
+	var err error
 	if doc, ok := ls.trackedIdeDocs[trackedIdeDocID]; !ok {
 		logger.Logf("Error: %s", &UnknownURIError{ideTextDocIdentifier.URI})
 		return
+	} else if ideChanges, err = convertFullTextChanges(doc.Text, ideParams.ContentChanges); err != nil {
+		logger.Logf("Error: %s", err)
+		return
 	} else if updatedDoc, err := textedits.ApplyLSPTextDocumentContentChangeEvent(doc, ideParams); err != nil {
 		logger.Logf("Error: %s", err)
 		return
@@ -1081,15 +1868,15 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 		ls.trackedIdeDocs[trackedIdeDocID] = updatedDoc
 		logger.Logf("-----Tracked SKETCH file-----\n" + updatedDoc.Text + "\n-----------------------------")
 	}
+	if ls.sketchDocIsClosedInClangd(ideTextDocIdentifier.URI) {
+		logger.Logf("No .ino opened, the change is not forwarded to clangd")
+		return
+	}
 
 	clangChanges := []lsp.TextDocumentContentChangeEvent{}
 	var clangURI *lsp.DocumentURI
 	var clangParams *lsp.DidChangeTextDocumentParams
-	for _, ideChange := range ideParams.ContentChanges {
-		if ideChange.Range == nil {
-			panic("full-text change not implemented")
-		}
-
+	for i, ideChange := range ideChanges {
 		clangRangeURI, clangRange, err := ls.ide2ClangRange(logger, ideTextDocIdentifier.URI, *ideChange.Range)
 		if err != nil {
 			logger.Logf("Error: %s", err)
@@ -1106,6 +1893,13 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 
 		// If we are applying changes to a .ino, update the sketchmapper
 		if ideTextDocIdentifier.URI.Ext() == ".ino" {
+			if ideParams.ContentChanges[i].Range == nil {
+				// The sketch mapper counts the characters in bytes: replace
+				// up to the end of the last line, whatever its length
+				mapperRange := *ideChange.Range
+				mapperRange.End.Character = math.MaxInt32
+				ideChange.Range = &mapperRange
+			}
 			_ = ls.sketchMapper.ApplyTextChange(ideTextDocIdentifier.URI, ideChange)
 		}
 
@@ -1121,6 +1915,7 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 		// If changes are applied to a .ino file we increment the global .ino.cpp versioning
 		// for each increment of the single .ino file.
 		clangVersion = ls.sketchMapper.CppText.Version
+		ls.recordInoVersions()
 		ls.sketchMapper.DebugLogAll()
 	}
 
@@ -1144,6 +1939,55 @@ func (ls *INOLanguageServer) textDocumentDidChangeNotifFromIDE(logger jsonrpc.Fu
 	}
 }
 
+// untrackedIdeDocument returns the document, as it was before the given changes,
+// of a didChange received for a document not opened by the IDE. The content is
+// read from disk, unless the first change replaces the whole text.
+func untrackedIdeDocument(ideParams *lsp.DidChangeTextDocumentParams) (lsp.TextDocumentItem, error) {
+	uri := ideParams.TextDocument.URI
+	languageID := "cpp"
+	if uri.Ext() == ".c" {
+		languageID = "c"
+	}
+	doc := lsp.TextDocumentItem{
+		URI:        uri,
+		LanguageID: languageID,
+		Version:    ideParams.TextDocument.Version - 1,
+	}
+	if len(ideParams.ContentChanges) > 0 && ideParams.ContentChanges[0].Range == nil {
+		return doc, nil
+	}
+	data, err := uri.AsPath().ReadFile()
+	if err != nil {
+		return doc, err
+	}
+	doc.Text = string(data)
+	return doc, nil
+}
+
+// convertFullTextChanges returns the content changes with the full-text ones
+// converted into changes of the range spanning the whole document, so they can
+// be mapped to clangd like the incremental ones. text is the content of the
+// document before the changes.
+func convertFullTextChanges(text string, changes []lsp.TextDocumentContentChangeEvent) ([]lsp.TextDocumentContentChangeEvent, error) {
+	res := make([]lsp.TextDocumentContentChangeEvent, 0, len(changes))
+	for _, change := range changes {
+		if change.Range == nil {
+			lines := strings.Split(text, "\n")
+			lastLine := lines[len(lines)-1]
+			change.Range = &lsp.Range{
+				End: lsp.Position{Line: len(lines) - 1, Character: len(utf16.Encode([]rune(lastLine)))},
+			}
+			text = change.Text
+		} else if newText, err := textedits.ApplyTextChange(text, *change.Range, change.Text); err != nil {
+			return nil, err
+		} else {
+			text = newText
+		}
+		res = append(res, change)
+	}
+	return res, nil
+}
+
 func (ls *INOLanguageServer) textDocumentDidSaveNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DidSaveTextDocumentParams) {
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
@@ -1152,14 +1996,19 @@ func (ls *INOLanguageServer) textDocumentDidSaveNotifFromIDE(logger jsonrpc.Func
 	// so we will not forward notification on saves in the sketch folder.
 	logger.Logf("notification is not forwarded to clang")
 
-	ls.triggerRebuild()
+	idePath := ideParams.TextDocument.URI.AsPath().String()
+	if doc, tracked := ls.trackedIdeDocs[idePath]; tracked && ls.lastBuiltDocsHash[idePath] == docContentHash(doc.Text) {
+		logger.Logf("document not changed since the last build, rebuild skipped")
+		return
+	}
+	ls.triggerRebuildForDocument(logger, ideParams.TextDocument.URI)
 }
 
 func (ls *INOLanguageServer) textDocumentDidCloseNotifFromIDE(logger jsonrpc.FunctionLogger, ideParams *lsp.DidCloseTextDocumentParams) {
 	ls.writeLock(logger, true)
 	defer ls.writeUnlock(logger)
 
-	ls.triggerRebuild()
+	ls.triggerRebuildForDocument(logger, ideParams.TextDocument.URI)
 
 	inoIdentifier := ideParams.TextDocument
 	if _, exist := ls.trackedIdeDocs[inoIdentifier.URI.AsPath().String()]; exist {
@@ -1169,6 +2018,13 @@ func (ls *INOLanguageServer) textDocumentDidCloseNotifFromIDE(logger jsonrpc.Fun
 		return
 	}
 
+	// The diagnostics of the sketch files are kept, if requested by configuration
+	if !ls.config.KeepClosedDocsDiagnostics || !ls.ideURIIsPartOfTheSketch(inoIdentifier.URI) {
+		ls.ideDocsDiagnosticsMux.Lock()
+		delete(ls.ideDocsDiagnostics, inoIdentifier.URI)
+		ls.ideDocsDiagnosticsMux.Unlock()
+	}
+
 	// If we are tracking a .ino...
 	if inoIdentifier.URI.Ext() == ".ino" {
 		ls.sketchTrackedFilesCount--
@@ -1179,6 +2035,9 @@ func (ls *INOLanguageServer) textDocumentDidCloseNotifFromIDE(logger jsonrpc.Fun
 			logger.Logf("--X Notification is not propagated to clangd")
 			return
 		}
+	} else if ls.sketchDocIsClosedInClangd(inoIdentifier.URI) {
+		logger.Logf("--X Document already closed in clangd")
+		return
 	}
 
 	clangIdentifier, err := ls.ide2ClangTextDocumentIdentifier(logger, inoIdentifier)
@@ -1195,7 +2054,207 @@ func (ls *INOLanguageServer) textDocumentDidCloseNotifFromIDE(logger jsonrpc.Fun
 		logger.Logf("Error sending notification to clangd server: %v", err)
 		logger.Logf("Please restart the language server.")
 		ls.Close()
+		return
+	}
+
+	if inoIdentifier.URI.Ext() == ".ino" {
+		ls.closeSketchDocsInClangd(logger)
+	}
+}
+
+// closeSketchDocsInClangd sends a didClose to clangd for all the tracked files of
+// the sketch that are not .ino. It's called when the last .ino is closed, to
+// avoid clangd holding stale buffers of the sketch: the documents are still
+// tracked, and sent again to clangd when an .ino is reopened.
+func (ls *INOLanguageServer) closeSketchDocsInClangd(logger jsonrpc.FunctionLogger) {
+	ls.sketchDocsClosedInClangd = true
+	for _, ideTextDocItem := range ls.trackedIdeDocs {
+		if ideTextDocItem.URI.Ext() == ".ino" || !ls.ideURIIsPartOfTheSketch(ideTextDocItem.URI) {
+			continue
+		}
+		clangIdentifier, err := ls.ide2ClangTextDocumentIdentifier(logger, lsp.TextDocumentIdentifier{URI: ideTextDocItem.URI})
+		if err != nil {
+			logger.Logf("Error: %s", err)
+			continue
+		}
+		logger.Logf("--> didClose(%s)", clangIdentifier)
+		if err := ls.Clangd.conn.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{TextDocument: clangIdentifier}); err != nil {
+			logger.Logf("Error sending notification to clangd server: %v", err)
+			logger.Logf("Please restart the language server.")
+			ls.Close()
+			return
+		}
+	}
+}
+
+// openSketchDocsInClangd sends a didOpen to clangd for all the tracked files of
+// the sketch that are not .ino.
+func (ls *INOLanguageServer) openSketchDocsInClangd(logger jsonrpc.FunctionLogger) error {
+	ls.sketchDocsClosedInClangd = false
+	for _, ideTextDocItem := range ls.trackedIdeDocs {
+		if ideTextDocItem.URI.Ext() == ".ino" || !ls.ideURIIsPartOfTheSketch(ideTextDocItem.URI) {
+			continue
+		}
+		clangTextDocItem, err := ls.ide2ClangTextDocumentItem(logger, ideTextDocItem)
+		if err != nil {
+			logger.Logf("error converting tracked document %s: %s", ideTextDocItem.URI, err)
+			continue
+		}
+		logger.Logf("Sending 'didOpen' notification to Clangd for %s", clangTextDocItem.URI)
+		if err := ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
+			TextDocument: clangTextDocItem,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sketchDocIsClosedInClangd returns true if the given document of the sketch has
+// been closed in clangd because all the .ino files have been closed.
+func (ls *INOLanguageServer) sketchDocIsClosedInClangd(ideURI lsp.DocumentURI) bool {
+	return ls.sketchDocsClosedInClangd && ideURI.Ext() != ".ino" && ls.ideURIIsPartOfTheSketch(ideURI)
+}
+
+func (ls *INOLanguageServer) statusReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*ArduinoStatusResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	res := &ArduinoStatusResult{
+		ClangdRunning:      ls.Clangd != nil,
+		LastBuildSucceeded: ls.lastBuildSucceeded,
+		Fqbn:               ls.config.Fqbn,
+		Programmer:         ls.config.Programmer,
+	}
+	// The sketch root is not known before the initialize request
+	if ls.sketchRoot != nil {
+		res.SketchRoot = ls.sketchRoot.String()
+	}
+	if ls.buildPath != nil {
+		res.BuildPath = ls.buildPath.String()
+	}
+	return res, nil
+}
+
+func (ls *INOLanguageServer) preprocessedSketchReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*ArduinoPreprocessedSketchResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchMapper == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "sketch not yet preprocessed"}
+	}
+	return &ArduinoPreprocessedSketchResult{
+		URI:     lsp.NewDocumentURIFromPath(ls.buildSketchCpp),
+		Version: ls.sketchMapper.CppText.Version,
+		Text:    ls.sketchMapper.CppText.Text,
+	}, nil
+}
+
+func (ls *INOLanguageServer) lineMapReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*ArduinoLineMapResult, *jsonrpc.ResponseError) {
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+
+	if ls.sketchMapper == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "sketch not yet preprocessed"}
+	}
+	return &ArduinoLineMapResult{
+		CppToIno: ls.sketchMapper.CppToInoMappings(),
+		InoToCpp: ls.sketchMapper.InoToCppMappings(),
+	}, nil
+}
+
+func (ls *INOLanguageServer) reloadConfigReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger) (*ArduinoReloadConfigResult, *jsonrpc.ResponseError) {
+	// arduino-cli reads its configuration file on every run (the daemon
+	// configuration is managed by the IDE): the data folder is obtained again
+	// and a full rebuild picks up the newly installed cores and libraries.
+	dataFolder, err := ls.extractDataFolderFromArduinoCLI(logger)
+	if err != nil {
+		logger.Logf("error retrieving data folder from arduino-cli: %s", err)
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: err.Error()}
 	}
+
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+	logger.Logf("Arduino data folder refreshed: %s", dataFolder)
+	res := &ArduinoReloadConfigResult{DataFolder: dataFolder.String()}
+	if ls.clangdDataFolder != nil && !ls.clangdDataFolder.EquivalentTo(dataFolder) && ls.Clangd != nil {
+		// clangd gets the data folder on the command line: it's restarted
+		// by the next request that needs it
+		logger.Logf("Arduino data folder changed from %s, restarting clangd", ls.clangdDataFolder)
+		ls.stopClangd()
+		res.ClangdRestarted = true
+	}
+	ls.clangdDataFolder = dataFolder
+	ls.sketchRebuilder.TriggerFullRebuild()
+	return res, nil
+}
+
+func (ls *INOLanguageServer) didChangeBoardOptionsNotifFromIDE(logger jsonrpc.FunctionLogger, params *DidChangeBoardOptionsParams) {
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+
+	fqbn, err := fqbnWithBoardOptions(ls.config.Fqbn, params.BoardOptions)
+	if err != nil {
+		logger.Logf("Error: %s", err)
+		return
+	}
+	logger.Logf("FQBN changed: %s -> %s", ls.config.Fqbn, fqbn)
+	ls.config.Fqbn = fqbn
+	ls.triggerRebuild()
+}
+
+func (ls *INOLanguageServer) selectedBoardNotifFromIDE(logger jsonrpc.FunctionLogger, params *ArduinoSelectedBoardParams) {
+	if err := ValidateFqbn(params.Fqbn); err != nil {
+		logger.Logf("Error: %s", err)
+		return
+	}
+
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+	logger.Logf("FQBN changed: %s -> %s", ls.config.Fqbn, params.Fqbn)
+	ls.config.Fqbn = params.Fqbn
+	ls.triggerRebuild()
+}
+
+func (ls *INOLanguageServer) selectedBoardReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, params *ArduinoSelectedBoardParams) (*ArduinoSelectedBoardResult, *jsonrpc.ResponseError) {
+	if err := ValidateFqbn(params.Fqbn); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+
+	ls.writeLock(logger, true)
+	defer ls.writeUnlock(logger)
+	logger.Logf("FQBN changed: %s -> %s", ls.config.Fqbn, params.Fqbn)
+	ls.config.Fqbn = params.Fqbn
+	ls.triggerRebuildAndWait(logger, true)
+
+	if !ls.lastBuildSucceeded {
+		return &ArduinoSelectedBoardResult{
+			Success: false,
+			Message: "Could not build the sketch for the board " + params.Fqbn + ", editor support may be inaccurate.",
+		}, nil
+	}
+	return &ArduinoSelectedBoardResult{
+		Success: true,
+		Message: "Editor support updated for the board " + params.Fqbn + ".",
+	}, nil
+}
+
+func (ls *INOLanguageServer) compileCommandsPathReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, params *ArduinoCompileCommandsPathParams) (*ArduinoCompileCommandsPathResult, *jsonrpc.ResponseError) {
+	// The compilation database doesn't need clangd: don't wait for it
+	ls.writeLock(logger, false)
+	defer ls.writeUnlock(logger)
+
+	if ls.buildPath == nil || ls.sketchRoot == nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "build path not yet available"}
+	}
+	if params.Regenerate {
+		ls.triggerRebuildAndWait(logger, false)
+	}
+	compileCommands := ls.buildPath.Join("compile_commands.json")
+	return &ArduinoCompileCommandsPathResult{
+		Path:   compileCommands.String(),
+		Exists: compileCommands.Exist(),
+	}, nil
 }
 
 func (ls *INOLanguageServer) fullBuildCompletedFromIDE(logger jsonrpc.FunctionLogger, params *DidCompleteBuildParams) {
@@ -1217,6 +2276,46 @@ func (ls *INOLanguageServer) CopyFullBuildResults(logger jsonrpc.FunctionLogger,
 	}
 }
 
+// clangDocumentIsClosedSketchDocument returns true if the given clangd document
+// belongs to the sketch and it's no longer open in the IDE.
+func (ls *INOLanguageServer) clangDocumentIsClosedSketchDocument(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI) bool {
+	if ls.clangURIRefersToIno(clangURI) {
+		return ls.sketchTrackedFilesCount == 0
+	}
+	inside, err := clangURI.AsPath().IsInsideDir(ls.buildSketchRoot)
+	if err != nil || !inside {
+		return false
+	}
+	ideURI, err := ls.clang2IdeDocumentURI(logger, clangURI)
+	if err != nil {
+		return false
+	}
+	_, tracked := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	return !tracked
+}
+
+// maxInoVersionsHistory is the number of versions of the preprocessed sketch
+// for which the versions of the .ino files are remembered.
+const maxInoVersionsHistory = 32
+
+// recordInoVersions remembers the versions of the .ino files matching the
+// current version of the preprocessed sketch, they are used to report the
+// diagnostics of the preprocessed sketch with the versions of the .ino files.
+func (ls *INOLanguageServer) recordInoVersions() {
+	cppVersion := ls.sketchMapper.CppText.Version
+	if ls.inoVersionsByCppVersion == nil || cppVersion == 1 {
+		ls.inoVersionsByCppVersion = map[int]map[lsp.DocumentURI]int{}
+	}
+	inoVersions := map[lsp.DocumentURI]int{}
+	for _, doc := range ls.trackedIdeDocs {
+		if doc.URI.Ext() == ".ino" {
+			inoVersions[doc.URI] = doc.Version
+		}
+	}
+	ls.inoVersionsByCppVersion[cppVersion] = inoVersions
+	delete(ls.inoVersionsByCppVersion, cppVersion-maxInoVersionsHistory)
+}
+
 func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.FunctionLogger, clangParams *lsp.PublishDiagnosticsParams) {
 	if ls.config.DisableRealTimeDiagnostics {
 		logger.Logf("Ignored by configuration")
@@ -1231,6 +2330,13 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 		logger.Logf("  > %s - %s: %s", diag.Range.Start, diag.Severity, string(diag.Code))
 	}
 
+	// clangd clears the diagnostics of the documents when they are closed, but
+	// the errors are still in the sketch: keep them if requested by configuration.
+	if ls.config.KeepClosedDocsDiagnostics && len(clangParams.Diagnostics) == 0 && ls.clangDocumentIsClosedSketchDocument(logger, clangParams.URI) {
+		logger.Logf("document closed, diagnostics kept by configuration")
+		return
+	}
+
 	// the diagnostics on sketch.cpp.ino once mapped into their
 	// .ino counter parts may span over multiple .ino files...
 	allIdeParams, err := ls.clang2IdeDiagnostics(logger, clangParams)
@@ -1253,6 +2359,7 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 			}
 			allIdeParams[ideInoURI] = &lsp.PublishDiagnosticsParams{
 				URI:         ideInoURI,
+				Version:     ls.clang2IdeDocumentVersion(clangParams.URI, clangParams.Version, ideInoURI),
 				Diagnostics: []lsp.Diagnostic{},
 			}
 			delete(ls.ideInoDocsWithDiagnostics, ideInoURI)
@@ -1274,15 +2381,37 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 			case "drv_unknown_argument":
 				// Skip errors like: "Unknown argument: '-mtext-section-literals'"
 			default:
-				ideParams.Diagnostics[n] = ideDiag
-				n++
-				continue
+				if !slices.Contains(ls.config.SuppressedDiagnostics, code) {
+					ideParams.Diagnostics[n] = ideDiag
+					n++
+					continue
+				}
+				// Skip errors suppressed by configuration
 			}
 			logger.Logf("filtered out diagnostic with error-code: %s", ideDiag.Code)
 		}
 		ideParams.Diagnostics = ideParams.Diagnostics[:n]
 	}
 
+	// Keep the converted diagnostics for the arduino/diagnosticsForDocument requests
+	ls.ideDocsDiagnosticsMux.Lock()
+	if ls.ideDocsDiagnostics == nil {
+		ls.ideDocsDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{}
+	}
+	for ideURI, ideParams := range allIdeParams {
+		if len(ideParams.Diagnostics) == 0 {
+			delete(ls.ideDocsDiagnostics, ideURI)
+		} else {
+			ls.ideDocsDiagnostics[ideURI] = slices.Clone(ideParams.Diagnostics)
+		}
+	}
+	ls.ideDocsDiagnosticsMux.Unlock()
+
+	if !ls.config.pushDiagnostics() {
+		logger.Logf("diagnostics not published, the IDE will pull them")
+		return
+	}
+
 	// Push back to IDE the converted diagnostics
 	logger.Logf("diagnostics to IDE:")
 	for _, ideParams := range allIdeParams {
@@ -1297,6 +2426,29 @@ func (ls *INOLanguageServer) publishDiagnosticsNotifFromClangd(logger jsonrpc.Fu
 	}
 }
 
+// ideDocumentDiagnostics returns a copy of the last diagnostics of the given
+// IDE document, it's never nil.
+func (ls *INOLanguageServer) ideDocumentDiagnostics(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI) []lsp.Diagnostic {
+	ls.ideDocsDiagnosticsMux.Lock()
+	defer ls.ideDocsDiagnosticsMux.Unlock()
+
+	diagnostics := slices.Clone(ls.ideDocsDiagnostics[ideURI])
+	if diagnostics == nil {
+		diagnostics = []lsp.Diagnostic{}
+	}
+	logger.Logf("%s (%d diagnostics)", ideURI, len(diagnostics))
+	return diagnostics
+}
+
+func (ls *INOLanguageServer) diagnosticsForDocumentReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, params *ArduinoDiagnosticsForDocumentParams) (*lsp.PublishDiagnosticsParams, *jsonrpc.ResponseError) {
+	ideURI := params.TextDocument.URI
+	return &lsp.PublishDiagnosticsParams{URI: ideURI, Diagnostics: ls.ideDocumentDiagnostics(logger, ideURI)}, nil
+}
+
+func (ls *INOLanguageServer) textDocumentDiagnosticReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, params *DocumentDiagnosticParams) (*FullDocumentDiagnosticReport, *jsonrpc.ResponseError) {
+	return &FullDocumentDiagnosticReport{Kind: "full", Items: ls.ideDocumentDiagnostics(logger, params.TextDocument.URI)}, nil
+}
+
 func (ls *INOLanguageServer) textDocumentRenameReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, ideParams *lsp.RenameParams) (*lsp.WorkspaceEdit, *jsonrpc.ResponseError) {
 	ls.writeLock(logger, false)
 	defer ls.writeUnlock(logger)
@@ -1338,11 +2490,72 @@ func (ls *INOLanguageServer) textDocumentRenameReqFromIDE(ctx context.Context, l
 	return ideWorkspaceEdit, nil
 }
 
+// requestCancelledError returns a RequestCancelled error if the request has been
+// canceled by the IDE (for example while waiting to acquire the lock).
+func requestCancelledError(ctx context.Context) *jsonrpc.ResponseError {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesRequestCancelled, Message: "request canceled"}
+}
+
 func (ls *INOLanguageServer) ideURIIsPartOfTheSketch(ideURI lsp.DocumentURI) bool {
-	res, _ := ideURI.AsPath().IsInsideDir(ls.sketchRoot)
+	res, _ := canonicalDocumentPath(ideURI).IsInsideDir(ls.sketchRoot)
 	return res
 }
 
+// canonicalDocumentPath returns the canonical path of the given document, so it
+// can be compared with the sketch root also if the sketch is opened through a
+// symlink. The documents not yet saved on disk can't be canonicalized, in this
+// case the nearest existing parent folder is canonicalized.
+func canonicalDocumentPath(uri lsp.DocumentURI) *paths.Path {
+	docPath := uri.AsPath()
+	dir := docPath
+	missing := []string{}
+	for !dir.Exist() {
+		parent := dir.Parent()
+		if parent.String() == dir.String() {
+			return docPath
+		}
+		missing = append([]string{dir.Base()}, missing...)
+		dir = parent
+	}
+	return dir.Canonical().Join(missing...)
+}
+
+// triggerRebuildForDocument triggers a rebuild of the sketch, unless the given
+// document matches one of the RebuildIgnore patterns.
+func (ls *INOLanguageServer) triggerRebuildForDocument(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI) {
+	if len(ls.config.RebuildIgnore) > 0 && ls.ideURIIsPartOfTheSketch(ideURI) {
+		if relPath, err := ls.sketchRoot.RelTo(canonicalDocumentPath(ideURI)); err == nil && rebuildIgnoreMatch(ls.config.RebuildIgnore, relPath.String()) {
+			logger.Logf("%s matches the rebuild ignore list, rebuild skipped", relPath)
+			return
+		}
+	}
+	ls.triggerRebuild()
+}
+
+// rebuildIgnoreMatch returns true if the given path, relative to the sketch root,
+// or one of its parent folders matches one of the glob patterns. Patterns without
+// a "/" are matched against the file or folder name, as in .gitignore.
+func rebuildIgnoreMatch(patterns []string, relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		for p := relPath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if match, _ := path.Match(pattern, p); match {
+				return true
+			}
+			if !strings.Contains(pattern, "/") {
+				if match, _ := path.Match(pattern, path.Base(p)); match {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 func (ls *INOLanguageServer) progressNotifFromClangd(logger jsonrpc.FunctionLogger, progress *lsp.ProgressParams) {
 	var token string
 	if err := json.Unmarshal(progress.Token, &token); err != nil {
@@ -1374,9 +2587,56 @@ func (ls *INOLanguageServer) windowWorkDoneProgressCreateReqFromClangd(ctx conte
 	return nil
 }
 
+func (ls *INOLanguageServer) windowWorkDoneProgressCancelNotifFromIDE(logger jsonrpc.FunctionLogger, params *lsp.WorkDoneProgressCancelParams) {
+	var token string
+	if err := json.Unmarshal(params.Token, &token); err != nil {
+		logger.Logf("error decoding progress token: %s", err)
+		return
+	}
+
+	switch token {
+	case "arduinoLanguageServerInit":
+		logger.Logf("The initial build can not be canceled")
+	case "arduinoLanguageServerRebuild":
+		logger.Logf("Canceling sketch rebuild")
+		ls.sketchRebuilder.Cancel()
+	default:
+		// The progress has been created by clangd
+		ls.readLock(logger, false)
+		defer ls.readUnlock(logger)
+		if ls.Clangd == nil {
+			return
+		}
+		if err := ls.Clangd.conn.WindowWorkDoneProgressCancel(params); err != nil {
+			logger.Logf("error sending progress cancel to clangd: %s", err)
+		}
+	}
+}
+
 func (ls *INOLanguageServer) setTraceNotifFromIDE(logger jsonrpc.FunctionLogger, params *lsp.SetTraceParams) {
+	// The IDE trace level is forwarded to clangd, it doesn't change the
+	// verbosity of the log files (see arduino/setLogLevel)
 	logger.Logf("Notification level set to: %s", params.Value)
-	ls.Clangd.conn.SetTrace(params)
+	ls.clangdTraceValue.Store(params.Value)
+
+	ls.readLock(logger, false)
+	defer ls.readUnlock(logger)
+	if ls.Clangd == nil {
+		// clangd is not running: the level is applied when it's started
+		return
+	}
+	if err := ls.Clangd.conn.SetTrace(params); err != nil {
+		logger.Logf("Error sending setTrace to clangd: %s", err)
+	}
+}
+
+func (ls *INOLanguageServer) setLogLevelReqFromIDE(ctx context.Context, logger jsonrpc.FunctionLogger, params *ArduinoSetLogLevelParams) (*ArduinoSetLogLevelResult, *jsonrpc.ResponseError) {
+	previous := GetTraceLevel()
+	if err := SetTraceLevel(params.Level); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	logger.Logf("Log level changed: %s -> %s", previous, params.Level)
+	return &ArduinoSetLogLevelResult{Level: params.Level, PreviousLevel: previous}, nil
 }
 
 func (ls *INOLanguageServer) removeTemporaryFiles(logger jsonrpc.FunctionLogger) {
@@ -1388,27 +2648,67 @@ func (ls *INOLanguageServer) removeTemporaryFiles(logger jsonrpc.FunctionLogger)
 		return
 	}
 
+	if ls.config.KeepTempFiles {
+		logger.Logf("Keeping temporary files in %s", ls.tempDir)
+		log.Printf("Temporary build files kept in %s", ls.tempDir)
+		ls.buildPath, ls.fullBuildPath, ls.buildSketchRoot, ls.tempDir = nil, nil, nil, nil
+		return
+	}
+
 	// Start a detached process to remove the temp files
+	tempDir := ls.tempDir
+	ls.buildPath, ls.fullBuildPath, ls.buildSketchRoot, ls.tempDir = nil, nil, nil, nil
+	if err := startRemoveTempFilesProcess(logger, tempDir); err != nil {
+		logger.Logf("Error starting remove-temp-files process: %s", err)
+		logger.Logf("Removing temp files in-process")
+		if err := RemoveTemporaryFolder(tempDir.String()); err != nil {
+			logger.Logf("Error removing temp files: %s", err)
+		}
+	}
+}
+
+// startRemoveTempFilesProcess runs a detached copy of the language server
+// executable that removes the given folder, so the cleanup can complete after
+// this process exits.
+func startRemoveTempFilesProcess(logger jsonrpc.FunctionLogger, tempDir *paths.Path) error {
+	// os.Args[0] may be a relative path or a shim that is no longer valid, use
+	// the resolved path of the running executable instead.
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("getting language server executable: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+	if !paths.New(executable).Exist() {
+		return fmt.Errorf("language server executable not found: %s", executable)
+	}
+
 	cwd, err := os.Getwd()
 	if err != nil {
-		logger.Logf("Error getting current working directory: %s", err)
-		return
+		return fmt.Errorf("getting current working directory: %w", err)
 	}
-	cmd := exec.Command(os.Args[0], "remove-temp-files", ls.tempDir.String())
+	cmd := exec.Command(executable, "remove-temp-files", tempDir.String())
 	cmd.Dir = cwd
 	if err := cmd.Start(); err != nil {
-		logger.Logf("Error starting remove-temp-files process: %s", err)
-		return
+		return err
 	}
 
-	// The process is now started, we can reset the paths
-	ls.buildPath, ls.fullBuildPath, ls.buildSketchRoot, ls.tempDir = nil, nil, nil, nil
-
 	// Detach the process so it can continue running even if the parent process exits
 	if err := cmd.Process.Release(); err != nil {
 		logger.Logf("Error detaching remove-temp-files process: %s", err)
-		return
 	}
+	return nil
+}
+
+// RemoveTemporaryFolder removes a temporary folder created by the language
+// server. As a safety measure, folders that do not belong to the language
+// server are refused.
+func RemoveTemporaryFolder(tmpFile string) error {
+	if !strings.Contains(tmpFile, "arduino-language-server") {
+		return fmt.Errorf("could not remove extraneous temp folder: %s", tmpFile)
+	}
+	return paths.New(tmpFile).RemoveAll()
 }
 
 // Close closes all the json-rpc connections and clean-up temp folders.
@@ -1417,6 +2717,12 @@ func (ls *INOLanguageServer) Close() {
 		ls.Clangd.Close()
 		ls.Clangd = nil
 	}
+	ls.cliDaemonMux.Lock()
+	if ls.cliDaemonConn != nil {
+		_ = ls.cliDaemonConn.Close()
+		ls.cliDaemonConn = nil
+	}
+	ls.cliDaemonMux.Unlock()
 	if ls.closing != nil {
 		close(ls.closing)
 		ls.closing = nil
@@ -1431,49 +2737,27 @@ func (ls *INOLanguageServer) CloseNotify() <-chan bool {
 func (ls *INOLanguageServer) extractDataFolderFromArduinoCLI(logger jsonrpc.FunctionLogger) (*paths.Path, error) {
 	var dataDir string
 	if ls.config.CliPath == nil {
-		// Establish a connection with the arduino-cli gRPC server
-		conn, err := grpc.Dial(
-			ls.config.CliDaemonAddress,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock())
-		if err != nil {
-			return nil, fmt.Errorf("error connecting to arduino-cli rpc server: %w", err)
-		}
-		defer conn.Close()
-		client := rpc.NewArduinoCoreServiceClient(conn)
-
-		resp, err := client.SettingsGetValue(context.Background(), &rpc.SettingsGetValueRequest{
-			Key: "directories.data",
+		err := ls.callCliDaemon(context.Background(), logger, func(client rpc.ArduinoCoreServiceClient) error {
+			resp, err := client.SettingsGetValue(context.Background(), &rpc.SettingsGetValueRequest{
+				Key: "directories.data",
+			})
+			if err != nil {
+				return fmt.Errorf("error getting arduino data dir: %w", err)
+			}
+			if err := json.Unmarshal([]byte(resp.GetEncodedValue()), &dataDir); err != nil {
+				return fmt.Errorf("error getting arduino data dir: %w", err)
+			}
+			return nil
 		})
 		if err != nil {
-			return nil, fmt.Errorf("error getting arduino data dir: %w", err)
-		}
-		if err := json.Unmarshal([]byte(resp.GetEncodedValue()), &dataDir); err != nil {
-			return nil, fmt.Errorf("error getting arduino data dir: %w", err)
+			return nil, err
 		}
 		logger.Logf("Arduino Data Dir -> %s", dataDir)
 	} else {
-		args := []string{
-			"--config-file", ls.config.CliConfigPath.String(),
-			"config", "get", "directories.data",
-			"--json",
-		}
-		cmd, err := paths.NewProcessFromPath(nil, ls.config.CliPath, args...)
+		res, err := ls.dataFolderFromArduinoCLIProcess(logger)
 		if err != nil {
-			return nil, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
-		}
-		cmdOutput := &bytes.Buffer{}
-		cmd.RedirectStdoutTo(cmdOutput)
-		logger.Logf("running: %s", strings.Join(args, " "))
-		if err := cmd.Run(); err != nil {
-			return nil, errors.Errorf("running %s: %s", strings.Join(args, " "), err)
+			return nil, err
 		}
-
-		var res string
-		if err := json.Unmarshal(cmdOutput.Bytes(), &res); err != nil {
-			return nil, errors.Errorf("parsing arduino-cli output: %s", err)
-		}
-		// Return only the build path
 		logger.Logf("Arduino Data Dir -> %s", res)
 		dataDir = res
 	}
@@ -1486,7 +2770,6 @@ func (ls *INOLanguageServer) clang2IdeCodeAction(logger jsonrpc.FunctionLogger,
 	ideCodeAction := &lsp.CodeAction{
 		Title:       clangCodeAction.Title,
 		Kind:        clangCodeAction.Kind,
-		Diagnostics: clangCodeAction.Diagnostics,
 		IsPreferred: clangCodeAction.IsPreferred,
 		Disabled:    clangCodeAction.Disabled,
 		Edit:        ls.cpp2inoWorkspaceEdit(logger, clangCodeAction.Edit),
@@ -1498,9 +2781,27 @@ func (ls *INOLanguageServer) clang2IdeCodeAction(logger jsonrpc.FunctionLogger,
 		}
 		ideCodeAction.Command = inoCommand
 	}
-	if origIdeURI.Ext() == ".ino" {
-		for i, diag := range ideCodeAction.Diagnostics {
-			_, ideCodeAction.Diagnostics[i].Range = ls.sketchMapper.CppToInoRange(diag.Range)
+	if len(clangCodeAction.Diagnostics) > 0 {
+		// The diagnostics fixed by the code action (for example clang-tidy fix-its)
+		// are relative to the clang document: convert them back or drop them if
+		// they are in the preprocessed section of the sketch.
+		clangURI, _, err := ls.ide2ClangDocumentURI(logger, origIdeURI)
+		if err != nil {
+			logger.Logf("Error converting code action diagnostics: %s", err)
+			return nil
+		}
+		ideCodeAction.Diagnostics = []lsp.Diagnostic{}
+		for _, clangDiagnostic := range clangCodeAction.Diagnostics {
+			_, ideDiagnostic, inPreprocessed, err := ls.clang2IdeDiagnostic(logger, clangURI, clangDiagnostic)
+			if err != nil {
+				logger.Logf("Error converting code action diagnostic: %s", err)
+				continue
+			}
+			if inPreprocessed {
+				logger.Logf("    ignored in-preprocessed-section diagnostic")
+				continue
+			}
+			ideCodeAction.Diagnostics = append(ideCodeAction.Diagnostics, ideDiagnostic)
 		}
 	}
 	return ideCodeAction
@@ -1591,7 +2892,7 @@ func (ls *INOLanguageServer) cpp2inoWorkspaceEdit(logger jsonrpc.FunctionLogger,
 func (ls *INOLanguageServer) cpp2inoTextEdit(logger jsonrpc.FunctionLogger, cppURI lsp.DocumentURI, cppEdit lsp.TextEdit) (lsp.DocumentURI, lsp.TextEdit, bool, error) {
 	inoURI, inoRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, cppURI, cppEdit.Range)
 
-	if err != nil {
+	if err != nil || inPreprocessed || inoURI == sourcemapper.NotInoURI {
 		if strings.HasPrefix(cppEdit.NewText, "\n") && cppEdit.Range.Start.Line < cppEdit.Range.End.Line {
 			// Special case: the text-edit may start from the very end of a not-ino section and fallthrough
 			// in the .ino section with a '\n...' at the beginning of the replacement text.
@@ -1611,9 +2912,45 @@ func (ls *INOLanguageServer) cpp2inoTextEdit(logger jsonrpc.FunctionLogger, cppU
 
 	inoEdit := cppEdit
 	inoEdit.Range = inoRange
+	if ls.clangURIRefersToIno(cppURI) {
+		if err != nil && cppLineIsOutsideIno(ls.sketchMapper, cppEdit.Range.Start.Line) {
+			// The edit starts in the preprocessed section and can't be moved
+			// into the .ino section: report it as preprocessed.
+			logger.Logf("Text edit starts in the preprocessed section: %s", cppEdit.Range)
+			return inoURI, inoEdit, true, nil
+		}
+		if err == nil && !inPreprocessed && cppRangeOverlapsPreprocessedLines(ls.sketchMapper, cppEdit.Range) {
+			// Applying the edit to the .ino would replace only a part of the
+			// text that it replaces in the .cpp, corrupting the sketch.
+			logger.Logf("Text edit overlaps the preprocessed section: %s", cppEdit.Range)
+			return inoURI, inoEdit, true, nil
+		}
+	}
 	return inoURI, inoEdit, inPreprocessed, err
 }
 
+// cppRangeOverlapsPreprocessedLines returns true if any of the lines after the
+// start of the range is not part of an .ino (the range may end at the beginning
+// of such a line).
+func cppRangeOverlapsPreprocessedLines(mapper *sourcemapper.SketchMapper, cppRange lsp.Range) bool {
+	for line := cppRange.Start.Line + 1; line <= cppRange.End.Line; line++ {
+		if line == cppRange.End.Line && cppRange.End.Character == 0 {
+			break
+		}
+		if cppLineIsOutsideIno(mapper, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// cppLineIsOutsideIno returns true if the given .cpp line has been added by the
+// preprocessor (prototypes, #line directives, ...).
+func cppLineIsOutsideIno(mapper *sourcemapper.SketchMapper, cppLine int) bool {
+	inoFile, _, ok := mapper.CppToInoLineOk(cppLine)
+	return !ok || inoFile == sourcemapper.NotIno.File || mapper.IsPreprocessedCppLine(cppLine)
+}
+
 // UnknownURIError is an error when an URI is not recognized
 type UnknownURIError struct {
 	URI lsp.DocumentURI
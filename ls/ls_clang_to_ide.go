@@ -68,9 +68,9 @@ func (ls *INOLanguageServer) clang2IdeRangeAndDocumentURI(logger jsonrpc.Functio
 		return lsp.NilURI, lsp.NilRange, false, err
 	}
 	if !inside {
-		ideURI := clangURI
+		ideURI := ls.clang2IdeExternalDocumentURI(clangURI)
 		logger.Logf("Range: %s:%s -> %s:%s (ext file)", clangURI, clangRange, ideURI, ideRange)
-		return clangURI, clangRange, false, nil
+		return ideURI, clangRange, false, nil
 	}
 
 	// Sketchbook/Sketch/AnotherFile.cpp <-> build-path/sketch/AnotherFile.cpp (one line offset)
@@ -91,6 +91,19 @@ func (ls *INOLanguageServer) clang2IdeRangeAndDocumentURI(logger jsonrpc.Functio
 	return ideURI, ideRange, false, err
 }
 
+// clang2IdeExternalDocumentURI converts the URI of a file outside the sketch, like
+// the headers and the sources of the Arduino core. clangd refers to them with the
+// paths of the compile_commands.json, that may go through symlinks or contain "..":
+// the canonical path is returned, unless the file is already open in the IDE.
+func (ls *INOLanguageServer) clang2IdeExternalDocumentURI(clangURI lsp.DocumentURI) lsp.DocumentURI {
+	// AsPath already follows the symlinks
+	clangPath := clangURI.AsPath().Clean()
+	if doc, tracked := ls.trackedIdeDocs[clangPath.String()]; tracked {
+		return doc.URI
+	}
+	return lsp.NewDocumentURIFromPath(clangPath.Canonical())
+}
+
 func (ls *INOLanguageServer) clang2IdeDocumentURI(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI) (lsp.DocumentURI, error) {
 	// Sketchbook/Sketch/Sketch.ino      <-> build-path/sketch/Sketch.ino.cpp
 	// Sketchbook/Sketch/AnotherTab.ino  <-> build-path/sketch/Sketch.ino.cpp  (different section from above)
@@ -141,6 +154,20 @@ func (ls *INOLanguageServer) clang2IdeDocumentHighlight(logger jsonrpc.FunctionL
 	}, false, nil
 }
 
+// clang2IdeDocumentVersion returns the version of the IDE document ideURI matching
+// the version clangVersion of the clangd document clangURI, or 0 if it's unknown.
+func (ls *INOLanguageServer) clang2IdeDocumentVersion(clangURI lsp.DocumentURI, clangVersion int, ideURI lsp.DocumentURI) int {
+	if clangVersion == 0 {
+		return 0
+	}
+	if !ls.clangURIRefersToIno(clangURI) {
+		// The other documents are sent to clangd with the same version used by the IDE
+		return clangVersion
+	}
+	// The preprocessed sketch has its own versioning, see recordInoVersions
+	return ls.inoVersionsByCppVersion[clangVersion][ideURI]
+}
+
 func (ls *INOLanguageServer) clang2IdeDiagnostics(logger jsonrpc.FunctionLogger, clangDiagsParams *lsp.PublishDiagnosticsParams) (map[lsp.DocumentURI]*lsp.PublishDiagnosticsParams, error) {
 	// If diagnostics comes from sketch.ino.cpp they may refer to multiple .ino files,
 	// so we collect all of the into a map.
@@ -154,7 +181,7 @@ func (ls *INOLanguageServer) clang2IdeDiagnostics(logger jsonrpc.FunctionLogger,
 		}
 		allIdeDiagsParams[ideURI] = &lsp.PublishDiagnosticsParams{
 			URI:         ideURI,
-			Version:     clangDiagsParams.Version,
+			Version:     ls.clang2IdeDocumentVersion(clangDiagsParams.URI, clangDiagsParams.Version, ideURI),
 			Diagnostics: []lsp.Diagnostic{},
 		}
 		return allIdeDiagsParams, nil
@@ -170,7 +197,10 @@ func (ls *INOLanguageServer) clang2IdeDiagnostics(logger jsonrpc.FunctionLogger,
 			continue
 		}
 		if _, ok := allIdeDiagsParams[ideURI]; !ok {
-			allIdeDiagsParams[ideURI] = &lsp.PublishDiagnosticsParams{URI: ideURI}
+			allIdeDiagsParams[ideURI] = &lsp.PublishDiagnosticsParams{
+				URI:     ideURI,
+				Version: ls.clang2IdeDocumentVersion(clangDiagsParams.URI, clangDiagsParams.Version, ideURI),
+			}
 		}
 		allIdeDiagsParams[ideURI].Diagnostics = append(allIdeDiagsParams[ideURI].Diagnostics, ideDiagnostic)
 	}
@@ -184,6 +214,8 @@ func (ls *INOLanguageServer) clang2IdeDiagnostic(logger jsonrpc.FunctionLogger,
 		return lsp.DocumentURI{}, lsp.Diagnostic{}, inPreproccesed, err
 	}
 
+	// All the fields not referring to a location, like the CodeDescription with
+	// the link to the clang-tidy documentation, are copied as they are
 	ideDiagnostic := clangDiagnostic
 	ideDiagnostic.Range = ideRange
 
@@ -225,6 +257,7 @@ func (ls *INOLanguageServer) clang2IdeDocumentSymbols(logger jsonrpc.FunctionLog
 		ideURI, ideRange, isPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangURI, clangSymbol.Range)
 		if err != nil {
 			logger.Logf("    filtering out invalid symbol range: %s", err)
+			ideSymbols = append(ideSymbols, ls.clang2IdeHoistedDocumentSymbols(logger, clangSymbol, clangURI, origIdeURI)...)
 			continue
 		}
 		if isPreprocessed {
@@ -233,6 +266,7 @@ func (ls *INOLanguageServer) clang2IdeDocumentSymbols(logger jsonrpc.FunctionLog
 		}
 		if ideURI != origIdeURI {
 			logger.Logf("    filtering out symbol related to %s", ideURI)
+			ideSymbols = append(ideSymbols, ls.clang2IdeHoistedDocumentSymbols(logger, clangSymbol, clangURI, origIdeURI)...)
 			continue
 		}
 		ideSelectionURI, ideSelectionRange, isSelectionPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangURI, clangSymbol.SelectionRange)
@@ -268,6 +302,25 @@ func (ls *INOLanguageServer) clang2IdeDocumentSymbols(logger jsonrpc.FunctionLog
 	return ideSymbols, nil
 }
 
+// clang2IdeHoistedDocumentSymbols converts the children of a symbol that has been
+// filtered out because it doesn't belong to origIdeURI. In the sketch.ino.cpp a
+// class may span more than one tab: in this case the children belonging to
+// origIdeURI are returned, so they can be moved up one level in place of their parent.
+func (ls *INOLanguageServer) clang2IdeHoistedDocumentSymbols(logger jsonrpc.FunctionLogger, clangSymbol lsp.DocumentSymbol, clangURI lsp.DocumentURI, origIdeURI lsp.DocumentURI) []lsp.DocumentSymbol {
+	if len(clangSymbol.Children) == 0 {
+		return nil
+	}
+	ideChildren, err := ls.clang2IdeDocumentSymbols(logger, clangSymbol.Children, clangURI, origIdeURI)
+	if err != nil {
+		logger.Logf("    filtering out invalid document-symbol children: %s", err)
+		return nil
+	}
+	if len(ideChildren) > 0 {
+		logger.Logf("    keeping %d children of %s belonging to %s", len(ideChildren), clangSymbol.Name, origIdeURI)
+	}
+	return ideChildren
+}
+
 func (ls *INOLanguageServer) cland2IdeTextEdits(logger jsonrpc.FunctionLogger, clangURI lsp.DocumentURI, clangTextEdits []lsp.TextEdit) (map[lsp.DocumentURI][]lsp.TextEdit, error) {
 	logger.Logf("%s clang/textEdit (%d elements)", clangURI, len(clangTextEdits))
 	allIdeTextEdits := map[lsp.DocumentURI][]lsp.TextEdit{}
@@ -312,6 +365,38 @@ func (ls *INOLanguageServer) clang2IdeLocationsArray(logger jsonrpc.FunctionLogg
 	return ideLocations, nil
 }
 
+func (ls *INOLanguageServer) clang2IdeLocationLinksArray(logger jsonrpc.FunctionLogger, clangOriginURI lsp.DocumentURI, clangLocationLinks []lsp.LocationLink) ([]lsp.LocationLink, error) {
+	ideLocationLinks := []lsp.LocationLink{}
+	for _, clangLocationLink := range clangLocationLinks {
+		ideTargetURI, ideTargetRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangLocationLink.TargetUri, clangLocationLink.TargetRange)
+		if err != nil {
+			logger.Logf("ERROR converting location link %s: %s", clangLocationLink.TargetUri, err)
+			return nil, err
+		}
+		if inPreprocessed {
+			logger.Logf("ignored in-preprocessed-section location link")
+			continue
+		}
+		_, ideTargetSelectionRange, _, err := ls.clang2IdeRangeAndDocumentURI(logger, clangLocationLink.TargetUri, clangLocationLink.TargetSelectionRange)
+		if err != nil {
+			logger.Logf("ERROR converting location link %s: %s", clangLocationLink.TargetUri, err)
+			return nil, err
+		}
+		ideLocationLink := lsp.LocationLink{
+			TargetUri:            ideTargetURI,
+			TargetRange:          ideTargetRange,
+			TargetSelectionRange: ideTargetSelectionRange,
+		}
+		if clangLocationLink.OriginSelectionRange != nil {
+			if _, ideOriginRange, _, err := ls.clang2IdeRangeAndDocumentURI(logger, clangOriginURI, *clangLocationLink.OriginSelectionRange); err == nil {
+				ideLocationLink.OriginSelectionRange = &ideOriginRange
+			}
+		}
+		ideLocationLinks = append(ideLocationLinks, ideLocationLink)
+	}
+	return ideLocationLinks, nil
+}
+
 func (ls *INOLanguageServer) clang2IdeLocation(logger jsonrpc.FunctionLogger, clangLocation lsp.Location) (lsp.Location, bool, error) {
 	ideURI, ideRange, inPreprocessed, err := ls.clang2IdeRangeAndDocumentURI(logger, clangLocation.URI, clangLocation.Range)
 	return lsp.Location{
@@ -321,10 +406,18 @@ func (ls *INOLanguageServer) clang2IdeLocation(logger jsonrpc.FunctionLogger, cl
 }
 
 func (ls *INOLanguageServer) clang2IdeSymbolTags(logger jsonrpc.FunctionLogger, clangSymbolTags []lsp.SymbolTag) []lsp.SymbolTag {
-	if len(clangSymbolTags) == 0 || clangSymbolTags == nil {
+	if len(clangSymbolTags) == 0 {
 		return clangSymbolTags
 	}
-	panic("not implemented")
+	ideSymbolTags := []lsp.SymbolTag{}
+	for _, tag := range clangSymbolTags {
+		if tag != lsp.SymbolTagDeprecated {
+			logger.Logf("    filtering out unknown symbol tag: %d", tag)
+			continue
+		}
+		ideSymbolTags = append(ideSymbolTags, tag)
+	}
+	return ideSymbolTags
 }
 
 func (ls *INOLanguageServer) clang2IdeSymbolsInformation(logger jsonrpc.FunctionLogger, clangSymbolsInformation []lsp.SymbolInformation) []lsp.SymbolInformation {
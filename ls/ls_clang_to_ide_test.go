@@ -0,0 +1,210 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/stretchr/testify/require"
+	"go.bug.st/json"
+	"go.bug.st/lsp"
+)
+
+func TestDiagnosticTagsAndDataRoundTrip(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	logger := testLogger()
+
+	clangDiagnostic := lsp.Diagnostic{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: 10, Character: 6},
+			End:   lsp.Position{Line: 10, Character: 12},
+		},
+		Severity: lsp.DiagnosticSeverityHint,
+		Source:   "clangd",
+		Message:  "unused variable 'unused'",
+		Tags:     []lsp.DiagnosticTag{lsp.DiagnosticTagUnnecessary, lsp.DiagnosticTagDeprecated},
+		Data:     json.RawMessage(`{"fixes":1}`),
+	}
+
+	ideURI, ideDiagnostic, inPreprocessed, err := ls.clang2IdeDiagnostic(logger, cppURI, clangDiagnostic)
+	require.NoError(t, err)
+	require.False(t, inPreprocessed)
+	require.Equal(t, inoURI, ideURI)
+	require.Equal(t, lsp.Range{
+		Start: lsp.Position{Line: 2, Character: 6},
+		End:   lsp.Position{Line: 2, Character: 12},
+	}, ideDiagnostic.Range)
+	require.Equal(t, clangDiagnostic.Tags, ideDiagnostic.Tags)
+	require.Equal(t, clangDiagnostic.Data, ideDiagnostic.Data)
+
+	backURI, backDiagnostic, err := ls.ide2ClangDiagnostic(logger, ideURI, ideDiagnostic)
+	require.NoError(t, err)
+	require.Equal(t, cppURI, backURI)
+	require.Equal(t, clangDiagnostic.Range, backDiagnostic.Range)
+	require.Equal(t, clangDiagnostic.Tags, backDiagnostic.Tags)
+	require.Equal(t, clangDiagnostic.Data, backDiagnostic.Data)
+}
+
+func TestDiagnosticCodeDescription(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	var clangDiag lsp.Diagnostic
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"range": {"start": {"line": 10, "character": 6}, "end": {"line": 10, "character": 12}},
+		"severity": 2,
+		"code": "misc-unused-parameters",
+		"codeDescription": {"href": "https://clang.llvm.org/extra/clang-tidy/checks/misc/unused-parameters.html"},
+		"source": "clang-tidy",
+		"message": "parameter 'x' is unused"
+	}`), &clangDiag))
+
+	ideURI, ideDiag, inPreprocessed, err := ls.clang2IdeDiagnostic(testLogger(), cppURI, clangDiag)
+	require.NoError(t, err)
+	require.False(t, inPreprocessed)
+	require.Equal(t, inoURI, ideURI)
+	require.NotNil(t, ideDiag.CodeDescription)
+	require.Equal(t, lsp.URI("https://clang.llvm.org/extra/clang-tidy/checks/misc/unused-parameters.html"), ideDiag.CodeDescription.Href)
+	data, err := json.Marshal(ideDiag)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"codeDescription":{"href":"https://clang.llvm.org/extra/clang-tidy/checks/misc/unused-parameters.html"}`)
+
+	// The link is kept when the diagnostic is sent back to clangd (in code actions)
+	_, backToClang, err := ls.ide2ClangDiagnostic(testLogger(), ideURI, ideDiag)
+	require.NoError(t, err)
+	require.Equal(t, clangDiag.CodeDescription, backToClang.CodeDescription)
+}
+
+func TestDeprecatedDocumentSymbol(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+
+	// [[deprecated]] void setup() { ... }
+	clangSymbols := []lsp.DocumentSymbol{{
+		Name: "setup",
+		Kind: lsp.SymbolKindFunction,
+		Range: lsp.Range{
+			Start: lsp.Position{Line: 9, Character: 0},
+			End:   lsp.Position{Line: 11, Character: 1},
+		},
+		SelectionRange: lsp.Range{
+			Start: lsp.Position{Line: 9, Character: 5},
+			End:   lsp.Position{Line: 9, Character: 10},
+		},
+		Tags: []lsp.SymbolTag{lsp.SymbolTagDeprecated},
+	}}
+	ideSymbols, err := ls.clang2IdeDocumentSymbols(testLogger(), clangSymbols, cppURI, inoURI)
+	require.NoError(t, err)
+	require.Len(t, ideSymbols, 1)
+	require.Equal(t, "setup", ideSymbols[0].Name)
+	require.Equal(t, 1, ideSymbols[0].Range.Start.Line)
+	require.Equal(t, []lsp.SymbolTag{lsp.SymbolTagDeprecated}, ideSymbols[0].Tags)
+}
+
+func TestDocumentSymbolsOfClassSpanningTabs(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+
+	// Add a second tab to the sketch, continuing a class opened in Sketch.ino
+	tab := ls.sketchRoot.Join("Tab.ino")
+	tabText := "  void tabMethod() {\n  }\n};\n"
+	require.NoError(t, tab.WriteFile([]byte(tabText)))
+	tabURI := lsp.NewDocumentURIFromPath(tab)
+	ls.trackedIdeDocs[tab.String()] = lsp.TextDocumentItem{URI: tabURI, LanguageID: "cpp", Version: 1, Text: tabText}
+	cppText, err := ls.buildSketchCpp.ReadFile()
+	require.NoError(t, err)
+	cppText = append(cppText, []byte("#line 1 "+strconv.Quote(tab.String())+"\n"+tabText)...)
+	require.NoError(t, ls.buildSketchCpp.WriteFile(cppText))
+	ls.sketchMapper = sourcemapper.CreateInoMapper(cppText)
+
+	symbolAt := func(name string, kind lsp.SymbolKind, startLine, endLine int, children ...lsp.DocumentSymbol) lsp.DocumentSymbol {
+		return lsp.DocumentSymbol{
+			Name: name,
+			Kind: kind,
+			Range: lsp.Range{
+				Start: lsp.Position{Line: startLine, Character: 0},
+				End:   lsp.Position{Line: endLine, Character: 1},
+			},
+			SelectionRange: lsp.Range{
+				Start: lsp.Position{Line: startLine, Character: 2},
+				End:   lsp.Position{Line: startLine, Character: 6},
+			},
+			Children: children,
+		}
+	}
+	// class Blinker {           <- Sketch.ino
+	//   void loop() { }         <- Sketch.ino
+	//   void tabMethod() { }    <- Tab.ino
+	// };                        <- Tab.ino
+	clangSymbols := []lsp.DocumentSymbol{
+		symbolAt("Blinker", lsp.SymbolKindClass, 13, 18,
+			symbolAt("loop", lsp.SymbolKindMethod, 13, 14),
+			symbolAt("tabMethod", lsp.SymbolKindMethod, 16, 17),
+		),
+	}
+
+	// The method defined in the secondary tab is reported even if the class
+	// is not part of it
+	tabSymbols, err := ls.clang2IdeDocumentSymbols(testLogger(), clangSymbols, cppURI, tabURI)
+	require.NoError(t, err)
+	require.Len(t, tabSymbols, 1)
+	require.Equal(t, "tabMethod", tabSymbols[0].Name)
+	require.Equal(t, 0, tabSymbols[0].Range.Start.Line)
+	require.Equal(t, 1, tabSymbols[0].Range.End.Line)
+
+	// In the main tab only the members belonging to it are reported
+	inoSymbols, err := ls.clang2IdeDocumentSymbols(testLogger(), clangSymbols, cppURI, inoURI)
+	require.NoError(t, err)
+	names := []string{}
+	var collect func(symbols []lsp.DocumentSymbol)
+	collect = func(symbols []lsp.DocumentSymbol) {
+		for _, symbol := range symbols {
+			names = append(names, symbol.Name)
+			collect(symbol.Children)
+		}
+	}
+	collect(inoSymbols)
+	require.Contains(t, names, "loop")
+	require.NotContains(t, names, "tabMethod")
+}
+
+func TestLocationsInUntrackedSketchFiles(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	helperText := []byte("int helper() {\n  return 1;\n}\n")
+	require.NoError(t, ls.sketchRoot.Join("helper.cpp").WriteFile(helperText))
+	require.NoError(t, ls.buildSketchRoot.Join("helper.cpp").WriteFile(append([]byte("#include <Arduino.h>\n"), helperText...)))
+
+	// helper.cpp has not been opened in the IDE
+	ideLocations, err := ls.clang2IdeLocationsArray(testLogger(), []lsp.Location{{
+		URI: lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("helper.cpp")),
+		Range: lsp.Range{
+			Start: lsp.Position{Line: 1, Character: 4},
+			End:   lsp.Position{Line: 1, Character: 10},
+		},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []lsp.Location{{
+		URI: lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("helper.cpp")),
+		Range: lsp.Range{
+			Start: lsp.Position{Line: 0, Character: 4},
+			End:   lsp.Position{Line: 0, Character: 10},
+		},
+	}}, ideLocations)
+
+	// files that do not exist are still reported as unknown
+	_, err = ls.clang2IdeLocationsArray(testLogger(), []lsp.Location{{
+		URI: lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("missing.cpp")),
+	}})
+	require.Error(t, err)
+}
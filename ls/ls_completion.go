@@ -0,0 +1,223 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"regexp"
+	"strings"
+
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+// isHiddenCompletionItem returns true if the completion item must not be shown to
+// the user. Identifiers starting with an underscore are hidden only if requested
+// in the configuration, since many valid macros (like _BV) start with underscore.
+func (ls *INOLanguageServer) isHiddenCompletionItem(item lsp.CompletionItem) bool {
+	return ls.config.HideUnderscoreCompletions && strings.HasPrefix(item.InsertText, "_")
+}
+
+// completionIncludesContext returns the text of the IDE documents whose
+// #include directives are visible from the given document: all the .ino tabs
+// of the sketch are merged in the same preprocessed sketch, so the includes of
+// the other tracked tabs count too.
+func (ls *INOLanguageServer) completionIncludesContext(ideDoc lsp.TextDocumentItem) string {
+	if ideDoc.URI.Ext() != ".ino" {
+		return ideDoc.Text
+	}
+	texts := []string{ideDoc.Text}
+	for _, doc := range ls.trackedIdeDocs {
+		if doc.URI.Ext() == ".ino" && doc.URI != ideDoc.URI && ls.ideURIIsPartOfTheSketch(doc.URI) {
+			texts = append(texts, doc.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+var includeDirectiveRegexp = regexp.MustCompile(`^\s*#\s*include\s*([<"][^>"]+[>"])`)
+
+// includedHeaders returns the set of headers included by the given source text,
+// in the form `<header.h>` or `"header.h"`.
+func includedHeaders(text string) map[string]bool {
+	res := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		if m := includeDirectiveRegexp.FindStringSubmatch(line); m != nil {
+			res[m[1]] = true
+		}
+	}
+	return res
+}
+
+// removeDuplicatedIncludeEdits removes, from the AdditionalTextEdits of the given
+// completion items, the edits that would only add #include directives already
+// present in ideText (or already added by another edit of the same item). The
+// order of the remaining edits is preserved.
+func removeDuplicatedIncludeEdits(ideText string, items []lsp.CompletionItem) {
+	present := includedHeaders(ideText)
+	for i, item := range items {
+		if len(item.AdditionalTextEdits) == 0 {
+			continue
+		}
+		added := map[string]bool{}
+		edits := []lsp.TextEdit{}
+		for _, edit := range item.AdditionalTextEdits {
+			duplicated := true
+			headers := []string{}
+			for _, line := range strings.Split(edit.NewText, "\n") {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				m := includeDirectiveRegexp.FindStringSubmatch(line)
+				if m == nil || (!present[m[1]] && !added[m[1]]) {
+					duplicated = false
+				}
+				if m != nil {
+					headers = append(headers, m[1])
+				}
+			}
+			if duplicated && len(headers) > 0 {
+				continue
+			}
+			for _, header := range headers {
+				added[header] = true
+			}
+			edits = append(edits, edit)
+		}
+		items[i].AdditionalTextEdits = edits
+	}
+}
+
+// clientSupportsSnippets returns true if the IDE advertised the support for
+// snippets in the completion items during initialization.
+func clientSupportsSnippets(ideParams *lsp.InitializeParams) bool {
+	textDocument := ideParams.Capabilities.TextDocument
+	if textDocument == nil || textDocument.Completion == nil || textDocument.Completion.CompletionItem == nil {
+		return false
+	}
+	return textDocument.Completion.CompletionItem.SnippetSupport
+}
+
+// snippetsEnabled returns true if the completion items may be sent to the IDE
+// as snippets.
+func (ls *INOLanguageServer) snippetsEnabled() bool {
+	return ls.ideSnippetSupport && !ls.config.DisableSnippets
+}
+
+// snippetToPlainText converts a snippet in the text that clangd would insert
+// without snippets support: the text is cut at the first tab stop or
+// placeholder, together with the parenthesis or angle bracket opening the
+// arguments list (for example `digitalWrite(${1:uint8_t pin}, ${2:uint8_t val})`
+// becomes `digitalWrite`).
+func snippetToPlainText(snippet string) string {
+	var res strings.Builder
+	for i := 0; i < len(snippet); i++ {
+		c := snippet[i]
+		if c == '\\' && i+1 < len(snippet) && strings.IndexByte(`$}\`, snippet[i+1]) != -1 {
+			i++
+			res.WriteByte(snippet[i])
+			continue
+		}
+		if c == '$' && i+1 < len(snippet) && (snippet[i+1] == '{' || (snippet[i+1] >= '0' && snippet[i+1] <= '9')) {
+			return strings.TrimRight(res.String(), "(<")
+		}
+		res.WriteByte(c)
+	}
+	return res.String()
+}
+
+// convertSnippetToPlainText changes the given snippet completion item in a
+// plain text one.
+func convertSnippetToPlainText(item *lsp.CompletionItem) {
+	if item.InsertTextFormat != lsp.InsertTextFormatSnippet {
+		return
+	}
+	item.InsertText = snippetToPlainText(item.InsertText)
+	if item.TextEdit != nil {
+		item.TextEdit.NewText = snippetToPlainText(item.TextEdit.NewText)
+	}
+	item.InsertTextFormat = lsp.InsertTextFormatPlainText
+}
+
+// isIncludeInsertion returns true if the text edit only inserts #include
+// directives (like the ones added by clangd's include-fixer).
+func isIncludeInsertion(edit lsp.TextEdit) bool {
+	if edit.Range.Start != edit.Range.End {
+		return false
+	}
+	found := false
+	for _, line := range strings.Split(edit.NewText, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !includeDirectiveRegexp.MatchString(line) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// includeInsertionEdit returns an edit that inserts the given #include
+// directives in the IDE document text, after the last #include already
+// present or at the beginning of the document.
+func includeInsertionEdit(ideText string, includes string) lsp.TextEdit {
+	lines := strings.Split(ideText, "\n")
+	pos := lsp.Position{}
+	for i, line := range lines {
+		if includeDirectiveRegexp.MatchString(line) {
+			pos = lsp.Position{Line: i + 1}
+			if i == len(lines)-1 {
+				// The include is on the last line, without a newline
+				pos = lsp.Position{Line: i, Character: len(line)}
+				includes = "\n" + strings.TrimSuffix(includes, "\n")
+			}
+		}
+	}
+	return lsp.TextEdit{Range: lsp.Range{Start: pos, End: pos}, NewText: includes}
+}
+
+// clang2IdeCompletionAdditionalTextEdits converts the additional text edits of a
+// completion item to the IDE document where the completion happens. clangd
+// inserts the missing #include directives at the top of the preprocessed
+// sketch, that is in the preprocessed section or in the first tab: these edits
+// are moved to the document being edited. Other edits not belonging to the
+// document are dropped.
+func (ls *INOLanguageServer) clang2IdeCompletionAdditionalTextEdits(logger jsonrpc.FunctionLogger, clangURI, ideURI lsp.DocumentURI, clangTextEdits []lsp.TextEdit) ([]lsp.TextEdit, error) {
+	var ideTextEdits []lsp.TextEdit
+	for _, clangTextEdit := range clangTextEdits {
+		editURI, ideTextEdit, inPreprocessed, err := ls.cpp2inoTextEdit(logger, clangURI, clangTextEdit)
+		if err == nil && !inPreprocessed && editURI == ideURI {
+			ideTextEdits = append(ideTextEdits, ideTextEdit)
+			continue
+		}
+		if !isIncludeInsertion(clangTextEdit) {
+			if err != nil {
+				return nil, err
+			}
+			logger.Logf("Text edit is in preprocessed section or is mapped to another file, ignored")
+			continue
+		}
+		ideDoc, ok := ls.trackedIdeDocs[ideURI.AsPath().String()]
+		if !ok {
+			logger.Logf("Document %s is not tracked, include insertion ignored", ideURI)
+			continue
+		}
+		ideTextEdit = includeInsertionEdit(ideDoc.Text, clangTextEdit.NewText)
+		logger.Logf("Include insertion moved to %s:%s", ideURI, ideTextEdit.Range.Start)
+		ideTextEdits = append(ideTextEdits, ideTextEdit)
+	}
+	return ideTextEdits, nil
+}
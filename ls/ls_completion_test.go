@@ -0,0 +1,308 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.bug.st/json"
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+func TestRemoveDuplicatedIncludeEdits(t *testing.T) {
+	includeWire := lsp.TextEdit{
+		Range:   lsp.Range{Start: lsp.Position{Line: 0, Character: 0}, End: lsp.Position{Line: 0, Character: 0}},
+		NewText: "#include <Wire.h>\n",
+	}
+	items := func() []lsp.CompletionItem {
+		return []lsp.CompletionItem{
+			{Label: "Wire", AdditionalTextEdits: []lsp.TextEdit{includeWire}},
+			{Label: "TwoWire", AdditionalTextEdits: []lsp.TextEdit{includeWire, includeWire}},
+		}
+	}
+
+	// The include is not yet in the sketch: each item keeps a single insertion
+	res := items()
+	removeDuplicatedIncludeEdits("void setup() {}\nvoid loop() {}\n", res)
+	require.Equal(t, []lsp.TextEdit{includeWire}, res[0].AdditionalTextEdits)
+	require.Equal(t, []lsp.TextEdit{includeWire}, res[1].AdditionalTextEdits)
+
+	// The include is already in the sketch: no insertion is needed
+	res = items()
+	removeDuplicatedIncludeEdits("#include <SPI.h>\n#include <Wire.h>\n\nvoid setup() {}\n", res)
+	require.Empty(t, res[0].AdditionalTextEdits)
+	require.Empty(t, res[1].AdditionalTextEdits)
+}
+
+func TestCompletionIncludesContext(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	ino := ls.trackedIdeDocs[inoURI.AsPath().String()]
+	tabURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("Tab.ino"))
+	headerURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("config.h"))
+	outsideURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Parent().Join("Other", "Other.ino"))
+	for _, doc := range []lsp.TextDocumentItem{
+		{URI: tabURI, Text: "#include <SPI.h>\n"},
+		{URI: headerURI, Text: "#include <EEPROM.h>\n"},
+		{URI: outsideURI, Text: "#include <Servo.h>\n"},
+	} {
+		ls.trackedIdeDocs[doc.URI.AsPath().String()] = doc
+	}
+
+	// The includes of the other .ino tabs are visible from the .ino...
+	headers := includedHeaders(ls.completionIncludesContext(ino))
+	require.True(t, headers["<SPI.h>"])
+	require.False(t, headers["<EEPROM.h>"])
+	require.False(t, headers["<Servo.h>"])
+
+	// ...but not from the other files of the sketch
+	headers = includedHeaders(ls.completionIncludesContext(ls.trackedIdeDocs[headerURI.AsPath().String()]))
+	require.Equal(t, map[string]bool{"<EEPROM.h>": true}, headers)
+}
+
+func TestUnderscoreCompletionItems(t *testing.T) {
+	bv := lsp.CompletionItem{Label: " _BV(uint8_t bit)", InsertText: "_BV"}
+	helper := lsp.CompletionItem{Label: " __FlashStringHelper", InsertText: "__FlashStringHelper"}
+	digitalWrite := lsp.CompletionItem{Label: " digitalWrite(pin, value)", InsertText: "digitalWrite"}
+
+	// By default items starting with underscore are returned
+	ls := &INOLanguageServer{config: &Config{}}
+	require.False(t, ls.isHiddenCompletionItem(bv))
+	require.False(t, ls.isHiddenCompletionItem(helper))
+	require.False(t, ls.isHiddenCompletionItem(digitalWrite))
+
+	ls = &INOLanguageServer{config: &Config{HideUnderscoreCompletions: true}}
+	require.True(t, ls.isHiddenCompletionItem(bv))
+	require.True(t, ls.isHiddenCompletionItem(helper))
+	require.False(t, ls.isHiddenCompletionItem(digitalWrite))
+}
+
+func TestSnippetToPlainText(t *testing.T) {
+	require.Equal(t, "digitalWrite", snippetToPlainText("digitalWrite(${1:uint8_t pin}, ${2:uint8_t val})"))
+	require.Equal(t, "std::vector", snippetToPlainText("std::vector<${1:class T}>"))
+	require.Equal(t, "millis()", snippetToPlainText("millis()"))
+	require.Equal(t, "loop()", snippetToPlainText("loop()$0"))
+	require.Equal(t, "cost$ {x}", snippetToPlainText(`cost\$ {x\}`))
+	require.Equal(t, "$", snippetToPlainText("$"))
+}
+
+func TestSnippetCompletionItems(t *testing.T) {
+	item := lsp.CompletionItem{
+		Label:            " digitalWrite(uint8_t pin, uint8_t val)",
+		InsertText:       "digitalWrite(${1:uint8_t pin}, ${2:uint8_t val})",
+		InsertTextFormat: lsp.InsertTextFormatSnippet,
+		TextEdit:         &lsp.TextEdit{NewText: "digitalWrite(${1:uint8_t pin}, ${2:uint8_t val})"},
+	}
+	convertSnippetToPlainText(&item)
+	require.Equal(t, "digitalWrite", item.InsertText)
+	require.Equal(t, "digitalWrite", item.TextEdit.NewText)
+	require.Equal(t, lsp.InsertTextFormatPlainText, item.InsertTextFormat)
+
+	// Snippets are enabled only if supported by the IDE and not disabled by configuration
+	params := &lsp.InitializeParams{}
+	require.False(t, clientSupportsSnippets(params))
+	require.NoError(t, json.Unmarshal([]byte(`{"textDocument":{"completion":{"completionItem":{"snippetSupport":true}}}}`), &params.Capabilities))
+	require.True(t, clientSupportsSnippets(params))
+	ls := &INOLanguageServer{config: &Config{}, ideSnippetSupport: true}
+	require.True(t, ls.snippetsEnabled())
+	ls.config.DisableSnippets = true
+	require.False(t, ls.snippetsEnabled())
+}
+
+func TestIncludeInsertionEdit(t *testing.T) {
+	at := func(line, char int) lsp.Range {
+		return lsp.Range{Start: lsp.Position{Line: line, Character: char}, End: lsp.Position{Line: line, Character: char}}
+	}
+	require.True(t, isIncludeInsertion(lsp.TextEdit{Range: at(1, 0), NewText: "#include <Wire.h>\n"}))
+	require.False(t, isIncludeInsertion(lsp.TextEdit{Range: at(1, 0), NewText: "int a;\n"}))
+	require.False(t, isIncludeInsertion(lsp.TextEdit{Range: at(1, 0), NewText: "\n"}))
+	require.False(t, isIncludeInsertion(lsp.TextEdit{
+		Range:   lsp.Range{Start: lsp.Position{Line: 1}, End: lsp.Position{Line: 2}},
+		NewText: "#include <Wire.h>\n",
+	}))
+
+	// No includes: at the beginning of the document
+	require.Equal(t,
+		lsp.TextEdit{Range: at(0, 0), NewText: "#include <Wire.h>\n"},
+		includeInsertionEdit("void setup() {}\n", "#include <Wire.h>\n"))
+	// After the last include
+	require.Equal(t,
+		lsp.TextEdit{Range: at(3, 0), NewText: "#include <Wire.h>\n"},
+		includeInsertionEdit("// comment\n#include <SPI.h>\n#include \"config.h\"\nvoid setup() {}\n", "#include <Wire.h>\n"))
+	// After an include on the last line, without a newline
+	require.Equal(t,
+		lsp.TextEdit{Range: at(0, 16), NewText: "\n#include <Wire.h>"},
+		includeInsertionEdit("#include <SPI.h>", "#include <Wire.h>\n"))
+}
+
+func TestMaxCompletions(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	fake := &fakeClangdConn{completion: &lsp.CompletionList{}}
+	for i := 0; i < 10; i++ {
+		fake.completion.Items = append(fake.completion.Items, lsp.CompletionItem{Label: "item" + strconv.Itoa(i)})
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	complete := func() *lsp.CompletionList {
+		res, respErr := ls.textDocumentCompletionReqFromIDE(context.Background(), testLogger(), &lsp.CompletionParams{
+			TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+				TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+				Position:     lsp.Position{Line: 2, Character: 2},
+			},
+		})
+		require.Nil(t, respErr)
+		return res
+	}
+
+	res := complete()
+	require.Len(t, res.Items, 10)
+	require.False(t, res.IsIncomplete)
+
+	ls.config.MaxCompletions = 10
+	res = complete()
+	require.Len(t, res.Items, 10)
+	require.False(t, res.IsIncomplete)
+
+	ls.config.MaxCompletions = 3
+	res = complete()
+	require.Len(t, res.Items, 3)
+	require.Equal(t, "item2", res.Items[2].Label)
+	require.True(t, res.IsIncomplete)
+}
+
+func TestCompletionSharedEditRange(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	cppRange := lsp.Range{Start: lsp.Position{Line: 10, Character: 2}, End: lsp.Position{Line: 10, Character: 5}}
+	inoRange := lsp.Range{Start: lsp.Position{Line: 2, Character: 2}, End: lsp.Position{Line: 2, Character: 5}}
+	preprocessedRange := lsp.Range{Start: lsp.Position{Line: 0, Character: 0}, End: lsp.Position{Line: 0, Character: 3}}
+	fake := &fakeClangdConn{completion: &lsp.CompletionList{Items: []lsp.CompletionItem{
+		{Label: "int", TextEdit: &lsp.TextEdit{Range: cppRange, NewText: "int"}},
+		{Label: "#include", TextEdit: &lsp.TextEdit{Range: preprocessedRange, NewText: "#include"}},
+		{Label: "interrupts", TextEdit: &lsp.TextEdit{Range: cppRange, NewText: "interrupts()"}},
+		{Label: "#inc", TextEdit: &lsp.TextEdit{Range: preprocessedRange, NewText: "#inc"}},
+	}}}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+
+	res, respErr := ls.textDocumentCompletionReqFromIDE(context.Background(), testLogger(), &lsp.CompletionParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Position:     lsp.Position{Line: 2, Character: 5},
+		},
+	})
+	require.Nil(t, respErr)
+	require.Len(t, res.Items, 2)
+	require.Equal(t, &lsp.TextEdit{Range: inoRange, NewText: "int"}, res.Items[0].TextEdit)
+	require.Equal(t, &lsp.TextEdit{Range: inoRange, NewText: "interrupts()"}, res.Items[1].TextEdit)
+}
+
+func TestCompletionSharedEditRangeWithNewline(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	cppLines := strings.Split(ls.sketchMapper.CppText.Text, "\n")
+	// The range starts at the end of the #line directive before setup()
+	cppRange := lsp.Range{Start: lsp.Position{Line: 8, Character: len(cppLines[8])}, End: lsp.Position{Line: 9, Character: 2}}
+	fake := &fakeClangdConn{completion: &lsp.CompletionList{Items: []lsp.CompletionItem{
+		{Label: "vo", TextEdit: &lsp.TextEdit{Range: cppRange, NewText: "vo"}},
+		{Label: "void", TextEdit: &lsp.TextEdit{Range: cppRange, NewText: "\nvoid"}},
+	}}}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+
+	res, respErr := ls.textDocumentCompletionReqFromIDE(context.Background(), testLogger(), &lsp.CompletionParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Position:     lsp.Position{Line: 1, Character: 2},
+		},
+	})
+	require.Nil(t, respErr)
+	// The edit starting with a newline is moved into the .ino, even if the
+	// same range is not valid for the other items
+	require.Len(t, res.Items, 1)
+	require.Equal(t, &lsp.TextEdit{
+		Range:   lsp.Range{Start: lsp.Position{Line: 1, Character: 0}, End: lsp.Position{Line: 1, Character: 2}},
+		NewText: "void",
+	}, res.Items[0].TextEdit)
+}
+
+func TestCompletionCancelsStaleRequests(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	started := make(chan bool, 1)
+	canceled := make(chan bool, 1)
+	fake := &fakeClangdConn{completion: &lsp.CompletionList{Items: []lsp.CompletionItem{{Label: "unused"}}}}
+	fake.completionHook = func(ctx context.Context) {
+		// The first request waits for clangd until it's canceled
+		fake.completionHook = nil
+		started <- true
+		select {
+		case <-ctx.Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+		}
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	params := &lsp.CompletionParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Position:     lsp.Position{Line: 2, Character: 2},
+		},
+	}
+
+	stale := make(chan *jsonrpc.ResponseError, 1)
+	go func() {
+		_, respErr := ls.textDocumentCompletionReqFromIDE(context.Background(), testLogger(), params)
+		stale <- respErr
+	}()
+	<-started
+
+	res, respErr := ls.textDocumentCompletionReqFromIDE(context.Background(), testLogger(), params)
+	require.Nil(t, respErr)
+	require.Len(t, res.Items, 1)
+	require.True(t, <-canceled)
+	respErr = <-stale
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesRequestCancelled, respErr.Code)
+	require.Empty(t, ls.activeCompletions)
+}
+
+func TestCompletionIncludeInsertion(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	includeWire := lsp.TextEdit{
+		Range:   lsp.Range{Start: lsp.Position{Line: 1, Character: 0}, End: lsp.Position{Line: 1, Character: 0}},
+		NewText: "#include <Wire.h>\n",
+	}
+	fake := &fakeClangdConn{completion: &lsp.CompletionList{
+		Items: []lsp.CompletionItem{{Label: "Wire", InsertText: "Wire", AdditionalTextEdits: []lsp.TextEdit{includeWire}}},
+	}}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+
+	res, respErr := ls.textDocumentCompletionReqFromIDE(context.Background(), testLogger(), &lsp.CompletionParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Position:     lsp.Position{Line: 2, Character: 2},
+		},
+	})
+	require.Nil(t, respErr)
+	require.Len(t, res.Items, 1)
+
+	// The include, added by clangd after the Arduino.h include of the preprocessed
+	// sketch, is moved at the beginning of the sketch
+	require.Equal(t, []lsp.TextEdit{{
+		Range:   lsp.Range{Start: lsp.Position{Line: 0, Character: 0}, End: lsp.Position{Line: 0, Character: 0}},
+		NewText: "#include <Wire.h>\n",
+	}}, res.Items[0].AdditionalTextEdits)
+}
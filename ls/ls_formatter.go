@@ -16,12 +16,30 @@
 package ls
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
 	"github.com/arduino/go-paths-helper"
 	"go.bug.st/lsp"
 	"go.bug.st/lsp/jsonrpc"
 )
 
-func (ls *INOLanguageServer) createClangdFormatterConfig(logger jsonrpc.FunctionLogger, cppuri lsp.DocumentURI) (func(), error) {
+// createClangdFormatterConfig writes the formatter configuration for the given
+// document and returns the URI of the document that clangd must format, with the
+// function to call once the formatting is done.
+func (ls *INOLanguageServer) createClangdFormatterConfig(logger jsonrpc.FunctionLogger, ideURI, cppuri lsp.DocumentURI) (lsp.DocumentURI, func(), error) {
+	if ls.config.DisableFormatOverride {
+		// Let clangd discover the user's own .clang-format in the parent directories
+		logger.Logf("    formatter config override disabled")
+		return cppuri, func() {}, nil
+	}
+
 	// clangd looks for a .clang-format configuration file on the same directory
 	// pointed by the uri passed in the lsp command parameters.
 	// https://github.com/llvm/llvm-project/blob/64d06ed9c9e0389cd27545d2f6e20455a91d89b1/clang-tools-extra/clangd/ClangdLSPServer.cpp#L856-L868
@@ -236,16 +254,163 @@ WhitespaceSensitiveMacros:
 		try(ls.config.FormatterConf)
 	}
 
-	targetFile := cppuri.AsPath()
-	if targetFile.IsNotDir() {
-		targetFile = targetFile.Parent()
+	targetDir := cppuri.AsPath()
+	if targetDir.IsNotDir() {
+		targetDir = targetDir.Parent()
+	}
+	cleanup, err := ls.writeClangdFormatterConfig(logger, targetDir, config)
+	if err == nil {
+		return cppuri, cleanup, nil
+	}
+
+	// The folder may be read-only (for example a read-only mount): format a copy of
+	// the document inside the managed build folder, where the config can be written.
+	// This is possible only for the documents not preprocessed (and not remapped).
+	doc, tracked := ls.trackedIdeDocs[ideURI.AsPath().String()]
+	if !tracked || ideURI != cppuri || ls.tempDir == nil {
+		return lsp.NilURI, nil, err
+	}
+	logger.Logf("    cannot write formatter config (%s), formatting a copy of the document", err)
+	copyDir := ls.tempDir.Join("formatter")
+	if err := copyDir.MkdirAll(); err != nil {
+		return lsp.NilURI, nil, err
+	}
+	cleanup, err = ls.writeClangdFormatterConfig(logger, copyDir, config)
+	if err != nil {
+		return lsp.NilURI, nil, err
+	}
+	copyURI := lsp.NewDocumentURIFromPath(copyDir.Join(cppuri.AsPath().Base()))
+	if err := ls.Clangd.conn.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: copyURI, LanguageID: doc.LanguageID, Version: doc.Version, Text: doc.Text},
+	}); err != nil {
+		cleanup()
+		return lsp.NilURI, nil, err
 	}
-	targetFile = targetFile.Join(".clang-format")
+	return copyURI, func() {
+		if err := ls.Clangd.conn.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: copyURI},
+		}); err != nil {
+			logger.Logf("    error closing formatted copy: %s", err)
+		}
+		cleanup()
+	}, nil
+}
+
+// writeClangdFormatterConfig writes the formatter config in the given folder and
+// returns the function to remove it.
+func (ls *INOLanguageServer) writeClangdFormatterConfig(logger jsonrpc.FunctionLogger, targetDir *paths.Path, config string) (func(), error) {
+	targetFile := targetDir.Join(".clang-format")
+
+	// Keep the config file in place until the formatting is done, before
+	// another request writes (and removes) it.
+	unlock := ls.lockFormatterConfigDir(targetDir)
 	cleanup := func() {
 		targetFile.Remove()
 		logger.Logf("    formatter config cleaned")
+		unlock()
 	}
 	logger.Logf("    writing formatter config in: %s", targetFile)
-	err := targetFile.WriteFile([]byte(config))
-	return cleanup, err
+	if err := targetFile.WriteFile([]byte(config)); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// lockFormatterConfigDir locks the given directory for writing a formatter
+// config file and returns the function to unlock it.
+func (ls *INOLanguageServer) lockFormatterConfigDir(dir *paths.Path) func() {
+	ls.formatterConfigMux.Lock()
+	if ls.formatterConfigLocks == nil {
+		ls.formatterConfigLocks = map[string]*sync.Mutex{}
+	}
+	lock, ok := ls.formatterConfigLocks[dir.String()]
+	if !ok {
+		lock = &sync.Mutex{}
+		ls.formatterConfigLocks[dir.String()] = lock
+	}
+	ls.formatterConfigMux.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// clangFormatReplacements is the output of clang-format --output-replacements-xml
+type clangFormatReplacements struct {
+	Replacements []struct {
+		Offset int    `xml:"offset,attr"`
+		Length int    `xml:"length,attr"`
+		Text   string `xml:",chardata"`
+	} `xml:"replacement"`
+}
+
+// clangFormatTextEdits formats the given cpp document with the clang-format
+// executable set in the configuration, instead of clangd. The configuration is
+// searched starting from formatURI (see createClangdFormatterConfig). If
+// clangRange is not nil only the lines in the range are formatted.
+func (ls *INOLanguageServer) clangFormatTextEdits(ctx context.Context, logger jsonrpc.FunctionLogger, ideURI, clangURI, formatURI lsp.DocumentURI, clangRange *lsp.Range) ([]lsp.TextEdit, error) {
+	var text string
+	if ls.clangURIRefersToIno(clangURI) {
+		text = ls.sketchMapper.CppText.Text
+	} else if doc, tracked := ls.trackedIdeDocs[ideURI.AsPath().String()]; tracked {
+		text = doc.Text
+	} else if data, err := clangURI.AsPath().ReadFile(); err != nil {
+		return nil, err
+	} else {
+		text = string(data)
+	}
+
+	args := []string{
+		"--style=file",
+		"--output-replacements-xml",
+		"--assume-filename=" + formatURI.AsPath().String(),
+	}
+	if clangRange != nil {
+		endLine := clangRange.End.Line
+		if endLine > clangRange.Start.Line && clangRange.End.Character == 0 {
+			// The range ends at the beginning of the line: don't format it
+			endLine--
+		}
+		args = append(args, fmt.Sprintf("--lines=%d:%d", clangRange.Start.Line+1, endLine+1))
+	}
+	logger.Logf("    running %s %s", ls.config.ClangFormatPath, strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, ls.config.ClangFormatPath.String(), args...)
+	cmd.Stdin = strings.NewReader(text)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("running clang-format: %w", err)
+	}
+
+	var replacements clangFormatReplacements
+	if err := xml.Unmarshal(out, &replacements); err != nil {
+		return nil, fmt.Errorf("decoding clang-format output: %w", err)
+	}
+	edits := []lsp.TextEdit{}
+	for _, r := range replacements.Replacements {
+		if r.Offset < 0 || r.Length < 0 || r.Offset+r.Length > len(text) {
+			return nil, fmt.Errorf("clang-format replacement out of range: offset %d length %d", r.Offset, r.Length)
+		}
+		edits = append(edits, lsp.TextEdit{
+			Range: lsp.Range{
+				Start: offsetToPosition(text, r.Offset),
+				End:   offsetToPosition(text, r.Offset+r.Length),
+			},
+			NewText: r.Text,
+		})
+	}
+	return edits, nil
+}
+
+// offsetToPosition returns the position of the given byte offset in the text,
+// the character is counted in UTF-16 code units as required by LSP.
+func offsetToPosition(text string, offset int) lsp.Position {
+	before := text[:offset]
+	line := strings.Count(before, "\n")
+	lineStart := strings.LastIndex(before, "\n") + 1
+	return lsp.Position{Line: line, Character: len(utf16.Encode([]rune(before[lineStart:])))}
 }
@@ -0,0 +1,239 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/textedits"
+)
+
+func TestConcurrentFormatterConfig(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	configFile := ls.buildSketchRoot.Join(".clang-format")
+
+	logger := testLogger()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			formatURI, cleanup, err := ls.createClangdFormatterConfig(logger, inoURI, cppURI)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, cppURI, formatURI)
+			defer cleanup()
+
+			// The config must stay in place while clangd is formatting
+			assert.True(t, configFile.Exist())
+			time.Sleep(5 * time.Millisecond)
+			assert.True(t, configFile.Exist())
+		}()
+	}
+	wg.Wait()
+	require.False(t, configFile.Exist())
+}
+
+func TestFormatterConfigInReadOnlyFolder(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ls.tempDir = paths.New(t.TempDir())
+	clangd := &fakeClangdConn{}
+	ls.Clangd = &clangdLSPClient{conn: clangd, ls: ls}
+
+	// A library file outside the sketch, in a folder where the config can't be written
+	libDir := paths.New(t.TempDir())
+	require.NoError(t, libDir.Join(".clang-format").MkdirAll())
+	libURI := lsp.NewDocumentURIFromPath(libDir.Join("lib.cpp"))
+	ls.trackedIdeDocs[libURI.AsPath().String()] = lsp.TextDocumentItem{URI: libURI, LanguageID: "cpp", Version: 3, Text: "int  x;\n"}
+
+	formatURI, cleanup, err := ls.createClangdFormatterConfig(testLogger(), libURI, libURI)
+	require.NoError(t, err)
+	copyFile := ls.tempDir.Join("formatter", "lib.cpp")
+	require.Equal(t, lsp.NewDocumentURIFromPath(copyFile), formatURI)
+	require.True(t, ls.tempDir.Join("formatter", ".clang-format").Exist())
+	require.Len(t, clangd.opened, 1)
+	require.Equal(t, "int  x;\n", clangd.opened[0].Text)
+
+	cleanup()
+	require.False(t, ls.tempDir.Join("formatter", ".clang-format").Exist())
+	require.Equal(t, []lsp.DocumentURI{formatURI}, clangd.closed)
+
+	// Untracked documents can't be copied
+	otherURI := lsp.NewDocumentURIFromPath(libDir.Join("other.cpp"))
+	_, _, err = ls.createClangdFormatterConfig(testLogger(), otherURI, otherURI)
+	require.Error(t, err)
+}
+
+func TestClangFormatExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not executable on windows")
+	}
+	ls, inoURI, _ := newTestSketchServer(t)
+	ls.Clangd = &clangdLSPClient{conn: &fakeClangdConn{}, ls: ls}
+
+	// Re-indent "  int unused = 0;" in the setup
+	offset, err := textedits.GetOffset(ls.sketchMapper.CppText.Text, lsp.Position{Line: 10, Character: 0})
+	require.NoError(t, err)
+	tmp := paths.New(t.TempDir())
+	argsFile := tmp.Join("args")
+	clangFormat := tmp.Join("clang-format")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\ncat > /dev/null\n", argsFile)
+	script += "echo \"<?xml version='1.0'?>\"\n"
+	script += "echo \"<replacements xml:space='preserve' incomplete_format='false'>\"\n"
+	script += fmt.Sprintf("echo \"<replacement offset='%d' length='2'>    </replacement>\"\n", offset)
+	script += "echo \"</replacements>\"\n"
+	require.NoError(t, clangFormat.WriteFile([]byte(script)))
+	require.NoError(t, clangFormat.Chmod(0755))
+	ls.config.ClangFormatPath = clangFormat
+
+	expected := []lsp.TextEdit{{
+		Range:   lsp.Range{Start: lsp.Position{Line: 2, Character: 0}, End: lsp.Position{Line: 2, Character: 2}},
+		NewText: "    ",
+	}}
+	res, respErr := ls.textDocumentFormattingReqFromIDE(context.Background(), testLogger(), &lsp.DocumentFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, expected, res)
+	args, err := argsFile.ReadFile()
+	require.NoError(t, err)
+	require.Contains(t, string(args), "--output-replacements-xml")
+	require.Contains(t, string(args), "--assume-filename="+ls.buildSketchCpp.String())
+	require.NotContains(t, string(args), "--lines")
+
+	res, respErr = ls.textDocumentRangeFormattingReqFromIDE(context.Background(), testLogger(), &lsp.DocumentRangeFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+		Range:        lsp.Range{Start: lsp.Position{Line: 2, Character: 0}, End: lsp.Position{Line: 3, Character: 0}},
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, expected, res)
+	args, err = argsFile.ReadFile()
+	require.NoError(t, err)
+	require.Contains(t, strings.TrimSpace(string(args)), "--lines=11:11")
+
+	// clang-format errors are reported
+	require.NoError(t, clangFormat.WriteFile([]byte("#!/bin/sh\necho 'Invalid argument' >&2\nexit 1\n")))
+	_, respErr = ls.textDocumentFormattingReqFromIDE(context.Background(), testLogger(), &lsp.DocumentFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.NotNil(t, respErr)
+	require.Contains(t, respErr.Message, "Invalid argument")
+}
+
+func TestOffsetToPosition(t *testing.T) {
+	text := "void setup() {\n  int a;\n}\n"
+	for _, pos := range []lsp.Position{{Line: 0, Character: 0}, {Line: 0, Character: 5}, {Line: 1, Character: 2}, {Line: 2, Character: 0}, {Line: 3, Character: 0}} {
+		offset, err := textedits.GetOffset(text, pos)
+		require.NoError(t, err)
+		require.Equal(t, pos, offsetToPosition(text, offset))
+	}
+
+	// clang-format offsets are in bytes, LSP characters in UTF-16 code units
+	text = "char *s = \"è😀\";  int a;\n"
+	require.Equal(t, lsp.Position{Line: 0, Character: 16}, offsetToPosition(text, strings.Index(text, "  int")))
+	require.Equal(t, lsp.Position{Line: 1, Character: 0}, offsetToPosition(text, len(text)))
+}
+
+func TestRangeFormattingFromFirstLine(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	fake := &fakeClangdConn{}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	cppLines := strings.Split(ls.sketchMapper.CppText.Text, "\n")
+	cppRange := func(startLine, startChar, endLine, endChar int) lsp.Range {
+		return lsp.Range{Start: lsp.Position{Line: startLine, Character: startChar}, End: lsp.Position{Line: endLine, Character: endChar}}
+	}
+
+	fake.rangeFormatting = []lsp.TextEdit{
+		// From the end of the "void loop();" prototype to the setup
+		{Range: cppRange(7, len(cppLines[7]), 9, 0), NewText: "\n"},
+		// From the end of the #line directive before the setup
+		{Range: cppRange(8, len(cppLines[8]), 9, 0), NewText: "\n\n"},
+		// From the first line of the sketch to the setup body, over the prototypes
+		{Range: cppRange(3, 0, 10, 2), NewText: "\n    "},
+		// Inside the setup body
+		{Range: cppRange(10, 0, 10, 2), NewText: "    "},
+	}
+	res, respErr := ls.textDocumentRangeFormattingReqFromIDE(context.Background(), testLogger(), &lsp.DocumentRangeFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+		Range:        cppRange(0, 0, 3, 1),
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, []lsp.TextEdit{
+		{Range: cppRange(1, 0, 1, 0), NewText: "\n"},
+		{Range: cppRange(2, 0, 2, 2), NewText: "    "},
+	}, res)
+}
+
+func TestWillSaveWaitUntil(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	ls.config.DisableFormatOverride = true
+	fake := &fakeClangdConn{
+		formatting: []lsp.TextEdit{{
+			Range:   lsp.Range{Start: lsp.Position{Line: 10, Character: 0}, End: lsp.Position{Line: 10, Character: 2}},
+			NewText: "    ",
+		}},
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	params := &lsp.WillSaveTextDocumentParams{
+		RextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+		Reason:       lsp.TextDocumentSaveReasonManual,
+	}
+
+	// Format on save disabled
+	res, respErr := ls.textDocumentWillSaveWaitUntilReqFromIDE(context.Background(), testLogger(), params)
+	require.Nil(t, respErr)
+	require.NotNil(t, res)
+	require.Empty(t, res)
+
+	// Format on save enabled
+	ls.config.FormatOnSave = true
+	res, respErr = ls.textDocumentWillSaveWaitUntilReqFromIDE(context.Background(), testLogger(), params)
+	require.Nil(t, respErr)
+	require.Equal(t, []lsp.TextEdit{{
+		Range:   lsp.Range{Start: lsp.Position{Line: 2, Character: 0}, End: lsp.Position{Line: 2, Character: 2}},
+		NewText: "    ",
+	}}, res)
+	require.Equal(t, lsp.FormattingOptions{}, fake.formattingOptions)
+
+	// The options of the last formatting request are reused
+	options := lsp.FormattingOptions{"tabSize": float64(4), "insertSpaces": false}
+	_, respErr = ls.textDocumentFormattingReqFromIDE(context.Background(), testLogger(), &lsp.DocumentFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+		Options:      options,
+	})
+	require.Nil(t, respErr)
+	fake.formattingOptions = nil
+	_, respErr = ls.textDocumentWillSaveWaitUntilReqFromIDE(context.Background(), testLogger(), params)
+	require.Nil(t, respErr)
+	require.Equal(t, options, fake.formattingOptions)
+
+	fake.formatting = nil
+	res, respErr = ls.textDocumentWillSaveWaitUntilReqFromIDE(context.Background(), testLogger(), params)
+	require.Nil(t, respErr)
+	require.NotNil(t, res)
+	require.Empty(t, res)
+}
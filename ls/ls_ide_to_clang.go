@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/go-paths-helper"
 	"go.bug.st/lsp"
 	"go.bug.st/lsp/jsonrpc"
 )
@@ -29,6 +30,12 @@ func (ls *INOLanguageServer) idePathToIdeURI(logger jsonrpc.FunctionLogger, inoP
 	}
 	doc, ok := ls.trackedIdeDocs[inoPath]
 	if !ok {
+		// The file may be part of the sketch but not yet opened in the IDE (for
+		// example the target of a goto-definition): refer to it from the disk.
+		if exist, err := paths.New(inoPath).ExistCheck(); err == nil && exist {
+			logger.Logf("    Path not opened in the IDE, using file on disk: %s", inoPath)
+			return lsp.NewDocumentURI(inoPath), nil
+		}
 		logger.Logf("    !!! Unresolved .ino path: %s", inoPath)
 		logger.Logf("    !!! Known doc paths are:")
 		for p := range ls.trackedIdeDocs {
@@ -48,7 +55,7 @@ func (ls *INOLanguageServer) ide2ClangTextDocumentIdentifier(logger jsonrpc.Func
 func (ls *INOLanguageServer) ide2ClangDocumentURI(logger jsonrpc.FunctionLogger, ideURI lsp.DocumentURI) (lsp.DocumentURI, bool, error) {
 	// Sketchbook/Sketch/Sketch.ino      -> build-path/sketch/Sketch.ino.cpp
 	// Sketchbook/Sketch/AnotherTab.ino  -> build-path/sketch/Sketch.ino.cpp  (different section from above)
-	idePath := ideURI.AsPath()
+	idePath := canonicalDocumentPath(ideURI)
 	if idePath.Ext() == ".ino" {
 		clangURI := lsp.NewDocumentURIFromPath(ls.buildSketchCpp)
 		logger.Logf("URI: %s -> %s", ideURI, clangURI)
@@ -80,6 +87,32 @@ func (ls *INOLanguageServer) ide2ClangDocumentURI(logger jsonrpc.FunctionLogger,
 	return clangURI, true, nil
 }
 
+// ide2ClangTextDocumentItem returns the TextDocumentItem that must be sent to clangd
+// in a didOpen notification for the given IDE document.
+func (ls *INOLanguageServer) ide2ClangTextDocumentItem(logger jsonrpc.FunctionLogger, ideTextDocItem lsp.TextDocumentItem) (lsp.TextDocumentItem, error) {
+	clangURI, _, err := ls.ide2ClangDocumentURI(logger, ideTextDocItem.URI)
+	if err != nil {
+		return lsp.TextDocumentItem{}, err
+	}
+	clangTextDocItem := lsp.TextDocumentItem{
+		URI: clangURI,
+	}
+	if ls.clangURIRefersToIno(clangURI) {
+		clangTextDocItem.LanguageID = "cpp"
+		clangTextDocItem.Text = ls.sketchMapper.CppText.Text
+		clangTextDocItem.Version = ls.sketchMapper.CppText.Version
+	} else {
+		clangText, err := clangURI.AsPath().ReadFile()
+		if err != nil {
+			logger.Logf("Error opening sketch file %s: %s", clangURI.AsPath(), err)
+		}
+		clangTextDocItem.LanguageID = ideTextDocItem.LanguageID
+		clangTextDocItem.Version = ideTextDocItem.Version
+		clangTextDocItem.Text = string(clangText)
+	}
+	return clangTextDocItem, nil
+}
+
 func (ls *INOLanguageServer) ide2ClangTextDocumentPositionParams(logger jsonrpc.FunctionLogger, ideParams lsp.TextDocumentPositionParams) (lsp.TextDocumentPositionParams, error) {
 	clangURI, clangPosition, err := ls.ide2ClangPosition(logger, ideParams.TextDocument.URI, ideParams.Position)
 	if err != nil {
@@ -0,0 +1,1149 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/arduino-language-server/sourcemapper"
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+	"go.bug.st/json"
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+func TestSignatureParameterLabel(t *testing.T) {
+	signature := "digitalWrite(uint8_t pin, uint8_t val) -> void"
+	require.Equal(t, "uint8_t pin", signatureParameterLabel(signature, json.RawMessage(`"uint8_t pin"`)))
+	require.Equal(t, "uint8_t pin", signatureParameterLabel(signature, json.RawMessage(`[13,24]`)))
+	require.Equal(t, "uint8_t val", signatureParameterLabel(signature, json.RawMessage(`[26,37]`)))
+	require.Equal(t, "", signatureParameterLabel(signature, json.RawMessage(`[26,100]`)))
+	require.Equal(t, "", signatureParameterLabel(signature, json.RawMessage(`{}`)))
+}
+
+func TestClangTidyCodeActionConversion(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+
+	cppRange := func(line, start, end int) lsp.Range {
+		return lsp.Range{Start: lsp.Position{Line: line, Character: start}, End: lsp.Position{Line: line, Character: end}}
+	}
+	unusedVariable := lsp.Diagnostic{
+		Range:    cppRange(10, 6, 12),
+		Severity: lsp.DiagnosticSeverityWarning,
+		Code:     json.RawMessage(`"clang-diagnostic-unused-variable"`),
+		Source:   "clang-tidy",
+		Message:  "unused variable 'unused'",
+	}
+	clangCodeAction := lsp.CodeAction{
+		Title: "remove unused variable",
+		Kind:  lsp.CodeActionKindQuickFix,
+		Diagnostics: []lsp.Diagnostic{
+			unusedVariable,
+			{Range: cppRange(5, 0, 13), Source: "clang-tidy", Message: "in preprocessed section"},
+		},
+		Edit: &lsp.WorkspaceEdit{
+			Changes: map[lsp.DocumentURI][]lsp.TextEdit{
+				cppURI: {
+					{Range: cppRange(10, 2, 17), NewText: ""},
+					{Range: cppRange(5, 0, 13), NewText: "void setup(void);"},
+				},
+			},
+		},
+	}
+
+	ideCodeAction := ls.clang2IdeCodeAction(testLogger(), clangCodeAction, inoURI)
+	require.NotNil(t, ideCodeAction)
+
+	// The fix-it diagnostic is mapped to the .ino, the preprocessed one is dropped
+	require.Len(t, ideCodeAction.Diagnostics, 1)
+	require.Equal(t, cppRange(2, 6, 12), ideCodeAction.Diagnostics[0].Range)
+	require.Equal(t, "unused variable 'unused'", ideCodeAction.Diagnostics[0].Message)
+
+	// The fix-it edit is mapped to the .ino, the edit in the preprocessed section is dropped
+	require.Equal(t, map[lsp.DocumentURI][]lsp.TextEdit{
+		inoURI: {{Range: cppRange(2, 2, 17), NewText: ""}},
+	}, ideCodeAction.Edit.Changes)
+}
+
+func TestDocumentLinks(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	require.NoError(t, ls.sketchRoot.Join("config.h").WriteFile([]byte("#define LED 13\n")))
+
+	ino := inoURI.AsPath().String()
+	doc := ls.trackedIdeDocs[ino]
+	doc.Text = "#include \"config.h\"\n#include \"missing.h\"\nvoid setup() {}\n"
+	ls.trackedIdeDocs[ino] = doc
+
+	links, respErr := ls.textDocumentDocumentLinkReqFromIDE(context.Background(), testLogger(), &lsp.DocumentLinkParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, []lsp.DocumentLink{{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: 0, Character: 10},
+			End:   lsp.Position{Line: 0, Character: 18},
+		},
+		Target: lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("config.h")),
+	}}, links)
+
+	// The includes of the files in src/ are searched in their folder first
+	src := ls.sketchRoot.Join("src")
+	require.NoError(t, src.MkdirAll())
+	require.NoError(t, src.Join("config.h").WriteFile([]byte("#define LED 12\n")))
+	require.NoError(t, src.Join("util.h").WriteFile([]byte("int util();\n")))
+	utilURI := lsp.NewDocumentURIFromPath(src.Join("util.cpp"))
+	ls.trackedIdeDocs[src.Join("util.cpp").String()] = lsp.TextDocumentItem{
+		URI:        utilURI,
+		LanguageID: "cpp",
+		Text:       "#include \"util.h\"\n#include \"config.h\"\n#include \"../config.h\"\n",
+	}
+	links, respErr = ls.textDocumentDocumentLinkReqFromIDE(context.Background(), testLogger(), &lsp.DocumentLinkParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: utilURI},
+	})
+	require.Nil(t, respErr)
+	require.Len(t, links, 3)
+	require.Equal(t, lsp.NewDocumentURIFromPath(src.Join("util.h")), links[0].Target)
+	require.Equal(t, lsp.NewDocumentURIFromPath(src.Join("config.h")), links[1].Target)
+	require.Equal(t, lsp.NewDocumentURIFromPath(src.Join("..", "config.h")), links[2].Target)
+}
+
+func TestWordOccurrences(t *testing.T) {
+	require.Equal(t, []int{4, 24}, wordOccurrences("see Other.ino, then see Other.ino", "Other.ino"))
+	require.Equal(t, []int{0}, wordOccurrences("Other.ino.", "Other.ino"))
+	// Parts of longer names are not references to the tab
+	require.Empty(t, wordOccurrences("see MyOther.ino and Other.ino_old", "Other.ino"))
+	require.Equal(t, []int{15}, wordOccurrences("MyOther.ino or Other.ino", "Other.ino"))
+	require.Empty(t, wordOccurrences("", "Other.ino"))
+}
+
+func TestRemoveTemporaryFolder(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+
+	extraneous := tmp.Join("some-other-folder")
+	require.NoError(t, extraneous.MkdirAll())
+	require.Error(t, RemoveTemporaryFolder(extraneous.String()))
+	require.True(t, extraneous.Exist())
+
+	own := tmp.Join("arduino-language-server-12345")
+	require.NoError(t, own.Join("build").MkdirAll())
+	require.NoError(t, RemoveTemporaryFolder(own.String()))
+	require.False(t, own.Exist())
+}
+
+func TestDuplicatedDidOpen(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	ls.trackedIdeDocs = map[string]lsp.TextDocumentItem{}
+	clangdIn := newTestClangdClient(ls)
+
+	ideDoc := lsp.TextDocumentItem{URI: inoURI, LanguageID: "cpp", Version: 1, Text: "void setup() {}\nvoid loop() {}\n"}
+	ls.textDocumentDidOpenNotifFromIDE(testLogger(), &lsp.DidOpenTextDocumentParams{TextDocument: ideDoc})
+	ls.textDocumentDidOpenNotifFromIDE(testLogger(), &lsp.DidOpenTextDocumentParams{TextDocument: ideDoc})
+	require.Equal(t, 1, ls.sketchTrackedFilesCount)
+	require.Equal(t, 1, strings.Count(clangdIn.String(), `"textDocument/didOpen"`))
+
+	ls.textDocumentDidCloseNotifFromIDE(testLogger(), &lsp.DidCloseTextDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.Equal(t, 0, ls.sketchTrackedFilesCount)
+	require.Empty(t, ls.trackedIdeDocs)
+	require.Equal(t, 1, strings.Count(clangdIn.String(), `"textDocument/didClose"`))
+}
+
+func TestDidSaveRebuildsOnlyChangedDocuments(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	ino := inoURI.AsPath().String()
+	save := func() bool {
+		ls.textDocumentDidSaveNotifFromIDE(testLogger(), &lsp.DidSaveTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+		})
+		select {
+		case <-ls.sketchRebuilder.trigger:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// never built
+	require.True(t, save())
+
+	// unchanged since the last build
+	ls.lastBuiltDocsHash = ls.trackedIdeDocsHash()
+	require.False(t, save())
+
+	// edited after the last build
+	doc := ls.trackedIdeDocs[ino]
+	doc.Text += "// comment\n"
+	ls.trackedIdeDocs[ino] = doc
+	require.True(t, save())
+}
+
+func TestPreprocessedSketch(t *testing.T) {
+	ls, _, cppURI := newTestSketchServer(t)
+	res, respErr := ls.preprocessedSketchReqFromIDE(context.Background(), testLogger())
+	require.Nil(t, respErr)
+	require.Equal(t, cppURI, res.URI)
+	require.Equal(t, ls.sketchMapper.CppText.Text, res.Text)
+	require.Contains(t, res.Text, "void setup();")
+}
+
+func TestCheckSketchMainFile(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	require.NoError(t, checkSketchMainFile(ls.sketchRoot))
+
+	// The name of the .ino doesn't need to match the folder name (the main
+	// file is chosen by arduino-cli)
+	renamed := paths.New(t.TempDir()).Join("Renamed")
+	require.NoError(t, renamed.MkdirAll())
+	require.NoError(t, renamed.Join("Blink.ino").WriteFile([]byte("void setup() {}\nvoid loop() {}\n")))
+	require.NoError(t, checkSketchMainFile(renamed))
+
+	// PlatformIO-style folder without a main .ino
+	pio := paths.New(t.TempDir()).Join("project")
+	require.NoError(t, pio.Join("src").MkdirAll())
+	require.NoError(t, pio.Join("src", "main.cpp").WriteFile([]byte("int main() {}\n")))
+	require.EqualError(t, checkSketchMainFile(pio), pio.String()+" is not an Arduino sketch: there is no .ino file in the folder, language features are not available")
+}
+
+func TestFindPreprocessedSketch(t *testing.T) {
+	ls, _, cppURI := newTestSketchServer(t)
+	cpp, err := findPreprocessedSketch(ls.buildSketchRoot)
+	require.NoError(t, err)
+	require.Equal(t, cppURI.AsPath().String(), cpp.String())
+
+	_, err = findPreprocessedSketch(paths.New(t.TempDir()))
+	require.Error(t, err)
+}
+
+func TestSketchFolderNameDifferentFromMainFile(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+
+	// The sketch folder has been opened as "sketch-folder" but the main file is Sketch.ino
+	ls.sketchName = "sketch-folder"
+	ls.buildSketchCpp = ls.buildSketchRoot.Join("sketch-folder.ino.cpp")
+	require.False(t, ls.clangURIRefersToIno(cppURI))
+
+	require.NoError(t, ls.updateBuildSketchCpp(testLogger()))
+	require.Equal(t, "Sketch", ls.sketchName)
+	require.True(t, ls.clangURIRefersToIno(cppURI))
+	clangURI, _, err := ls.ide2ClangDocumentURI(testLogger(), inoURI)
+	require.NoError(t, err)
+	require.Equal(t, cppURI, clangURI)
+}
+
+func TestFullTextDidChange(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	clangdIn := newTestClangdClient(ls)
+
+	helper := ls.sketchRoot.Join("helper.cpp")
+	helperURI := lsp.NewDocumentURIFromPath(helper)
+	require.NoError(t, helper.WriteFile([]byte("int helper() {\n  return 1;\n}\n")))
+	require.NoError(t, ls.buildSketchRoot.Join("helper.cpp").WriteFile([]byte("#line 1\nint helper() {\n  return 1;\n}\n")))
+	ls.trackedIdeDocs[helper.String()] = lsp.TextDocumentItem{URI: helperURI, LanguageID: "cpp", Version: 1, Text: "int helper() {\n  return 1;\n}\n"}
+
+	change := func(uri lsp.DocumentURI, text string) {
+		ls.textDocumentDidChangeNotifFromIDE(testLogger(), &lsp.DidChangeTextDocumentParams{
+			TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: 2},
+			ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: text}},
+		})
+	}
+
+	newInoText := "\nvoid setup() {\n  int used = 1;\n  used++;\n}\n\nvoid loop() {\n}\n"
+	change(inoURI, newInoText)
+	require.Equal(t, newInoText, ls.trackedIdeDocs[inoURI.AsPath().String()].Text)
+	require.Contains(t, ls.sketchMapper.CppText.Text, "  int used = 1;\n  used++;\n}")
+	require.NotContains(t, ls.sketchMapper.CppText.Text, "unused")
+	require.Contains(t, clangdIn.String(), `"uri":"`+cppURI.String()+`"`)
+
+	change(helperURI, "int helper() {\n  return 2;\n}\n")
+	require.Equal(t, "int helper() {\n  return 2;\n}\n", ls.trackedIdeDocs[helper.String()].Text)
+	require.Equal(t, 2, strings.Count(clangdIn.String(), `"textDocument/didChange"`))
+	require.Contains(t, clangdIn.String(), `{"start":{"line":1,"character":0},"end":{"line":4,"character":0}}`)
+
+	// The end of the replaced range is in UTF-16 code units and the changes
+	// sent by the IDE are left untouched
+	change(helperURI, "int helper() {\n  return 3;\n} // èè😀")
+	params := &lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: helperURI}, Version: 3},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: "int helper();\n"}},
+	}
+	ls.textDocumentDidChangeNotifFromIDE(testLogger(), params)
+	require.Nil(t, params.ContentChanges[0].Range)
+	require.Equal(t, "int helper();\n", ls.trackedIdeDocs[helper.String()].Text)
+	require.Contains(t, clangdIn.String(), `{"start":{"line":1,"character":0},"end":{"line":3,"character":9}}`)
+
+	// The sketch mapper replaces the whole last line too
+	inoDoc := ls.trackedIdeDocs[inoURI.AsPath().String()]
+	inoDoc.Text = "void setup() {}\nvoid loop() {} // èè"
+	ls.trackedIdeDocs[inoURI.AsPath().String()] = inoDoc
+	ls.sketchMapper = sourcemapper.CreateInoMapper([]byte("#include <Arduino.h>\n#line 1 " + strconv.Quote(inoURI.AsPath().String()) + "\n" + inoDoc.Text))
+	change(inoURI, "void setup() {}\nvoid loop() {}\n")
+	require.NotContains(t, ls.sketchMapper.CppText.Text, "è")
+	require.True(t, strings.HasSuffix(ls.sketchMapper.CppText.Text, "\nvoid setup() {}\nvoid loop() {}\n"))
+}
+
+func TestHoverWithFakeClangd(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	fake := &fakeClangdConn{
+		hover: func(*lsp.HoverParams) *lsp.Hover {
+			return &lsp.Hover{
+				Contents: lsp.MarkupContent{Kind: lsp.MarkupKindMarkdown, Value: "variable `unused`"},
+				Range: &lsp.Range{
+					Start: lsp.Position{Line: 10, Character: 6},
+					End:   lsp.Position{Line: 10, Character: 12},
+				},
+			}
+		},
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+
+	hover, respErr := ls.textDocumentHoverReqFromIDE(context.Background(), testLogger(), &lsp.HoverParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Position:     lsp.Position{Line: 2, Character: 8},
+		},
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, cppURI, fake.hoverParams.TextDocument.URI)
+	require.Equal(t, lsp.Position{Line: 10, Character: 8}, fake.hoverParams.Position)
+	require.Equal(t, "variable `unused`", hover.Contents.Value)
+	require.Equal(t, &lsp.Range{
+		Start: lsp.Position{Line: 2, Character: 6},
+		End:   lsp.Position{Line: 2, Character: 12},
+	}, hover.Range)
+}
+
+func TestHoverOnPreprocessedSection(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	var hoverRange *lsp.Range
+	fake := &fakeClangdConn{
+		hover: func(*lsp.HoverParams) *lsp.Hover {
+			return &lsp.Hover{
+				Contents: lsp.MarkupContent{Kind: lsp.MarkupKindMarkdown, Value: "function `setup`"},
+				Range:    hoverRange,
+			}
+		},
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	hover := func() *lsp.Hover {
+		res, respErr := ls.textDocumentHoverReqFromIDE(context.Background(), testLogger(), &lsp.HoverParams{
+			TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+				TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+				Position:     lsp.Position{Line: 1, Character: 6},
+			},
+		})
+		require.Nil(t, respErr)
+		return res
+	}
+
+	// The range refers to the generated prototype
+	hoverRange = &lsp.Range{
+		Start: lsp.Position{Line: 5, Character: 5},
+		End:   lsp.Position{Line: 5, Character: 10},
+	}
+	require.Nil(t, hover())
+
+	// No range: the hover is shown
+	hoverRange = nil
+	res := hover()
+	require.NotNil(t, res)
+	require.Nil(t, res.Range)
+	require.Equal(t, "function `setup`", res.Contents.Value)
+
+	// The symbol is defined only in the generated prototypes
+	fake.definition = []lsp.Location{{
+		URI:   cppURI,
+		Range: lsp.Range{Start: lsp.Position{Line: 5, Character: 5}, End: lsp.Position{Line: 5, Character: 10}},
+	}}
+	require.Nil(t, hover())
+
+	// The symbol is defined in the sketch
+	fake.definition[0].Range = lsp.Range{Start: lsp.Position{Line: 9, Character: 5}, End: lsp.Position{Line: 9, Character: 10}}
+	require.NotNil(t, hover())
+}
+
+func TestSignatureHelpInSecondaryTab(t *testing.T) {
+	ls, _, cppURI := newTestSketchServer(t)
+
+	// Add a second tab to the sketch, with a function called from it
+	tab := ls.sketchRoot.Join("Tab.ino")
+	tabText := "void blink(int pin, int times) {\n}\n\nvoid test() {\n  blink(13, 2);\n}\n"
+	require.NoError(t, tab.WriteFile([]byte(tabText)))
+	tabURI := lsp.NewDocumentURIFromPath(tab)
+	ls.trackedIdeDocs[tab.String()] = lsp.TextDocumentItem{URI: tabURI, LanguageID: "cpp", Version: 1, Text: tabText}
+	cppText, err := ls.buildSketchCpp.ReadFile()
+	require.NoError(t, err)
+	cppText = append(cppText, []byte("#line 1 "+strconv.Quote(tab.String())+"\n"+tabText)...)
+	require.NoError(t, ls.buildSketchCpp.WriteFile(cppText))
+	ls.sketchMapper = sourcemapper.CreateInoMapper(cppText)
+
+	activeParameter := 1
+	activeSignature := 0
+	clangSignatureHelp := &lsp.SignatureHelp{
+		Signatures: []lsp.SignatureInformation{{
+			Label:         "blink(int pin, int times) -> void",
+			Documentation: json.RawMessage(`"Blinks the led"`),
+			Parameters: []lsp.ParameterInformation{
+				{Label: json.RawMessage(`[6,13]`)},
+				{Label: json.RawMessage(`[15,24]`)},
+			},
+		}},
+		ActiveSignature: &activeSignature,
+		ActiveParameter: &activeParameter,
+	}
+	fake := &fakeClangdConn{
+		signatureHelp: func(*lsp.SignatureHelpParams) *lsp.SignatureHelp { return clangSignatureHelp },
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+
+	res, respErr := ls.textDocumentSignatureHelpReqFromIDE(context.Background(), testLogger(), &lsp.SignatureHelpParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: tabURI},
+			Position:     lsp.Position{Line: 4, Character: 12},
+		},
+	})
+	require.Nil(t, respErr)
+
+	// The request is forwarded on the corresponding line of the preprocessed sketch...
+	require.Equal(t, cppURI, fake.signatureHelpParams.TextDocument.URI)
+	cppLine, ok := ls.sketchMapper.InoToCppLineOk(tabURI, 4)
+	require.True(t, ok)
+	require.Equal(t, lsp.Position{Line: cppLine, Character: 12}, fake.signatureHelpParams.Position)
+
+	// ...and the response is returned as is
+	require.Equal(t, clangSignatureHelp, res)
+	require.Equal(t, "int times", signatureParameterLabel(res.Signatures[0].Label, res.Signatures[0].Parameters[*res.ActiveParameter].Label))
+}
+
+func TestNonEmptyClangdResponses(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	ls.config.DisableFormatOverride = true
+	cppRange := lsp.Range{Start: lsp.Position{Line: 10, Character: 6}, End: lsp.Position{Line: 10, Character: 12}}
+	inoRange := lsp.Range{Start: lsp.Position{Line: 2, Character: 6}, End: lsp.Position{Line: 2, Character: 12}}
+	fake := &fakeClangdConn{}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	ctx := context.Background()
+
+	t.Run("DocumentHighlight", func(t *testing.T) {
+		params := &lsp.DocumentHighlightParams{
+			TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+				TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+				Position:     inoRange.Start,
+			},
+		}
+		fake.highlights = nil
+		res, respErr := ls.textDocumentDocumentHighlightReqFromIDE(ctx, testLogger(), params)
+		require.Nil(t, respErr)
+		require.Nil(t, res)
+
+		fake.highlights = []lsp.DocumentHighlight{{Range: cppRange, Kind: lsp.DocumentHighlightKindWrite}}
+		res, respErr = ls.textDocumentDocumentHighlightReqFromIDE(ctx, testLogger(), params)
+		require.Nil(t, respErr)
+		require.Equal(t, []lsp.DocumentHighlight{{Range: inoRange, Kind: lsp.DocumentHighlightKindWrite}}, res)
+	})
+
+	t.Run("CodeAction", func(t *testing.T) {
+		params := &lsp.CodeActionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Range:        inoRange,
+		}
+		fake.codeActions = nil
+		res, respErr := ls.textDocumentCodeActionReqFromIDE(ctx, testLogger(), params)
+		require.Nil(t, respErr)
+		require.Empty(t, res)
+
+		var clangItem lsp.CommandOrCodeAction
+		clangItem.Set(lsp.CodeAction{
+			Title: "remove unused variable",
+			Kind:  lsp.CodeActionKindQuickFix,
+			Edit: &lsp.WorkspaceEdit{
+				Changes: map[lsp.DocumentURI][]lsp.TextEdit{cppURI: {{Range: cppRange}}},
+			},
+		})
+		fake.codeActions = []lsp.CommandOrCodeAction{clangItem}
+		res, respErr = ls.textDocumentCodeActionReqFromIDE(ctx, testLogger(), params)
+		require.Nil(t, respErr)
+		require.Len(t, res, 1)
+		ideCodeAction, ok := res[0].Get().(lsp.CodeAction)
+		require.True(t, ok)
+		require.Equal(t, "remove unused variable", ideCodeAction.Title)
+		require.Equal(t, []lsp.TextEdit{{Range: inoRange}}, ideCodeAction.Edit.Changes[inoURI])
+	})
+
+	t.Run("RangeFormatting", func(t *testing.T) {
+		params := &lsp.DocumentRangeFormattingParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Range:        inoRange,
+		}
+		fake.rangeFormatting = nil
+		res, respErr := ls.textDocumentRangeFormattingReqFromIDE(ctx, testLogger(), params)
+		require.Nil(t, respErr)
+		require.Nil(t, res)
+
+		fake.rangeFormatting = []lsp.TextEdit{{Range: cppRange, NewText: "used"}}
+		res, respErr = ls.textDocumentRangeFormattingReqFromIDE(ctx, testLogger(), params)
+		require.Nil(t, respErr)
+		require.Equal(t, []lsp.TextEdit{{Range: inoRange, NewText: "used"}}, res)
+	})
+}
+
+func TestInitializeTwice(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	sketchRoot := ls.sketchRoot
+	otherRoot := lsp.NewDocumentURIFromPath(paths.New(t.TempDir()))
+	ls.initialized = true
+
+	// The first initialize is still in progress
+	res, respErr := ls.initializeReqFromIDE(context.Background(), testLogger(), &lsp.InitializeParams{RootURI: otherRoot})
+	require.Nil(t, res)
+	require.NotNil(t, respErr)
+	require.Equal(t, jsonrpc.ErrorCodesInvalidRequest, respErr.Code)
+	require.Equal(t, sketchRoot, ls.sketchRoot)
+
+	// The first initialize is done: its result is returned again
+	ls.initializeResult = &lsp.InitializeResult{ServerInfo: &lsp.InitializeResultServerInfo{Name: "arduino-language-server"}}
+	res, respErr = ls.initializeReqFromIDE(context.Background(), testLogger(), &lsp.InitializeParams{RootURI: otherRoot})
+	require.Nil(t, respErr)
+	require.Same(t, ls.initializeResult, res)
+	require.Equal(t, sketchRoot, ls.sketchRoot)
+}
+
+func TestStatusBeforeInitialize(t *testing.T) {
+	ls := &INOLanguageServer{config: &Config{Fqbn: "arduino:avr:uno"}}
+	status, respErr := ls.statusReqFromIDE(context.Background(), testLogger())
+	require.Nil(t, respErr)
+	require.False(t, status.ClangdRunning)
+	require.Equal(t, "arduino:avr:uno", status.Fqbn)
+	require.Empty(t, status.SketchRoot)
+	require.Empty(t, status.BuildPath)
+
+	ls, _, _ = newTestSketchServer(t)
+	status, respErr = ls.statusReqFromIDE(context.Background(), testLogger())
+	require.Nil(t, respErr)
+	require.Equal(t, ls.sketchRoot.String(), status.SketchRoot)
+}
+
+func TestMissingInitializedNotification(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ls.config.DiagnosticsMode = DiagnosticsModePull
+	ls.ideDiagnosticRegistration.Store(true)
+	ideOut := newTestIDEConnection(ls)
+
+	// The client doesn't send the initialized notification: the pull
+	// diagnostics are registered anyway after the timeout
+	ls.waitInitializedNotification(testLogger(), 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return strings.Contains(ideOut.String(), "client/registerCapability")
+	}, 5*time.Second, 10*time.Millisecond, "pull diagnostics not registered")
+
+	// A late initialized notification doesn't register them again
+	ideOut.Reset()
+	ls.initializedNotifFromIDE(testLogger(), &lsp.InitializedParams{})
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, ideOut.String())
+}
+
+func TestSetSketchRoot(t *testing.T) {
+	tmp := paths.New(t.TempDir()).Canonical()
+	for _, sketchName := range []string{"Sketch", "My Sketch", "Skétch ✓"} {
+		sketchRoot := tmp.Join(sketchName)
+		require.NoError(t, sketchRoot.MkdirAll())
+		encoded := lsp.NewDocumentURIFromPath(sketchRoot).String()
+
+		for _, rootURI := range []string{encoded, encoded + "/"} {
+			uri, err := lsp.NewDocumentURIFromURL(rootURI)
+			require.NoError(t, err)
+			ls := &INOLanguageServer{buildSketchRoot: tmp.Join("build", "sketch")}
+			ls.setSketchRoot(uri)
+			require.Equal(t, sketchRoot.String(), ls.sketchRoot.String(), rootURI)
+			require.Equal(t, sketchName, ls.sketchName, rootURI)
+			require.Equal(t, sketchName+".ino.cpp", ls.buildSketchCpp.Base(), rootURI)
+
+			// The preprocessed sketch URIs sent by clangd are recognized
+			require.True(t, ls.clangURIRefersToIno(lsp.NewDocumentURIFromPath(ls.buildSketchCpp)), rootURI)
+			require.True(t, ls.ideURIIsPartOfTheSketch(lsp.NewDocumentURIFromPath(sketchRoot.Join(sketchName+".ino"))), rootURI)
+		}
+	}
+}
+
+func TestClientCapabilitiesSummary(t *testing.T) {
+	params := &lsp.InitializeParams{}
+	require.Equal(t,
+		"client=unknown snippets=no semanticTokens=no workspaceFolders=no (0 folders) workDoneProgress=no",
+		clientCapabilitiesSummary(params))
+
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"processId": 1,
+		"clientInfo": {"name": "Visual Studio Code", "version": "1.90.0"},
+		"rootUri": "file:///tmp/Sketch",
+		"capabilities": {
+			"textDocument": {
+				"completion": {"completionItem": {"snippetSupport": true}},
+				"semanticTokens": {"requests": {"full": {"delta": true}}, "tokenTypes": [], "tokenModifiers": [], "formats": ["relative"]}
+			},
+			"workspace": {"workspaceFolders": true},
+			"window": {"workDoneProgress": true}
+		},
+		"workspaceFolders": [{"uri": "file:///tmp/Sketch", "name": "Sketch"}]
+	}`), params))
+	require.Equal(t,
+		"client=Visual Studio Code 1.90.0 snippets=yes semanticTokens=yes workspaceFolders=yes (1 folders) workDoneProgress=yes",
+		clientCapabilitiesSummary(params))
+}
+
+func TestHoverShowSourceLocation(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	fake := &fakeClangdConn{
+		hover: func(*lsp.HoverParams) *lsp.Hover {
+			return &lsp.Hover{Contents: lsp.MarkupContent{Kind: lsp.MarkupKindMarkdown, Value: "variable `unused`"}}
+		},
+		definition: []lsp.Location{{
+			URI:   cppURI,
+			Range: lsp.Range{Start: lsp.Position{Line: 10, Character: 6}, End: lsp.Position{Line: 10, Character: 12}},
+		}},
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	hover := func() string {
+		res, respErr := ls.textDocumentHoverReqFromIDE(context.Background(), testLogger(), &lsp.HoverParams{
+			TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+				TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+				Position:     lsp.Position{Line: 2, Character: 6},
+			},
+		})
+		require.Nil(t, respErr)
+		if res == nil {
+			return ""
+		}
+		return res.Contents.Value
+	}
+
+	require.Equal(t, "variable `unused`", hover())
+
+	ls.config.HoverShowSourceLocation = true
+	require.Equal(t, "variable `unused`\n\n---\nDefined in `Sketch.ino:3`", hover())
+
+	// Definitions outside of the sketch are not shown
+	fake.definition[0] = lsp.Location{URI: lsp.NewDocumentURI("/usr/include/stdio.h")}
+	require.Equal(t, "variable `unused`", hover())
+}
+
+func TestReloadConfig(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake arduino-cli is a shell script")
+	}
+	ls, _, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	tmp := paths.New(t.TempDir()).Canonical()
+	dataFolder := tmp.Join("data")
+	require.NoError(t, dataFolder.MkdirAll())
+	cli := tmp.Join("arduino-cli")
+	require.NoError(t, cli.WriteFile([]byte("#!/bin/sh\necho '"+strconv.Quote(dataFolder.String())+"'\n")))
+	require.NoError(t, os.Chmod(cli.String(), 0755))
+	ls.config.CliPath = cli
+	ls.config.CliConfigPath = tmp.Join("arduino-cli.yaml")
+
+	res, respErr := ls.reloadConfigReqFromIDE(context.Background(), testLogger())
+	require.Nil(t, respErr)
+	require.Equal(t, dataFolder.String(), res.DataFolder)
+	require.Equal(t, dataFolder, ls.clangdDataFolder)
+	require.False(t, res.ClangdRestarted)
+	require.NotNil(t, ls.Clangd)
+
+	// A full rebuild has been scheduled
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+	require.True(t, ls.sketchRebuilder.fullBuildRequested.Load())
+
+	// The data folder changed: clangd is restarted by the next request
+	ls.clangdDataFolder = tmp.Join("old-data")
+	res, respErr = ls.reloadConfigReqFromIDE(context.Background(), testLogger())
+	require.Nil(t, respErr)
+	require.True(t, res.ClangdRestarted)
+	require.Nil(t, ls.Clangd)
+	require.True(t, ls.clangdStoppedForInactivity)
+	require.Equal(t, dataFolder, ls.clangdDataFolder)
+}
+
+func TestReadPreprocessedSketch(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	cpp := tmp.Join("Sketch.ino.cpp")
+	require.NoError(t, cpp.WriteFile([]byte("void setup() {}\n")))
+	data, err := readPreprocessedSketch(cpp)
+	require.NoError(t, err)
+	require.Equal(t, "void setup() {}\n", string(data))
+
+	// Too big
+	defer func(max int64) { maxPreprocessedSketchSize = max }(maxPreprocessedSketchSize)
+	maxPreprocessedSketchSize = 10
+	_, err = readPreprocessedSketch(cpp)
+	require.ErrorContains(t, err, "too big")
+	maxPreprocessedSketchSize = 1024
+
+	// Not a file
+	_, err = readPreprocessedSketch(tmp)
+	require.ErrorContains(t, err, "not a regular file")
+	_, err = readPreprocessedSketch(tmp.Join("missing.ino.cpp"))
+	require.Error(t, err)
+
+	// Symlink loop
+	loop1, loop2 := tmp.Join("loop1.ino.cpp"), tmp.Join("loop2.ino.cpp")
+	if os.Symlink(loop2.String(), loop1.String()) == nil && os.Symlink(loop1.String(), loop2.String()) == nil {
+		_, err = readPreprocessedSketch(loop1)
+		require.Error(t, err)
+	}
+}
+
+func TestRebuildIgnoreMatch(t *testing.T) {
+	patterns := []string{"data/", "*.md", "assets/*.png"}
+	require.True(t, rebuildIgnoreMatch(patterns, "data/index.html"))
+	require.True(t, rebuildIgnoreMatch(patterns, "data/www/style.css"))
+	require.True(t, rebuildIgnoreMatch(patterns, "README.md"))
+	require.True(t, rebuildIgnoreMatch(patterns, "docs/notes.md"))
+	require.True(t, rebuildIgnoreMatch(patterns, "assets/logo.png"))
+	require.False(t, rebuildIgnoreMatch(patterns, "assets/logo.h"))
+	require.False(t, rebuildIgnoreMatch(patterns, "src/data.h"))
+	require.False(t, rebuildIgnoreMatch(patterns, "Sketch.ino"))
+	require.False(t, rebuildIgnoreMatch(nil, "data/index.html"))
+}
+
+func TestRebuildIgnore(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	ls.config.RebuildIgnore = []string{"data"}
+	assetURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("data", "index.html"))
+
+	ls.textDocumentDidSaveNotifFromIDE(testLogger(), &lsp.DidSaveTextDocumentParams{TextDocument: lsp.TextDocumentIdentifier{URI: assetURI}})
+	require.Len(t, ls.sketchRebuilder.trigger, 0)
+
+	ls.textDocumentDidSaveNotifFromIDE(testLogger(), &lsp.DidSaveTextDocumentParams{TextDocument: lsp.TextDocumentIdentifier{URI: inoURI}})
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+}
+
+func TestDidCloseClearsDiagnostics(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	ls.Clangd = &clangdLSPClient{conn: &fakeClangdConn{}, ls: ls}
+	helperURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("helper.cpp"))
+	outsideURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Parent().Join("Other", "other.cpp"))
+	unused := lsp.Diagnostic{Message: "unused variable 'unused'"}
+	for _, uri := range []lsp.DocumentURI{inoURI, helperURI, outsideURI} {
+		ls.trackedIdeDocs[uri.AsPath().String()] = lsp.TextDocumentItem{URI: uri, LanguageID: "cpp"}
+	}
+	ls.ideDocsDiagnostics = map[lsp.DocumentURI][]lsp.Diagnostic{
+		inoURI:     {unused},
+		helperURI:  {unused},
+		outsideURI: {unused},
+	}
+	closeDoc := func(uri lsp.DocumentURI) {
+		ls.textDocumentDidCloseNotifFromIDE(testLogger(), &lsp.DidCloseTextDocumentParams{TextDocument: lsp.TextDocumentIdentifier{URI: uri}})
+	}
+
+	// The diagnostics of the sketch files are kept by configuration...
+	ls.config.KeepClosedDocsDiagnostics = true
+	closeDoc(helperURI)
+	require.Contains(t, ls.ideDocsDiagnostics, helperURI)
+	// ...but not the ones of the other files
+	closeDoc(outsideURI)
+	require.NotContains(t, ls.ideDocsDiagnostics, outsideURI)
+
+	ls.config.KeepClosedDocsDiagnostics = false
+	closeDoc(inoURI)
+	require.NotContains(t, ls.ideDocsDiagnostics, inoURI)
+}
+
+func TestDidCloseLastInoClosesSketchDocs(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	clangd := &fakeClangdConn{}
+	ls.Clangd = &clangdLSPClient{conn: clangd, ls: ls}
+	helperURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Join("helper.cpp"))
+	outsideURI := lsp.NewDocumentURIFromPath(ls.sketchRoot.Parent().Join("Other", "other.cpp"))
+	ls.trackedIdeDocs[helperURI.AsPath().String()] = lsp.TextDocumentItem{URI: helperURI, LanguageID: "cpp"}
+	ls.trackedIdeDocs[outsideURI.AsPath().String()] = lsp.TextDocumentItem{URI: outsideURI, LanguageID: "cpp"}
+	ls.sketchTrackedFilesCount = 1
+
+	helperClangURI := lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("helper.cpp"))
+	ls.textDocumentDidCloseNotifFromIDE(testLogger(), &lsp.DidCloseTextDocumentParams{TextDocument: lsp.TextDocumentIdentifier{URI: inoURI}})
+	require.Equal(t, []lsp.DocumentURI{cppURI, helperClangURI}, clangd.closed)
+	require.Contains(t, ls.trackedIdeDocs, helperURI.AsPath().String())
+	require.Contains(t, ls.trackedIdeDocs, outsideURI.AsPath().String())
+
+	// The helper is still open in the IDE: the changes are tracked, not sent to clangd
+	ls.textDocumentDidChangeNotifFromIDE(testLogger(), &lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: helperURI}, Version: 1},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Range: &lsp.Range{}, Text: "int x;\n"}},
+	})
+	require.Equal(t, "int x;\n", ls.trackedIdeDocs[helperURI.AsPath().String()].Text)
+	require.Empty(t, clangd.changed)
+
+	// Reopening the sketch sends the helper to clangd again
+	ls.textDocumentDidOpenNotifFromIDE(testLogger(), &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: inoURI, LanguageID: "ino", Version: 2, Text: "void setup() {}\nvoid loop() {}\n"},
+	})
+	require.Len(t, clangd.opened, 2)
+	require.Equal(t, cppURI, clangd.opened[0].URI)
+	require.Equal(t, helperClangURI, clangd.opened[1].URI)
+	require.False(t, ls.sketchDocsClosedInClangd)
+
+	// And closes it when it's closed in the IDE
+	ls.textDocumentDidCloseNotifFromIDE(testLogger(), &lsp.DidCloseTextDocumentParams{TextDocument: lsp.TextDocumentIdentifier{URI: helperURI}})
+	require.Equal(t, []lsp.DocumentURI{cppURI, helperClangURI, helperClangURI}, clangd.closed)
+	require.NotContains(t, ls.trackedIdeDocs, helperURI.AsPath().String())
+}
+
+func TestUntrackedIdeDocument(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	file := tmp.Join("helper.c")
+	require.NoError(t, file.WriteFile([]byte("int x;\n")))
+	uri := lsp.NewDocumentURIFromPath(file)
+	rangeChange := lsp.TextDocumentContentChangeEvent{Range: &lsp.Range{}, Text: "// "}
+
+	doc, err := untrackedIdeDocument(&lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: 3},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{rangeChange},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "int x;\n", doc.Text)
+	require.Equal(t, "c", doc.LanguageID)
+	require.Equal(t, 2, doc.Version)
+
+	// A full text change does not need the content on disk
+	missingURI := lsp.NewDocumentURIFromPath(tmp.Join("missing.cpp"))
+	doc, err = untrackedIdeDocument(&lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: missingURI}, Version: 1},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: "int y;\n"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "", doc.Text)
+	require.Equal(t, "cpp", doc.LanguageID)
+
+	_, err = untrackedIdeDocument(&lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: missingURI}, Version: 1},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{rangeChange},
+	})
+	require.Error(t, err)
+}
+
+func TestDidChangeTracksUntrackedDocument(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	clangd := &fakeClangdConn{}
+	ls.Clangd = &clangdLSPClient{conn: clangd, ls: ls}
+	helper := ls.sketchRoot.Join("helper.cpp")
+	require.NoError(t, helper.WriteFile([]byte("int x;\n")))
+	require.NoError(t, ls.buildSketchRoot.Join("helper.cpp").WriteFile([]byte("int x;\n")))
+	helperURI := lsp.NewDocumentURIFromPath(helper)
+
+	ls.textDocumentDidChangeNotifFromIDE(testLogger(), &lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: helperURI}, Version: 2},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{
+			{Range: &lsp.Range{Start: lsp.Position{Line: 0, Character: 4}, End: lsp.Position{Line: 0, Character: 5}}, Text: "y"},
+		},
+	})
+	require.Equal(t, "int y;\n", ls.trackedIdeDocs[helper.String()].Text)
+	require.Len(t, clangd.opened, 1)
+	require.Equal(t, "int x;\n", clangd.opened[0].Text)
+	require.Len(t, clangd.changed, 1)
+	require.Equal(t, "y", clangd.changed[0].ContentChanges[0].Text)
+}
+
+func TestSelectedBoard(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	ls.config.Fqbn = "arduino:avr:uno"
+
+	_, respErr := ls.selectedBoardReqFromIDE(context.Background(), testLogger(), &ArduinoSelectedBoardParams{Fqbn: "arduino:avr"})
+	require.NotNil(t, respErr)
+	require.Equal(t, "arduino:avr:uno", ls.config.Fqbn)
+
+	// Simulate the rebuild, the logger is created before starting the goroutine
+	// because it resets the color settings
+	buildLogger := testLogger()
+	buildResult := make(chan bool)
+	go func() {
+		for success := range buildResult {
+			<-ls.sketchRebuilder.trigger
+			ls.writeLock(buildLogger, false)
+			ls.lastBuildSucceeded = success
+			ls.writeUnlock(buildLogger)
+			for _, completed := range ls.sketchRebuilder.takePendingCompleted() {
+				close(completed)
+			}
+		}
+	}()
+	defer close(buildResult)
+
+	buildResult <- true
+	res, respErr := ls.selectedBoardReqFromIDE(context.Background(), testLogger(), &ArduinoSelectedBoardParams{Fqbn: "arduino:avr:mega"})
+	require.Nil(t, respErr)
+	require.True(t, res.Success)
+	require.Equal(t, "arduino:avr:mega", ls.config.Fqbn)
+
+	buildResult <- false
+	res, respErr = ls.selectedBoardReqFromIDE(context.Background(), testLogger(), &ArduinoSelectedBoardParams{Fqbn: "esp32:esp32:esp32"})
+	require.Nil(t, respErr)
+	require.False(t, res.Success)
+	require.Contains(t, res.Message, "esp32:esp32:esp32")
+}
+
+func TestCompileCommandsPathRegenerate(t *testing.T) {
+	// Before the initialize request the request fails without waiting for clangd
+	ls := &INOLanguageServer{config: &Config{}}
+	_, respErr := ls.compileCommandsPathReqFromIDE(context.Background(), testLogger(), &ArduinoCompileCommandsPathParams{Regenerate: true})
+	require.NotNil(t, respErr)
+
+	ls, _, _ = newTestSketchServer(t)
+	newTestClangdClient(ls)
+	ls.Clangd = nil
+	ls.buildPath = ls.buildSketchRoot.Parent()
+	require.NoError(t, ls.buildPath.Join("compile_commands.json").WriteFile([]byte("[]")))
+
+	// The regeneration doesn't need clangd
+	go func() {
+		<-ls.sketchRebuilder.trigger
+		for _, completed := range ls.sketchRebuilder.takePendingCompleted() {
+			close(completed)
+		}
+	}()
+	res, respErr := ls.compileCommandsPathReqFromIDE(context.Background(), testLogger(), &ArduinoCompileCommandsPathParams{Regenerate: true})
+	require.Nil(t, respErr)
+	require.True(t, res.Exists)
+	require.Equal(t, ls.buildPath.Join("compile_commands.json").String(), res.Path)
+}
+
+func TestSelectedBoardNotification(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	ls.config.Fqbn = "arduino:avr:uno"
+
+	ls.selectedBoardNotifFromIDE(testLogger(), &ArduinoSelectedBoardParams{Fqbn: "invalid"})
+	require.Equal(t, "arduino:avr:uno", ls.config.Fqbn)
+	require.Len(t, ls.sketchRebuilder.trigger, 0)
+
+	ls.selectedBoardNotifFromIDE(testLogger(), &ArduinoSelectedBoardParams{Fqbn: "arduino:avr:nano:cpu=atmega328old"})
+	require.Equal(t, "arduino:avr:nano:cpu=atmega328old", ls.config.Fqbn)
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+}
+
+func TestDiagnosticsForDocument(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	newTestIDEConnection(ls)
+
+	res, respErr := ls.diagnosticsForDocumentReqFromIDE(context.Background(), testLogger(), &ArduinoDiagnosticsForDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, inoURI, res.URI)
+	require.NotNil(t, res.Diagnostics)
+	require.Empty(t, res.Diagnostics)
+
+	unused := lsp.Diagnostic{
+		Range:    lsp.Range{Start: lsp.Position{Line: 10, Character: 6}, End: lsp.Position{Line: 10, Character: 12}},
+		Severity: lsp.DiagnosticSeverityWarning,
+		Code:     json.RawMessage(`"-Wunused-variable"`),
+		Source:   "clang",
+		Message:  "unused variable 'unused'",
+	}
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Diagnostics: []lsp.Diagnostic{unused}})
+	res, respErr = ls.diagnosticsForDocumentReqFromIDE(context.Background(), testLogger(), &ArduinoDiagnosticsForDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.Nil(t, respErr)
+	require.Len(t, res.Diagnostics, 1)
+	require.Equal(t, 2, res.Diagnostics[0].Range.Start.Line)
+	require.Equal(t, "unused variable 'unused'", res.Diagnostics[0].Message)
+
+	// Diagnostics cleared by clangd are removed
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Diagnostics: []lsp.Diagnostic{}})
+	res, respErr = ls.diagnosticsForDocumentReqFromIDE(context.Background(), testLogger(), &ArduinoDiagnosticsForDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+	})
+	require.Nil(t, respErr)
+	require.Empty(t, res.Diagnostics)
+}
+
+func TestDiagnosticsVersion(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	ideOut := newTestIDEConnection(ls)
+
+	// The preprocessed sketch has its own versioning, independent from the .ino
+	ls.trackedIdeDocs[inoURI.AsPath().String()] = lsp.TextDocumentItem{URI: inoURI, LanguageID: "cpp", Version: 7}
+	ls.sketchMapper.CppText.Version = 3
+	ls.recordInoVersions()
+	ls.trackedIdeDocs[inoURI.AsPath().String()] = lsp.TextDocumentItem{URI: inoURI, LanguageID: "cpp", Version: 8}
+	ls.sketchMapper.CppText.Version = 4
+	ls.recordInoVersions()
+
+	unused := lsp.Diagnostic{
+		Range:    lsp.Range{Start: lsp.Position{Line: 10, Character: 6}, End: lsp.Position{Line: 10, Character: 12}},
+		Severity: lsp.DiagnosticSeverityWarning,
+		Message:  "unused variable 'unused'",
+	}
+	allIdeParams, err := ls.clang2IdeDiagnostics(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Version: 3, Diagnostics: []lsp.Diagnostic{unused}})
+	require.NoError(t, err)
+	require.Equal(t, 7, allIdeParams[inoURI].Version)
+
+	allIdeParams, err = ls.clang2IdeDiagnostics(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Version: 4})
+	require.NoError(t, err)
+	require.Equal(t, 8, allIdeParams[inoURI].Version)
+
+	// Unknown versions are not reported
+	allIdeParams, err = ls.clang2IdeDiagnostics(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Version: 5, Diagnostics: []lsp.Diagnostic{unused}})
+	require.NoError(t, err)
+	require.Equal(t, 0, allIdeParams[inoURI].Version)
+
+	// The other sketch files keep the version used by the IDE
+	helper := ls.sketchRoot.Join("helper.cpp")
+	require.NoError(t, helper.WriteFile([]byte("int helper;\n")))
+	allIdeParams, err = ls.clang2IdeDiagnostics(testLogger(), &lsp.PublishDiagnosticsParams{
+		URI:     lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("helper.cpp")),
+		Version: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, allIdeParams[lsp.NewDocumentURIFromPath(helper)].Version)
+
+	// The published diagnostics carry the .ino version
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Version: 4, Diagnostics: []lsp.Diagnostic{unused}})
+	require.Contains(t, ideOut.String(), `"version":8`)
+}
+
+func TestKeepClosedDocsDiagnostics(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	ideOut := newTestIDEConnection(ls)
+
+	helper := ls.sketchRoot.Join("helper.cpp")
+	require.NoError(t, helper.WriteFile([]byte("int helper() {}\n")))
+	clangHelperURI := lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("helper.cpp"))
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{
+		URI: clangHelperURI,
+		Diagnostics: []lsp.Diagnostic{{
+			Range:    lsp.Range{Start: lsp.Position{Line: 1, Character: 14}, End: lsp.Position{Line: 1, Character: 15}},
+			Severity: lsp.DiagnosticSeverityWarning,
+			Code:     json.RawMessage(`"-Wreturn-type"`),
+			Message:  "non-void function does not return a value",
+		}},
+	})
+	require.Contains(t, ideOut.String(), "non-void function does not return a value")
+
+	// helper.cpp is not open in the IDE: the diagnostics cleared by clangd
+	// after the didClose are kept...
+	ls.config.KeepClosedDocsDiagnostics = true
+	ideOut.Reset()
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: clangHelperURI, Diagnostics: []lsp.Diagnostic{}})
+	require.Empty(t, ideOut.String())
+
+	// ...unless the document is open
+	ls.trackedIdeDocs[helper.String()] = lsp.TextDocumentItem{URI: lsp.NewDocumentURIFromPath(helper), LanguageID: "cpp", Version: 1}
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: clangHelperURI, Diagnostics: []lsp.Diagnostic{}})
+	require.Contains(t, ideOut.String(), `"diagnostics":[]`)
+
+	// By default the diagnostics are cleared
+	delete(ls.trackedIdeDocs, helper.String())
+	ls.config.KeepClosedDocsDiagnostics = false
+	ideOut.Reset()
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: clangHelperURI, Diagnostics: []lsp.Diagnostic{}})
+	require.Contains(t, ideOut.String(), `"diagnostics":[]`)
+}
+
+func TestDefinitionInArduinoCore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not available")
+	}
+	ls, inoURI, cppURI := newTestSketchServer(t)
+
+	// An installed core, reachable through a symlinked data folder
+	tmp := paths.New(t.TempDir()).Canonical()
+	core := tmp.Join("Arduino15", "packages", "arduino", "hardware", "avr", "1.8.6", "cores", "arduino")
+	require.NoError(t, core.MkdirAll())
+	require.NoError(t, core.Join("wiring_digital.c").WriteFile([]byte("void digitalWrite(uint8_t pin, uint8_t val) {\n}\n")))
+	require.NoError(t, os.Symlink(tmp.Join("Arduino15").String(), tmp.Join("data").String()))
+	clangCorePath := tmp.Join("data", "packages", "arduino", "hardware", "avr", "1.8.6", "variants", "..", "cores", "arduino", "wiring_digital.c")
+
+	digitalWriteRange := lsp.Range{Start: lsp.Position{Line: 0, Character: 5}, End: lsp.Position{Line: 0, Character: 17}}
+	fake := &fakeClangdConn{
+		definition: []lsp.Location{{URI: lsp.NewDocumentURI(clangCorePath.String()), Range: digitalWriteRange}},
+	}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+
+	locations, _, respErr := ls.textDocumentDefinitionReqFromIDE(context.Background(), testLogger(), &lsp.DefinitionParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Position:     lsp.Position{Line: 2, Character: 2},
+		},
+	})
+	require.Nil(t, respErr)
+	require.Equal(t, []lsp.Location{{
+		URI:   lsp.NewDocumentURIFromPath(core.Join("wiring_digital.c")),
+		Range: digitalWriteRange,
+	}}, locations)
+
+	// The location links are converted too
+	links, err := ls.clang2IdeLocationLinksArray(testLogger(), cppURI, []lsp.LocationLink{{
+		TargetUri:            lsp.NewDocumentURI(clangCorePath.String()),
+		TargetRange:          digitalWriteRange,
+		TargetSelectionRange: digitalWriteRange,
+	}})
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	require.Equal(t, lsp.NewDocumentURIFromPath(core.Join("wiring_digital.c")), links[0].TargetUri)
+}
+
+func TestSymlinkedSketchRoot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not available")
+	}
+	ls, _, cppURI := newTestSketchServer(t)
+
+	// The IDE opens the sketch through a symlink
+	link := paths.New(t.TempDir()).Join("Sketch")
+	require.NoError(t, os.Symlink(ls.sketchRoot.String(), link.String()))
+	ls.setSketchRoot(lsp.NewDocumentURIFromPath(link))
+	require.Equal(t, ls.sketchRoot.Canonical().String(), ls.sketchRoot.String())
+
+	linkedInoURI := lsp.NewDocumentURIFromPath(link.Join("Sketch.ino"))
+	ls.trackedIdeDocs[linkedInoURI.AsPath().String()] = lsp.TextDocumentItem{URI: linkedInoURI, LanguageID: "cpp", Version: 1}
+	require.True(t, ls.ideURIIsPartOfTheSketch(linkedInoURI))
+	clangURI, _, err := ls.ide2ClangDocumentURI(testLogger(), linkedInoURI)
+	require.NoError(t, err)
+	require.Equal(t, cppURI, clangURI)
+	require.True(t, ls.clangURIRefersToIno(clangURI))
+
+	// Ranges are converted back to the document opened in the IDE
+	ideURI, ideRange, _, err := ls.clang2IdeRangeAndDocumentURI(testLogger(), cppURI, lsp.Range{
+		Start: lsp.Position{Line: 10, Character: 6},
+		End:   lsp.Position{Line: 10, Character: 12},
+	})
+	require.NoError(t, err)
+	require.Equal(t, linkedInoURI, ideURI)
+	require.Equal(t, 2, ideRange.Start.Line)
+
+	// A file not yet saved in the sketch folder is part of the sketch too
+	newFileURI := lsp.NewDocumentURIFromPath(link.Join("new.cpp"))
+	require.True(t, ls.ideURIIsPartOfTheSketch(newFileURI))
+	clangURI, _, err = ls.ide2ClangDocumentURI(testLogger(), newFileURI)
+	require.NoError(t, err)
+	require.Equal(t, lsp.NewDocumentURIFromPath(ls.buildSketchRoot.Join("new.cpp")), clangURI)
+}
@@ -16,11 +16,17 @@
 package ls
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/arduino/arduino-language-server/streams"
 	"github.com/arduino/go-paths-helper"
@@ -30,9 +36,53 @@ import (
 	"go.bug.st/lsp/jsonrpc"
 )
 
+// ClangdConn is the connection used to send messages to clangd. It's implemented
+// by *lsp.Client, the tests may replace it with a fake returning canned responses.
+type ClangdConn interface {
+	Run()
+	Exit() error
+	Initialize(ctx context.Context, param *lsp.InitializeParams) (*lsp.InitializeResult, *jsonrpc.ResponseError, error)
+	Initialized(param *lsp.InitializedParams) error
+	Shutdown(ctx context.Context) (*jsonrpc.ResponseError, error)
+	SetTrace(param *lsp.SetTraceParams) error
+	WindowWorkDoneProgressCancel(param *lsp.WorkDoneProgressCancelParams) error
+	TextDocumentDidOpen(param *lsp.DidOpenTextDocumentParams) error
+	TextDocumentDidChange(param *lsp.DidChangeTextDocumentParams) error
+	TextDocumentDidSave(param *lsp.DidSaveTextDocumentParams) error
+	TextDocumentDidClose(param *lsp.DidCloseTextDocumentParams) error
+	TextDocumentCompletion(ctx context.Context, param *lsp.CompletionParams) (*lsp.CompletionList, *jsonrpc.ResponseError, error)
+	TextDocumentHover(ctx context.Context, param *lsp.HoverParams) (*lsp.Hover, *jsonrpc.ResponseError, error)
+	TextDocumentSignatureHelp(ctx context.Context, param *lsp.SignatureHelpParams) (*lsp.SignatureHelp, *jsonrpc.ResponseError, error)
+	TextDocumentDefinition(ctx context.Context, param *lsp.DefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError, error)
+	TextDocumentTypeDefinition(ctx context.Context, param *lsp.TypeDefinitionParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError, error)
+	TextDocumentImplementation(ctx context.Context, param *lsp.ImplementationParams) ([]lsp.Location, []lsp.LocationLink, *jsonrpc.ResponseError, error)
+	TextDocumentDocumentHighlight(ctx context.Context, param *lsp.DocumentHighlightParams) ([]lsp.DocumentHighlight, *jsonrpc.ResponseError, error)
+	TextDocumentDocumentSymbol(ctx context.Context, param *lsp.DocumentSymbolParams) ([]lsp.DocumentSymbol, []lsp.SymbolInformation, *jsonrpc.ResponseError, error)
+	TextDocumentCodeAction(ctx context.Context, param *lsp.CodeActionParams) ([]lsp.CommandOrCodeAction, *jsonrpc.ResponseError, error)
+	TextDocumentFormatting(ctx context.Context, param *lsp.DocumentFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError, error)
+	TextDocumentRangeFormatting(ctx context.Context, param *lsp.DocumentRangeFormattingParams) ([]lsp.TextEdit, *jsonrpc.ResponseError, error)
+	TextDocumentRename(ctx context.Context, param *lsp.RenameParams) (*lsp.WorkspaceEdit, *jsonrpc.ResponseError, error)
+}
+
 type clangdLSPClient struct {
-	conn *lsp.Client
+	conn ClangdConn
 	ls   *INOLanguageServer
+
+	// stoppedForInactivity is set when clangd is closed by the idle timeout
+	stoppedForInactivity atomic.Bool
+}
+
+// clangdIndexPath returns the directory where clangd stores its cache and
+// background index: the one given in the configuration or, by default, a
+// folder in the temp directory of the language server, removed on exit.
+func (ls *INOLanguageServer) clangdIndexPath() *paths.Path {
+	if ls.config.ClangdIndexPath != nil {
+		return ls.config.ClangdIndexPath
+	}
+	if ls.tempDir == nil {
+		return nil
+	}
+	return ls.tempDir.Join("clangd-cache")
 }
 
 // newClangdLSPClient creates and returns a new client
@@ -42,6 +92,16 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 	clangdConf += fmt.Sprintln("  Suppress: [anon_bitfield_qualifiers]")
 	clangdConf += fmt.Sprintln("CompileFlags:")
 	clangdConf += fmt.Sprintln("  Add: -ferror-limit=0")
+	if ls.config.EnableClangdConfig && ls.sketchRoot != nil && ls.sketchRoot.Join(".clangd").Exist() {
+		// The sketch is built in the build path, where the .clangd in the
+		// sketch folder would be ignored: merge it with our configuration
+		if sketchConf, err := sketchClangdConfig(ls.sketchRoot); err != nil {
+			logger.Logf("Error reading sketch clangd configuration: %s", err)
+		} else {
+			logger.Logf("    using clangd configuration from the sketch folder")
+			clangdConf += sketchConf
+		}
+	}
 	if err := clangdConfFile.WriteFile([]byte(clangdConf)); err != nil {
 		logger.Logf("Error writing clangd configuration: %s", err)
 	}
@@ -52,6 +112,9 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 		"--pch-storage=memory",
 		fmt.Sprintf(`--compile-commands-dir=%s`, ls.buildPath),
 	}
+	if ls.config.EnableClangdConfig {
+		args = append(args, "--enable-config")
+	}
 	if jobs := ls.config.Jobs; jobs == -1 {
 		// default: limit parallel build jobs to 1
 		args = append(args, "-j", "1")
@@ -72,6 +135,18 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 		extraEnv = append(extraEnv, "TMPDIR="+ls.tempDir.String()) // For unix-based systems
 		extraEnv = append(extraEnv, "TMP="+ls.tempDir.String())    // For Windows
 	}
+	if indexPath := ls.clangdIndexPath(); indexPath != nil {
+		// The background index of the sketch is stored near the compilation
+		// database (in the build path), the index of the files outside of the
+		// project goes in the user cache directory: redirect it too.
+		if err := indexPath.MkdirAll(); err != nil {
+			logger.Logf("Error creating clangd index directory: %s", err)
+		} else {
+			logger.Logf("    clangd index path: %s", indexPath)
+			extraEnv = append(extraEnv, "XDG_CACHE_HOME="+indexPath.String()) // For unix-based systems
+			extraEnv = append(extraEnv, "LOCALAPPDATA="+indexPath.String())   // For Windows
+		}
+	}
 	if clangdCmd, err := paths.NewProcessFromPath(extraEnv, ls.config.ClangdPath, args...); err != nil {
 		panic("starting clangd: " + err.Error())
 	} else if cin, err := clangdCmd.StdinPipe(); err != nil {
@@ -91,7 +166,7 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 	clangdStdio := streams.NewReadWriteCloser(clangdStdout, clangdStdin)
 	if ls.config.EnableLogging {
 		clangdStdio = streams.LogReadWriteCloserAs(clangdStdio, "inols-clangd.log")
-		go io.Copy(streams.OpenLogFileAs("inols-clangd-err.log"), clangdStderr)
+		go copyClangdStderr(clangdStderr, streams.OpenLogFileAs("inols-clangd-err.log"), ls.config.LogClangdStderr)
 	} else {
 		go io.Copy(os.Stderr, clangdStderr)
 	}
@@ -99,8 +174,9 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 	client := &clangdLSPClient{
 		ls: ls,
 	}
-	client.conn = lsp.NewClient(clangdStdio, clangdStdio, client)
-	client.conn.SetLogger(&Logger{
+	conn := lsp.NewClient(clangdStdio, clangdStdio, client)
+	client.conn = conn
+	conn.SetLogger(&Logger{
 		IncomingPrefix: "IDE     LS <-- Clangd",
 		OutgoingPrefix: "IDE     LS --> Clangd",
 		HiColor:        color.HiRedString,
@@ -110,6 +186,67 @@ func newClangdLSPClient(logger jsonrpc.FunctionLogger, dataFolder *paths.Path, l
 	return client
 }
 
+// ProbeClangd runs the given clangd executable with the --version flag and
+// returns the first line of its output. If clangd can not be executed on this
+// platform (a binary built for another architecture or a broken wrapper script)
+// the returned error says so.
+func ProbeClangd(clangdPath *paths.Path) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, clangdPath.String(), "--version").CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if err != nil {
+		if isExecFormatError(err, output) {
+			return "", fmt.Errorf("clangd at %s is not executable on this platform", clangdPath)
+		}
+		if output != "" {
+			err = fmt.Errorf("%w: %s", err, output)
+		}
+		return "", fmt.Errorf("could not run clangd at %s: %w", clangdPath, err)
+	}
+	return strings.SplitN(output, "\n", 2)[0], nil
+}
+
+// isExecFormatError returns true if the error (and the output) of a process
+// tells that the executable is not compatible with the running platform.
+func isExecFormatError(err error, output string) bool {
+	if errors.Is(err, syscall.ENOEXEC) {
+		return true
+	}
+	// A wrapper script exits with 126 also when a permission is denied: only
+	// the output tells if the binary is for another platform
+	msg := strings.ToLower(err.Error() + "\n" + output)
+	for _, s := range []string{"exec format error", "cannot execute binary file", "bad cpu type in executable", "not a valid win32 application"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyClangdStderr copies the clangd stderr to out and, if toLog is true, forwards
+// each line to the language server log prefixed by CLANGD-STDERR.
+func copyClangdStderr(clangdStderr io.Reader, out io.Writer, toLog bool) {
+	defer streams.CatchAndLogPanic()
+
+	if !toLog {
+		io.Copy(out, clangdStderr)
+		return
+	}
+	scanner := bufio.NewScanner(clangdStderr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(out, line)
+		logPrint("info", "CLANGD-STDERR", color.HiBlackString, "%s", line)
+	}
+	if err := scanner.Err(); err != nil {
+		// Keep draining the stderr (without logging it) to not block clangd
+		logPrint("error", "CLANGD-STDERR", color.HiRedString, "error reading clangd stderr: %s", err)
+		io.Copy(out, clangdStderr)
+	}
+}
+
 // Run sends a Run notification to Clangd
 func (client *clangdLSPClient) Run() {
 	client.conn.Run()
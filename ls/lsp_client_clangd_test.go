@@ -0,0 +1,110 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClangdIndexPath(t *testing.T) {
+	tmp := paths.New(t.TempDir())
+	ls := &INOLanguageServer{config: &Config{}}
+	require.Nil(t, ls.clangdIndexPath())
+
+	ls.tempDir = tmp
+	require.Equal(t, tmp.Join("clangd-cache"), ls.clangdIndexPath())
+
+	ls.config.ClangdIndexPath = tmp.Join("index")
+	require.Equal(t, tmp.Join("index"), ls.clangdIndexPath())
+}
+
+func TestCopyClangdStderr(t *testing.T) {
+	out := &bytes.Buffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	errFile := &bytes.Buffer{}
+	copyClangdStderr(strings.NewReader("clangd: Unknown command line argument '-foo'\nStack dump:\n"), errFile, true)
+	require.Equal(t, "clangd: Unknown command line argument '-foo'\nStack dump:\n", errFile.String())
+	require.Contains(t, out.String(), "CLANGD-STDERR clangd: Unknown command line argument '-foo'")
+	require.Contains(t, out.String(), "CLANGD-STDERR Stack dump:")
+
+	out.Reset()
+	errFile.Reset()
+	copyClangdStderr(strings.NewReader("I[12:00:00.000] clangd version 14.0.0\n"), errFile, false)
+	require.Equal(t, "I[12:00:00.000] clangd version 14.0.0\n", errFile.String())
+	require.Empty(t, out.String())
+
+	// A line too long to be logged doesn't stop the copy of the stderr
+	out.Reset()
+	errFile.Reset()
+	copyClangdStderr(strings.NewReader("first\n"+strings.Repeat("x", 2*1024*1024)+"\nlast\n"), errFile, true)
+	require.True(t, strings.HasPrefix(errFile.String(), "first\n"))
+	require.True(t, strings.HasSuffix(errFile.String(), "\nlast\n"))
+	require.Contains(t, out.String(), "error reading clangd stderr")
+}
+
+func TestProbeClangd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not executable on windows")
+	}
+	tmp := paths.New(t.TempDir())
+
+	clangd := tmp.Join("clangd")
+	require.NoError(t, clangd.WriteFile([]byte("#!/bin/sh\necho 'clangd version 14.0.0'\necho 'Features: linux'\n")))
+	require.NoError(t, clangd.Chmod(0755))
+	version, err := ProbeClangd(clangd)
+	require.NoError(t, err)
+	require.Equal(t, "clangd version 14.0.0", version)
+
+	// A binary for another platform
+	foreign := tmp.Join("clangd-foreign")
+	require.NoError(t, foreign.WriteFile([]byte{0xCA, 0xFE, 0xBA, 0xBE, 0, 0, 0, 2}))
+	require.NoError(t, foreign.Chmod(0755))
+	_, err = ProbeClangd(foreign)
+	require.EqualError(t, err, "clangd at "+foreign.String()+" is not executable on this platform")
+
+	// A wrapper script that can not run the real binary
+	shim := tmp.Join("clangd-shim")
+	require.NoError(t, shim.WriteFile([]byte("#!/bin/sh\necho \"clangd: cannot execute binary file\" >&2\nexit 126\n")))
+	require.NoError(t, shim.Chmod(0755))
+	_, err = ProbeClangd(shim)
+	require.EqualError(t, err, "clangd at "+shim.String()+" is not executable on this platform")
+
+	// A wrapper script failing with exit code 126 for another reason
+	denied := tmp.Join("clangd-denied")
+	require.NoError(t, denied.WriteFile([]byte("#!/bin/sh\necho \"clangd: Permission denied\" >&2\nexit 126\n")))
+	require.NoError(t, denied.Chmod(0755))
+	_, err = ProbeClangd(denied)
+	require.ErrorContains(t, err, "could not run clangd at "+denied.String())
+	require.ErrorContains(t, err, "Permission denied")
+
+	// Other failures are reported with the clangd output
+	broken := tmp.Join("clangd-broken")
+	require.NoError(t, broken.WriteFile([]byte("#!/bin/sh\necho 'missing libLLVM.so' >&2\nexit 1\n")))
+	require.NoError(t, broken.Chmod(0755))
+	_, err = ProbeClangd(broken)
+	require.ErrorContains(t, err, "could not run clangd at "+broken.String())
+	require.ErrorContains(t, err, "missing libLLVM.so")
+}
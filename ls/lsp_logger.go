@@ -18,10 +18,14 @@ package ls
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/arduino/arduino-language-server/streams"
 	"github.com/fatih/color"
 	"go.bug.st/json"
+	"go.bug.st/lsp"
 	"go.bug.st/lsp/jsonrpc"
 )
 
@@ -36,34 +40,106 @@ func init() {
 	log.SetFlags(log.Lmicroseconds)
 }
 
+// jsonLogger, if set, receives all the log entries as structured JSON
+// instead of the colorized log lines.
+var jsonLogger *streams.JSONLogWriter
+
+// SetJSONLogger makes the language server loggers write structured entries
+// to the given JSONLogWriter.
+func SetJSONLogger(w *streams.JSONLogWriter) {
+	jsonLogger = w
+}
+
+// traceLevel is the verbosity of the JSON-RPC tracing, it can be changed at
+// runtime by the IDE. The default is "messages".
+var traceLevel atomic.Value
+
+// SetTraceLevel changes the verbosity of the JSON-RPC tracing:
+//   - "off": only the errors are logged and the dump of the raw JSON-RPC
+//     streams into the log files is paused
+//   - "messages": the requests, responses and notifications are logged
+//   - "verbose": the messages are logged together with their payload
+func SetTraceLevel(level lsp.TraceValue) error {
+	switch level {
+	case lsp.TraceValueOff, lsp.TraceValueMessages, lsp.TraceValueVerbose:
+	default:
+		return fmt.Errorf("invalid trace level: %q", level)
+	}
+	traceLevel.Store(level)
+	streams.SetDumpEnabled(level != lsp.TraceValueOff)
+	return nil
+}
+
+// GetTraceLevel returns the current verbosity of the JSON-RPC tracing.
+func GetTraceLevel() lsp.TraceValue {
+	if level, ok := traceLevel.Load().(lsp.TraceValue); ok {
+		return level
+	}
+	return lsp.TraceValueMessages
+}
+
+// traceMessages returns true if the JSON-RPC messages should be logged.
+func traceMessages() bool {
+	return GetTraceLevel() != lsp.TraceValueOff
+}
+
+// tracePayload returns the given JSON-RPC payload formatted to be appended to
+// a log line if the trace level is "verbose", or an empty string otherwise.
+func tracePayload(payload json.RawMessage) string {
+	if GetTraceLevel() != lsp.TraceValueVerbose || len(payload) == 0 {
+		return ""
+	}
+	return " " + string(payload)
+}
+
+// logPrint prints a log line for the given component: as a JSON entry if a
+// jsonLogger is set, or as a colorized log line otherwise.
+func logPrint(level, component string, colorFunc func(format string, a ...interface{}) string, format string, a ...interface{}) {
+	if jsonLogger != nil {
+		jsonLogger.Log(level, component, fmt.Sprintf(format, a...))
+		return
+	}
+	log.Print(colorFunc("%s "+format, append([]interface{}{component}, a...)...))
+}
+
 // LogOutgoingRequest prints an outgoing request into the log
 func (l *Logger) LogOutgoingRequest(id string, method string, params json.RawMessage) {
-	log.Print(l.HiColor("%s REQU %s %s", l.OutgoingPrefix, method, id))
+	if traceMessages() {
+		logPrint("info", l.OutgoingPrefix, l.HiColor, "REQU %s %s%s", method, id, tracePayload(params))
+	}
 }
 
 // LogOutgoingCancelRequest prints an outgoing cancel request into the log
 func (l *Logger) LogOutgoingCancelRequest(id string) {
-	log.Print(l.LoColor("%s CANCEL %s", l.OutgoingPrefix, id))
+	if traceMessages() {
+		logPrint("info", l.OutgoingPrefix, l.LoColor, "CANCEL %s", id)
+	}
 }
 
 // LogIncomingResponse prints an incoming response into the log if there is no error
 func (l *Logger) LogIncomingResponse(id string, method string, resp json.RawMessage, respErr *jsonrpc.ResponseError) {
-	e := ""
 	if respErr != nil {
-		e = l.ErrorColor(" ERROR: %s", respErr.AsError())
+		logPrint("error", l.IncomingPrefix, l.LoColor, "RESP %s %s%s", method, id, l.ErrorColor(" ERROR: %s", respErr.AsError()))
+		return
+	}
+	if traceMessages() {
+		logPrint("info", l.IncomingPrefix, l.LoColor, "RESP %s %s%s", method, id, tracePayload(resp))
 	}
-	log.Print(l.LoColor("%s RESP %s %s%s", l.IncomingPrefix, method, id, e))
 }
 
 // LogOutgoingNotification prints an outgoing notification into the log
 func (l *Logger) LogOutgoingNotification(method string, params json.RawMessage) {
-	log.Print(l.HiColor("%s NOTIF %s", l.OutgoingPrefix, method))
+	if traceMessages() {
+		logPrint("info", l.OutgoingPrefix, l.HiColor, "NOTIF %s%s", method, tracePayload(params))
+	}
 }
 
 // LogIncomingRequest prints an incoming request into the log
 func (l *Logger) LogIncomingRequest(id string, method string, params json.RawMessage) jsonrpc.FunctionLogger {
 	spaces := "                                               "
-	log.Print(l.HiColor(fmt.Sprintf("%s REQU %s %s", l.IncomingPrefix, method, id)))
+	if traceMessages() {
+		logPrint("info", l.IncomingPrefix, l.HiColor, "REQU %s %s%s", method, id, tracePayload(params))
+	}
 	return &FunctionLogger{
 		colorFunc: l.HiColor,
 		prefix:    fmt.Sprintf("%s      %s %s", spaces[:len(l.IncomingPrefix)], method, id),
@@ -72,22 +148,28 @@ func (l *Logger) LogIncomingRequest(id string, method string, params json.RawMes
 
 // LogIncomingCancelRequest prints an incoming cancel request into the log
 func (l *Logger) LogIncomingCancelRequest(id string) {
-	log.Print(l.LoColor("%s CANCEL %s", l.IncomingPrefix, id))
+	if traceMessages() {
+		logPrint("info", l.IncomingPrefix, l.LoColor, "CANCEL %s", id)
+	}
 }
 
 // LogOutgoingResponse prints an outgoing response into the log if there is no error
 func (l *Logger) LogOutgoingResponse(id string, method string, resp json.RawMessage, respErr *jsonrpc.ResponseError) {
-	e := ""
 	if respErr != nil {
-		e = l.ErrorColor(" ERROR: %s", respErr.AsError())
+		logPrint("error", l.OutgoingPrefix, l.LoColor, "RESP %s %s%s", method, id, l.ErrorColor(" ERROR: %s", respErr.AsError()))
+		return
+	}
+	if traceMessages() {
+		logPrint("info", l.OutgoingPrefix, l.LoColor, "RESP %s %s%s", method, id, tracePayload(resp))
 	}
-	log.Print(l.LoColor("%s RESP %s %s%s", l.OutgoingPrefix, method, id, e))
 }
 
 // LogIncomingNotification prints an incoming notification into the log
 func (l *Logger) LogIncomingNotification(method string, params json.RawMessage) jsonrpc.FunctionLogger {
 	spaces := "                                               "
-	log.Print(l.HiColor(fmt.Sprintf("%s NOTIF %s", l.IncomingPrefix, method)))
+	if traceMessages() {
+		logPrint("info", l.IncomingPrefix, l.HiColor, "NOTIF %s%s", method, tracePayload(params))
+	}
 	return &FunctionLogger{
 		colorFunc: l.HiColor,
 		prefix:    fmt.Sprintf("%s       %s", spaces[:len(l.IncomingPrefix)], method),
@@ -96,12 +178,16 @@ func (l *Logger) LogIncomingNotification(method string, params json.RawMessage)
 
 // LogIncomingDataDelay prints the delay of incoming data into the log
 func (l *Logger) LogIncomingDataDelay(delay time.Duration) {
-	log.Printf("IN Elapsed: %v", delay)
+	if traceMessages() {
+		log.Printf("IN Elapsed: %v", delay)
+	}
 }
 
 // LogOutgoingDataDelay prints the delay of outgoing data into the log
 func (l *Logger) LogOutgoingDataDelay(delay time.Duration) {
-	log.Printf("OUT Elapsed: %v", delay)
+	if traceMessages() {
+		log.Printf("OUT Elapsed: %v", delay)
+	}
 }
 
 // FunctionLogger is a lsp function logger
@@ -121,5 +207,9 @@ func NewLSPFunctionLogger(colofFunction func(format string, a ...interface{}) st
 
 // Logf logs the given message
 func (l *FunctionLogger) Logf(format string, a ...interface{}) {
+	if jsonLogger != nil {
+		jsonLogger.Log("info", strings.TrimRight(strings.TrimSpace(l.prefix), ":"), fmt.Sprintf(format, a...))
+		return
+	}
 	log.Print(l.colorFunc(l.prefix+": "+format, a...))
 }
@@ -0,0 +1,102 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/require"
+	"go.bug.st/json"
+	"go.bug.st/lsp"
+	"go.bug.st/lsp/jsonrpc"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	defer SetTraceLevel(lsp.TraceValueMessages)
+	out := &bytes.Buffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+	l := &Logger{IncomingPrefix: "IDE --> LS", OutgoingPrefix: "IDE <-- LS", HiColor: color.HiGreenString, LoColor: color.GreenString, ErrorColor: color.RedString}
+
+	res, respErr := ls.setLogLevelReqFromIDE(context.Background(), testLogger(), &ArduinoSetLogLevelParams{Level: lsp.TraceValueOff})
+	require.Nil(t, respErr)
+	require.Equal(t, lsp.TraceValueMessages, res.PreviousLevel)
+	require.Equal(t, lsp.TraceValueOff, GetTraceLevel())
+
+	// Only the errors are logged
+	out.Reset()
+	l.LogOutgoingNotification("textDocument/publishDiagnostics", nil)
+	l.LogOutgoingResponse("1", "textDocument/hover", nil, nil)
+	require.Empty(t, out.String())
+	l.LogOutgoingResponse("2", "textDocument/hover", nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "failure"})
+	require.Contains(t, out.String(), "failure")
+
+	res, respErr = ls.setLogLevelReqFromIDE(context.Background(), testLogger(), &ArduinoSetLogLevelParams{Level: lsp.TraceValueMessages})
+	require.Nil(t, respErr)
+	require.Equal(t, lsp.TraceValueOff, res.PreviousLevel)
+	out.Reset()
+	l.LogOutgoingNotification("textDocument/publishDiagnostics", json.RawMessage(`{"uri":"file:///Sketch.ino"}`))
+	require.Contains(t, out.String(), "textDocument/publishDiagnostics")
+	require.NotContains(t, out.String(), "file:///Sketch.ino")
+
+	_, respErr = ls.setLogLevelReqFromIDE(context.Background(), testLogger(), &ArduinoSetLogLevelParams{Level: "debug"})
+	require.NotNil(t, respErr)
+	require.Equal(t, lsp.TraceValueMessages, GetTraceLevel())
+}
+
+func TestSetTraceWithoutClangd(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	defer SetTraceLevel(lsp.TraceValueMessages)
+
+	// clangd not yet started (or stopped for inactivity)
+	ls.setTraceNotifFromIDE(testLogger(), &lsp.SetTraceParams{Value: lsp.TraceValueVerbose})
+	require.Equal(t, lsp.TraceValueVerbose, ls.clangdTraceValue.Load())
+
+	fake := &fakeClangdConn{}
+	ls.Clangd = &clangdLSPClient{conn: fake, ls: ls}
+	ls.setTraceNotifFromIDE(testLogger(), &lsp.SetTraceParams{Value: lsp.TraceValueOff})
+	require.Equal(t, []lsp.TraceValue{lsp.TraceValueOff}, fake.trace)
+	require.Equal(t, lsp.TraceValueOff, ls.clangdTraceValue.Load())
+}
+
+func TestVerboseLogLevelLogsPayloads(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	defer SetTraceLevel(lsp.TraceValueMessages)
+	out := &bytes.Buffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+	l := &Logger{IncomingPrefix: "IDE --> LS", OutgoingPrefix: "IDE <-- LS", HiColor: color.HiGreenString, LoColor: color.GreenString, ErrorColor: color.RedString}
+
+	_, respErr := ls.setLogLevelReqFromIDE(context.Background(), testLogger(), &ArduinoSetLogLevelParams{Level: lsp.TraceValueVerbose})
+	require.Nil(t, respErr)
+	out.Reset()
+	l.LogIncomingRequest("1", "textDocument/hover", json.RawMessage(`{"position":{"line":1,"character":2}}`))
+	require.Contains(t, out.String(), `textDocument/hover 1 {"position":{"line":1,"character":2}}`)
+
+	// The IDE trace level doesn't silence the log files
+	ls.setTraceNotifFromIDE(testLogger(), &lsp.SetTraceParams{Value: lsp.TraceValueOff})
+	require.Equal(t, lsp.TraceValueVerbose, GetTraceLevel())
+	out.Reset()
+	l.LogIncomingRequest("2", "textDocument/hover", json.RawMessage(`{}`))
+	require.Contains(t, out.String(), "textDocument/hover 2 {}")
+}
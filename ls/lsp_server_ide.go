@@ -19,6 +19,7 @@ import (
 	"context"
 	"io"
 
+	"github.com/arduino/arduino-language-server/sourcemapper"
 	"github.com/fatih/color"
 	"go.bug.st/json"
 	"go.bug.st/lsp"
@@ -27,17 +28,34 @@ import (
 
 // IDELSPServer is an IDE lsp server
 type IDELSPServer struct {
-	conn *lsp.Server
-	ls   *INOLanguageServer
+	conn  *lsp.Server
+	ls    *INOLanguageServer
+	input *initializeRequestReader
 }
 
 // NewIDELSPServer creates and return a new server
 func NewIDELSPServer(logger jsonrpc.FunctionLogger, in io.Reader, out io.Writer, ls *INOLanguageServer) *IDELSPServer {
 	server := &IDELSPServer{
-		ls: ls,
+		ls:    ls,
+		input: &initializeRequestReader{in: in},
 	}
-	server.conn = lsp.NewServer(in, out, server)
+	server.conn = lsp.NewServer(server.input, out, server)
 	server.conn.RegisterCustomNotification("ino/didCompleteBuild", server.ArduinoBuildCompleted)
+	server.conn.RegisterCustomNotification("arduino/didChangeBoardOptions", server.ArduinoDidChangeBoardOptions)
+	server.conn.RegisterCustomNotification("arduino/selectedBoard", server.ArduinoSelectedBoardNotification)
+	server.conn.RegisterCustomRequest("arduino/status", server.ArduinoStatus)
+	server.conn.RegisterCustomRequest("arduino/parameterHints", server.ArduinoParameterHints)
+	server.conn.RegisterCustomRequest("arduino/preprocessedSketch", server.ArduinoPreprocessedSketch)
+	server.conn.RegisterCustomRequest("arduino/lineMap", server.ArduinoLineMap)
+	server.conn.RegisterCustomRequest("arduino/reloadConfig", server.ArduinoReloadConfig)
+	server.conn.RegisterCustomRequest("arduino/setLogLevel", server.ArduinoSetLogLevel)
+	server.conn.RegisterCustomRequest("arduino/selectedBoard", server.ArduinoSelectedBoard)
+	server.conn.RegisterCustomRequest("arduino/diagnosticsForDocument", server.ArduinoDiagnosticsForDocument)
+	server.conn.RegisterCustomRequest("arduino/compileCommandsPath", server.ArduinoCompileCommandsPath)
+	if ls.config.pullDiagnostics() {
+		// textDocument/diagnostic is not supported by go.bug.st/lsp
+		server.conn.RegisterCustomRequest("textDocument/diagnostic", server.TextDocumentDiagnostic)
+	}
 	server.conn.SetLogger(&Logger{
 		IncomingPrefix: "IDE --> LS",
 		OutgoingPrefix: "IDE <-- LS",
@@ -55,6 +73,9 @@ func (server *IDELSPServer) Run() {
 
 // Initialize sends an initilize request
 func (server *IDELSPServer) Initialize(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.InitializeParams) (*lsp.InitializeResult, *jsonrpc.ResponseError) {
+	if server.input != nil {
+		server.ls.storeIDEExtraCapabilities(logger, server.input.initializeRequest())
+	}
 	return server.ls.initializeReqFromIDE(ctx, logger, params)
 }
 
@@ -88,9 +109,9 @@ func (server *IDELSPServer) WorkspaceWillDeleteFiles(ctx context.Context, logger
 	panic("unimplemented")
 }
 
-// TextDocumentWillSaveWaitUntil is not implemented
+// TextDocumentWillSaveWaitUntil returns the formatting edits to apply before saving (if enabled)
 func (server *IDELSPServer) TextDocumentWillSaveWaitUntil(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.WillSaveTextDocumentParams) ([]lsp.TextEdit, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+	return server.ls.textDocumentWillSaveWaitUntilReqFromIDE(ctx, logger, params)
 }
 
 // TextDocumentCompletion is not implemented
@@ -168,9 +189,9 @@ func (server *IDELSPServer) CodeLensResolve(ctx context.Context, logger jsonrpc.
 	panic("unimplemented")
 }
 
-// TextDocumentDocumentLink is not implemented
+// TextDocumentDocumentLink sends a request to list the links in a text document
 func (server *IDELSPServer) TextDocumentDocumentLink(ctx context.Context, logger jsonrpc.FunctionLogger, params *lsp.DocumentLinkParams) ([]lsp.DocumentLink, *jsonrpc.ResponseError) {
-	panic("unimplemented")
+	return server.ls.textDocumentDocumentLinkReqFromIDE(ctx, logger, params)
 }
 
 // DocumentLinkResolve is not implemented
@@ -285,9 +306,9 @@ func (server *IDELSPServer) SetTrace(logger jsonrpc.FunctionLogger, params *lsp.
 	server.ls.setTraceNotifFromIDE(logger, params)
 }
 
-// WindowWorkDoneProgressCancel is not implemented
+// WindowWorkDoneProgressCancel sends a notification to cancel a progress
 func (server *IDELSPServer) WindowWorkDoneProgressCancel(logger jsonrpc.FunctionLogger, params *lsp.WorkDoneProgressCancelParams) {
-	panic("unimplemented")
+	server.ls.windowWorkDoneProgressCancelNotifFromIDE(logger, params)
 }
 
 // WorkspaceDidChangeWorkspaceFolders is not implemented
@@ -335,9 +356,9 @@ func (server *IDELSPServer) TextDocumentDidChange(logger jsonrpc.FunctionLogger,
 	server.ls.textDocumentDidChangeNotifFromIDE(logger, params)
 }
 
-// TextDocumentWillSave is not implemented
+// TextDocumentWillSave is ignored: clangd doesn't need it, didSave does all the work
 func (server *IDELSPServer) TextDocumentWillSave(logger jsonrpc.FunctionLogger, params *lsp.WillSaveTextDocumentParams) {
-	panic("unimplemented")
+	logger.Logf("willSave %s ignored", params.RextDocument.URI)
 }
 
 // TextDocumentDidSave sends a notification the a text document has been saved
@@ -368,3 +389,212 @@ func (server *IDELSPServer) ArduinoBuildCompleted(logger jsonrpc.FunctionLogger,
 		server.ls.fullBuildCompletedFromIDE(logger, &params)
 	}
 }
+
+// DidChangeBoardOptionsParams is a custom notification from the IDE, sent when
+// the board options (menu selections) have been changed by the user.
+type DidChangeBoardOptionsParams struct {
+	// BoardOptions are the board options in the form MENU_ID=OPTION_ID[,MENU2_ID=OPTION_ID...]
+	BoardOptions string `json:"boardOptions"`
+}
+
+// ArduinoDidChangeBoardOptions handles "arduino/didChangeBoardOptions" messages from the IDE
+func (server *IDELSPServer) ArduinoDidChangeBoardOptions(logger jsonrpc.FunctionLogger, raw json.RawMessage) {
+	var params DidChangeBoardOptionsParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		logger.Logf("ERROR decoding DidChangeBoardOptionsParams: %s", err)
+	} else {
+		server.ls.didChangeBoardOptionsNotifFromIDE(logger, &params)
+	}
+}
+
+// ArduinoSelectedBoardParams are the parameters of the custom "arduino/selectedBoard"
+// request and notification, sent when the user selects another board.
+type ArduinoSelectedBoardParams struct {
+	Fqbn string `json:"fqbn"`
+}
+
+// ArduinoSelectedBoardResult is the response to the custom "arduino/selectedBoard"
+// request, sent once the sketch has been rebuilt for the selected board.
+type ArduinoSelectedBoardResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// ArduinoSelectedBoardNotification handles "arduino/selectedBoard" notifications
+// from the IDE, for the clients that do not need to know when the rebuild completes
+func (server *IDELSPServer) ArduinoSelectedBoardNotification(logger jsonrpc.FunctionLogger, raw json.RawMessage) {
+	var params ArduinoSelectedBoardParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		logger.Logf("ERROR decoding ArduinoSelectedBoardParams: %s", err)
+	} else {
+		server.ls.selectedBoardNotifFromIDE(logger, &params)
+	}
+}
+
+// ArduinoSelectedBoard handles "arduino/selectedBoard" requests from the IDE
+func (server *IDELSPServer) ArduinoSelectedBoard(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	var params ArduinoSelectedBoardParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.selectedBoardReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoStatusResult is the response to the custom "arduino/status" request,
+// it allows the editors to know the state of the language server.
+type ArduinoStatusResult struct {
+	ClangdRunning      bool   `json:"clangdRunning"`
+	LastBuildSucceeded bool   `json:"lastBuildSucceeded"`
+	Fqbn               string `json:"fqbn"`
+	Programmer         string `json:"programmer"`
+	SketchRoot         string `json:"sketchRoot"`
+	BuildPath          string `json:"buildPath"`
+}
+
+// ArduinoStatus handles "arduino/status" requests from the IDE
+func (server *IDELSPServer) ArduinoStatus(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	return server.ls.statusReqFromIDE(ctx, logger)
+}
+
+// ArduinoParameterHintsResult is the response to the custom "arduino/parameterHints"
+// request, it contains the parameters names of the call at the given position.
+type ArduinoParameterHintsResult struct {
+	Signature       string   `json:"signature"`
+	Parameters      []string `json:"parameters"`
+	ActiveParameter int      `json:"activeParameter"`
+}
+
+// ArduinoParameterHints handles "arduino/parameterHints" requests from the IDE
+func (server *IDELSPServer) ArduinoParameterHints(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	var params lsp.TextDocumentPositionParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.parameterHintsReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoPreprocessedSketchResult is the response to the custom "arduino/preprocessedSketch"
+// request, it contains the preprocessed sketch as seen by clangd.
+type ArduinoPreprocessedSketchResult struct {
+	URI     lsp.DocumentURI `json:"uri"`
+	Version int             `json:"version"`
+	Text    string          `json:"text"`
+}
+
+// ArduinoPreprocessedSketch handles "arduino/preprocessedSketch" requests from the IDE
+func (server *IDELSPServer) ArduinoPreprocessedSketch(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	return server.ls.preprocessedSketchReqFromIDE(ctx, logger)
+}
+
+// ArduinoLineMapResult is the response to the custom "arduino/lineMap" request,
+// it contains the line mapping between the sketch and the preprocessed sketch.
+type ArduinoLineMapResult struct {
+	CppToIno []sourcemapper.LineMapping `json:"cppToIno"`
+	InoToCpp []sourcemapper.LineMapping `json:"inoToCpp"`
+}
+
+// ArduinoLineMap handles "arduino/lineMap" requests from the IDE
+func (server *IDELSPServer) ArduinoLineMap(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	return server.ls.lineMapReqFromIDE(ctx, logger)
+}
+
+// ArduinoReloadConfigResult is the response to the custom "arduino/reloadConfig"
+// request, it contains the Arduino data folder read from the refreshed configuration
+// and tells if clangd has been restarted to use it.
+type ArduinoReloadConfigResult struct {
+	DataFolder      string `json:"dataFolder"`
+	ClangdRestarted bool   `json:"clangdRestarted"`
+}
+
+// ArduinoReloadConfig handles "arduino/reloadConfig" requests from the IDE
+func (server *IDELSPServer) ArduinoReloadConfig(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	return server.ls.reloadConfigReqFromIDE(ctx, logger)
+}
+
+// ArduinoSetLogLevelParams are the parameters of the custom "arduino/setLogLevel"
+// request, Level is one of "off", "messages" or "verbose".
+type ArduinoSetLogLevelParams struct {
+	Level lsp.TraceValue `json:"level"`
+}
+
+// ArduinoSetLogLevelResult is the response to the custom "arduino/setLogLevel"
+// request, it contains the new and the previous log level.
+type ArduinoSetLogLevelResult struct {
+	Level         lsp.TraceValue `json:"level"`
+	PreviousLevel lsp.TraceValue `json:"previousLevel"`
+}
+
+// ArduinoSetLogLevel handles "arduino/setLogLevel" requests from the IDE
+func (server *IDELSPServer) ArduinoSetLogLevel(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	var params ArduinoSetLogLevelParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.setLogLevelReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoDiagnosticsForDocumentParams are the parameters of the custom
+// "arduino/diagnosticsForDocument" request.
+type ArduinoDiagnosticsForDocumentParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+}
+
+// ArduinoDiagnosticsForDocument handles "arduino/diagnosticsForDocument" requests
+// from the IDE, the last diagnostics published for the document are returned.
+func (server *IDELSPServer) ArduinoDiagnosticsForDocument(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	var params ArduinoDiagnosticsForDocumentParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.diagnosticsForDocumentReqFromIDE(ctx, logger, &params)
+}
+
+// ArduinoCompileCommandsPathParams are the parameters of the custom
+// "arduino/compileCommandsPath" request, if Regenerate is true the sketch is
+// rebuilt before returning the path.
+type ArduinoCompileCommandsPathParams struct {
+	Regenerate bool `json:"regenerate,omitempty"`
+}
+
+// ArduinoCompileCommandsPathResult is the response to the custom
+// "arduino/compileCommandsPath" request, it contains the path of the
+// compilation database used by clangd.
+type ArduinoCompileCommandsPathResult struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+// ArduinoCompileCommandsPath handles "arduino/compileCommandsPath" requests from the IDE
+func (server *IDELSPServer) ArduinoCompileCommandsPath(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	var params ArduinoCompileCommandsPathParams
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+		}
+	}
+	return server.ls.compileCommandsPathReqFromIDE(ctx, logger, &params)
+}
+
+// DocumentDiagnosticParams are the parameters of a textDocument/diagnostic request.
+type DocumentDiagnosticParams struct {
+	TextDocument     lsp.TextDocumentIdentifier `json:"textDocument"`
+	Identifier       string                     `json:"identifier,omitempty"`
+	PreviousResultID string                     `json:"previousResultId,omitempty"`
+}
+
+// FullDocumentDiagnosticReport is the response to a textDocument/diagnostic
+// request, it contains all the diagnostics of the document.
+type FullDocumentDiagnosticReport struct {
+	Kind     string           `json:"kind"`
+	ResultID string           `json:"resultId,omitempty"`
+	Items    []lsp.Diagnostic `json:"items"`
+}
+
+// TextDocumentDiagnostic handles textDocument/diagnostic requests from the IDE
+func (server *IDELSPServer) TextDocumentDiagnostic(ctx context.Context, logger jsonrpc.FunctionLogger, raw json.RawMessage) (interface{}, *jsonrpc.ResponseError) {
+	var params DocumentDiagnosticParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	return server.ls.textDocumentDiagnosticReqFromIDE(ctx, logger, &params)
+}
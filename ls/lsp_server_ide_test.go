@@ -0,0 +1,103 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package ls
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.bug.st/json"
+	"go.bug.st/lsp"
+)
+
+func TestWillSaveThenDidSave(t *testing.T) {
+	ls, inoURI, _ := newTestSketchServer(t)
+	newTestClangdClient(ls)
+	server := &IDELSPServer{ls: ls}
+
+	require.NotPanics(t, func() {
+		server.TextDocumentWillSave(testLogger(), &lsp.WillSaveTextDocumentParams{
+			RextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+			Reason:       lsp.TextDocumentSaveReasonManual,
+		})
+		server.TextDocumentDidSave(testLogger(), &lsp.DidSaveTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: inoURI},
+		})
+	})
+	require.Len(t, ls.sketchRebuilder.trigger, 1)
+}
+
+func TestPullDiagnostics(t *testing.T) {
+	ls, inoURI, cppURI := newTestSketchServer(t)
+	ls.config.DiagnosticsMode = DiagnosticsModePull
+	ls.ideInoDocsWithDiagnostics = map[lsp.DocumentURI]bool{}
+	ideOut := &bytes.Buffer{}
+	ls.IDE = NewIDELSPServer(testLogger(), strings.NewReader(""), ideOut, ls)
+
+	unused := lsp.Diagnostic{
+		Range:    lsp.Range{Start: lsp.Position{Line: 10, Character: 6}, End: lsp.Position{Line: 10, Character: 12}},
+		Severity: lsp.DiagnosticSeverityWarning,
+		Code:     json.RawMessage(`"-Wunused-variable"`),
+		Source:   "clang",
+		Message:  "unused variable 'unused'",
+	}
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Diagnostics: []lsp.Diagnostic{unused}})
+
+	// The diagnostics are not pushed...
+	require.NotContains(t, ideOut.String(), "textDocument/publishDiagnostics")
+
+	// ...but they are returned to the IDE when requested
+	res, respErr := ls.IDE.TextDocumentDiagnostic(context.Background(), testLogger(), json.RawMessage(`{"textDocument":{"uri":"`+inoURI.String()+`"}}`))
+	require.Nil(t, respErr)
+	data, err := json.Marshal(res)
+	require.NoError(t, err)
+	var report FullDocumentDiagnosticReport
+	require.NoError(t, json.Unmarshal(data, &report))
+	require.Equal(t, "full", report.Kind)
+	require.Len(t, report.Items, 1)
+	require.Equal(t, 2, report.Items[0].Range.Start.Line)
+	require.Equal(t, "unused variable 'unused'", report.Items[0].Message)
+
+	// In "both" mode the diagnostics are pushed too
+	ls.config.DiagnosticsMode = DiagnosticsModeBoth
+	ls.publishDiagnosticsNotifFromClangd(testLogger(), &lsp.PublishDiagnosticsParams{URI: cppURI, Diagnostics: []lsp.Diagnostic{unused}})
+	require.Contains(t, ideOut.String(), "textDocument/publishDiagnostics")
+}
+
+func TestCompileCommandsPath(t *testing.T) {
+	ls, _, _ := newTestSketchServer(t)
+	ls.IDE = &IDELSPServer{ls: ls}
+
+	// The build path is not known before the initialization
+	_, respErr := ls.IDE.ArduinoCompileCommandsPath(context.Background(), testLogger(), nil)
+	require.NotNil(t, respErr)
+
+	ls.buildPath = ls.buildSketchRoot.Parent()
+	res, respErr := ls.IDE.ArduinoCompileCommandsPath(context.Background(), testLogger(), json.RawMessage(`{}`))
+	require.Nil(t, respErr)
+	require.Equal(t, &ArduinoCompileCommandsPathResult{
+		Path:   ls.buildPath.Join("compile_commands.json").String(),
+		Exists: false,
+	}, res)
+
+	require.NoError(t, ls.buildPath.Join("compile_commands.json").WriteFile([]byte("[]")))
+	res, respErr = ls.IDE.ArduinoCompileCommandsPath(context.Background(), testLogger(), nil)
+	require.Nil(t, respErr)
+	require.True(t, res.(*ArduinoCompileCommandsPathResult).Exists)
+}
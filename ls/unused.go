@@ -37,8 +37,11 @@ func (ls *INOLanguageServer) handleError(logger jsonrpc.FunctionLogger, err erro
 		message = submatch[1]
 	} else if strings.Contains(errorStr, "platform not installed") || strings.Contains(errorStr, "no FQBN provided") {
 		if ls.config.Fqbn != "" {
-			message = "Editor support may be inaccurate because the core for the board `" + ls.config.Fqbn + "` is not installed."
-			message += " Use the Boards Manager to install it."
+			message = missingCoreMessage(ls.config.Fqbn, errorStr)
+			if message == "" {
+				message = "Editor support may be inaccurate because the core for the board `" + ls.config.Fqbn + "` is not installed."
+				message += " Use the Boards Manager to install it."
+			}
 		} else {
 			// This case happens most often when the app is started for the first time and no
 			// board is selected yet. Don't bother the user with an error then.
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -12,8 +13,11 @@ import (
 	"os/signal"
 	"os/user"
 	"path"
+	"runtime"
 	"strings"
+	"time"
 
+	"github.com/arduino/arduino-language-server/globals"
 	"github.com/arduino/arduino-language-server/ls"
 	"github.com/arduino/arduino-language-server/streams"
 	"github.com/arduino/go-paths-helper"
@@ -23,13 +27,10 @@ import (
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "remove-temp-files" {
 		for _, tmpFile := range os.Args[2:] {
-			// SAFETY CHECK
-			if !strings.Contains(tmpFile, "arduino-language-server") {
-				fmt.Println("Could not remove extraneous temp folder:", tmpFile)
+			if err := ls.RemoveTemporaryFolder(tmpFile); err != nil {
+				fmt.Println(err)
 				os.Exit(1)
 			}
-
-			paths.New(tmpFile).RemoveAll()
 		}
 		return
 	}
@@ -46,21 +47,60 @@ func main() {
 	fqbn := flag.String(
 		"fqbn", "",
 		"Fully qualified board name to use initially (can be changed via JSON-RPC)")
+	programmer := flag.String(
+		"programmer", "",
+		"Programmer to use for uploads (reported to the editor, not needed for the build)")
 	/* unused */ _ = flag.String(
 		"board-name", "",
 		"User-friendly board name to use initially (can be changed via JSON-RPC)")
 	enableLogging := flag.Bool(
 		"log", false,
 		"Enable logging to files")
+	logClangdStderr := flag.Bool(
+		"log-clangd-stderr", false,
+		"Forward the clangd stderr into the language server log when logging is enabled (it's always written to inols-clangd-err.log)")
+	pprofAddress := flag.String(
+		"pprof", "",
+		"Start a pprof debug server on the given address (for example: localhost:6060), disabled if empty")
+	logMaxSize := flag.Int(
+		"log-max-size", 0,
+		"Maximum size in MB of each log file before it's rotated (0 = unlimited)")
+	logMaxBackups := flag.Int(
+		"log-max-backups", 3,
+		"Number of rotated log files to keep")
+	logFormat := flag.String(
+		"log-format", "text",
+		"Format of the log output: 'text' (human readable) or 'json' (one JSON object per line)")
 	loggingBasePath := flag.String(
 		"logpath", ".",
 		"Location where to write logging files to when logging is enabled")
 	formatFilePath := flag.String(
 		"format-conf-path", "",
 		"Path to global clang-format configuration file")
+	clangFormatPath := flag.String(
+		"clang-format", "",
+		"Path to a clang-format executable used for formatting instead of clangd")
+	formatOnSave := flag.Bool(
+		"format-on-save", false,
+		"Format the sketch files before saving (for editors using textDocument/willSaveWaitUntil)")
+	noFormatOverride := flag.Bool(
+		"no-format-override", false,
+		"Do not inject a temporary .clang-format configuration when formatting, let clangd search for the user's own configuration")
+	hoverShowSourceLocation := flag.Bool(
+		"hover-show-source-location", false,
+		"Show the sketch tab and line where the symbol is defined in the hover")
+	hideUnderscoreCompletions := flag.Bool(
+		"hide-underscore-completions", false,
+		"Hide completion items starting with an underscore")
 	cliDaemonAddress := flag.String(
 		"cli-daemon-addr", "",
 		"TCP address and port of the Arduino CLI daemon (for example: localhost:50051)")
+	cliDaemonTLSCert := flag.String(
+		"cli-daemon-tls-cert", "",
+		"Path to the PEM encoded CA certificate used to connect to the Arduino CLI daemon over TLS")
+	cliDaemonToken := flag.String(
+		"cli-daemon-token", "",
+		"Authentication token sent to the Arduino CLI daemon (requires TLS)")
 	cliDaemonInstanceNumber := flag.Int(
 		"cli-daemon-instance", -1,
 		"Instance number of the Arduino CLI daemon")
@@ -70,30 +110,122 @@ func main() {
 	noRealTimeDiagnostics := flag.Bool(
 		"no-real-time-diagnostics", false,
 		"Disable real time diagnostics")
+	diagnosticsMode := flag.String(
+		"diagnostics-mode", ls.DiagnosticsModePush,
+		"How the diagnostics are sent to the IDE: 'push' (textDocument/publishDiagnostics), 'pull' (textDocument/diagnostic) or 'both'")
+	keepClosedDiagnostics := flag.Bool(
+		"keep-closed-diagnostics", false,
+		"Keep the diagnostics of the sketch files closed in the IDE, instead of clearing them")
+	enableClangdConfig := flag.Bool(
+		"enable-clangd-config", true,
+		"Honor the .clangd configuration file in the sketch folder (clangd is started with --enable-config)")
+	clangdIndexPath := flag.String(
+		"clangd-index-path", "",
+		"Directory where clangd stores its cache and background index (default: inside the temporary directory, removed on exit)")
+	clangdIdleTimeout := flag.Int(
+		"clangd-idle-timeout", 0,
+		"Stop clangd after the given minutes without requests to free memory, it's started again when needed (0 = never stop)")
+	noSnippets := flag.Bool(
+		"no-snippets", false,
+		"Send completion items as plain text, even if the editor supports snippets")
+	maxCompletions := flag.Int(
+		"max-completions", 0,
+		"Maximum number of completion items sent to the editor, the list is marked as incomplete if truncated (0 = no limit)")
+	fullDocumentSync := flag.Bool(
+		"full-document-sync", false,
+		"Ask the editor to send the full text of the documents on every change, for clients that do not support incremental sync")
+	keepTemp := flag.Bool(
+		"keep-temp", false,
+		"Do not remove the temporary build directories on exit (useful to debug build problems)")
+	rebuildDebounce := flag.Int(
+		"rebuild-debounce", 1000,
+		"Delay in milliseconds to wait for further changes before rebuilding the sketch")
+	buildCacheSize := flag.Int(
+		"build-cache-size", 3,
+		"Number of build environments of the previously used boards kept to make switching back to them faster (0 = disabled)")
+	var suppressedDiagnostics stringsFlag
+	flag.Var(&suppressedDiagnostics,
+		"suppress-diagnostic",
+		"Clang diagnostic code to hide from the editor (for example: pragma_unknown), can be repeated")
+	var defines stringsFlag
+	flag.Var(&defines,
+		"define",
+		"Macro definition, in the form NAME or NAME=VALUE, added to the compile commands used by clangd (for example: DEBUG=1), can be repeated")
+	var rebuildIgnore stringsFlag
+	flag.Var(&rebuildIgnore,
+		"rebuild-ignore",
+		"Glob pattern, relative to the sketch folder, of the files whose changes do not trigger a rebuild (for example: data/), can be repeated")
+	socketAddress := flag.String(
+		"socket", "",
+		"Listen on the given TCP address (for example: localhost:9999) and serve a single client connection instead of stdio")
+	showVersion := flag.Bool(
+		"version", false,
+		"Print version information and exit")
 	jobs := flag.Int("jobs", -1, "Max number of parallel jobs. Default is 1. Use 0 to match the number of available CPU cores.")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(globals.VersionInfo.String())
+		return
+	}
+
+	streams.LogFileMaxSize = int64(*logMaxSize) * 1024 * 1024
+	streams.LogFileMaxBackups = *logMaxBackups
 	if *loggingBasePath != "" {
 		streams.GlobalLogDirectory = paths.New(*loggingBasePath)
 	} else if *enableLogging {
 		log.Fatalf("Please specify logpath")
 	}
 
+	if *logFormat != "text" && *logFormat != "json" {
+		log.Fatalf("Invalid log format %q, must be 'text' or 'json'", *logFormat)
+	}
+	switch *diagnosticsMode {
+	case ls.DiagnosticsModePush, ls.DiagnosticsModePull, ls.DiagnosticsModeBoth:
+	default:
+		log.Fatalf("Invalid diagnostics mode %q, must be 'push', 'pull' or 'both'", *diagnosticsMode)
+	}
+	setLogOutput := func(out io.Writer) {
+		if *logFormat == "json" {
+			jsonLogger := streams.NewJSONLogWriter(out)
+			log.SetFlags(0)
+			log.SetOutput(jsonLogger)
+			ls.SetJSONLogger(jsonLogger)
+		} else {
+			log.SetOutput(out)
+		}
+	}
+
 	if *enableLogging {
 		logfile := streams.OpenLogFileAs("inols-err.log")
-		log.SetOutput(io.MultiWriter(logfile, os.Stderr))
+		setLogOutput(io.MultiWriter(logfile, os.Stderr))
 		defer streams.CatchAndLogPanic()
-		go func() {
-			log.Println(http.ListenAndServe("localhost:6060", nil))
-		}()
 		log.Println("Language server launched with arguments:")
 		for i, arg := range os.Args {
 			log.Printf("  arg[%d] = %s", i, arg)
 		}
 	} else {
-		log.SetOutput(os.Stderr)
+		setLogOutput(os.Stderr)
+	}
+
+	if *pprofAddress != "" {
+		listener, err := net.Listen("tcp", *pprofAddress)
+		if err != nil {
+			log.Fatalf("Could not start pprof server on %s: %s", *pprofAddress, err)
+		}
+		log.Printf("pprof server listening on http://%s/debug/pprof/", listener.Addr())
+		go func() {
+			log.Println(http.Serve(listener, nil))
+		}()
 	}
 
+	// The flags not set on the command line may be provided via environment
+	// variables, useful when it's hard to pass flags (for example in editor plugins)
+	flagFromEnv(fqbn, "fqbn", "ARDUINO_LS_FQBN")
+	flagFromEnv(cliConfigPath, "cli-config", "ARDUINO_LS_CLI_CONFIG")
+	flagFromEnv(cliPath, "cli", "ARDUINO_LS_CLI")
+	flagFromEnv(clangdPath, "clangd", "ARDUINO_LS_CLANGD")
+
 	if *cliDaemonAddress != "" || *cliDaemonInstanceNumber != -1 {
 		// if one is set, both must be set
 		if *cliDaemonAddress == "" || *cliDaemonInstanceNumber == -1 {
@@ -101,11 +233,11 @@ func main() {
 		}
 	} else {
 		if *cliConfigPath == "" {
-			if user, _ := user.Current(); user != nil {
-				candidate := path.Join(user.HomeDir, ".arduino15/arduino-cli.yaml")
+			for _, candidate := range defaultCliConfigPaths() {
 				if _, err := os.Stat(candidate); err == nil {
 					*cliConfigPath = candidate
 					log.Printf("ArduinoCLI config file found at %s\n", candidate)
+					break
 				}
 			}
 		}
@@ -122,6 +254,12 @@ func main() {
 		}
 	}
 
+	if *fqbn != "" {
+		if err := ls.ValidateFqbn(*fqbn); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if *clangdPath == "" {
 		bin, _ := exec.LookPath("clangd")
 		if bin == "" {
@@ -130,29 +268,91 @@ func main() {
 		log.Printf("clangd found at %s\n", bin)
 		*clangdPath = bin
 	}
+	if bin, err := checkClangd(*clangdPath); err != nil {
+		log.Fatal(err)
+	} else {
+		*clangdPath = bin
+	}
+	// If clangd can not be run the language server is started anyway, to
+	// report the error to the IDE after the initialization.
+	clangdVersion, clangdErr := ls.ProbeClangd(paths.New(*clangdPath))
+	if clangdErr != nil {
+		log.Print(clangdErr)
+	} else {
+		log.Printf("Using %s", clangdVersion)
+	}
+
+	if *clangFormatPath != "" {
+		// A command name (like clang-format-17) is searched in the PATH
+		bin, err := exec.LookPath(*clangFormatPath)
+		if err != nil {
+			log.Fatalf("clang-format not found at %s: %s", *clangFormatPath, err)
+		}
+		*clangFormatPath = bin
+	}
 
 	config := &ls.Config{
 		Fqbn:                            *fqbn,
+		Programmer:                      *programmer,
 		ClangdPath:                      paths.New(*clangdPath),
+		ClangdIndexPath:                 paths.New(*clangdIndexPath),
+		ClangdError:                     clangdErr,
 		EnableLogging:                   *enableLogging,
+		LogClangdStderr:                 *logClangdStderr,
 		CliPath:                         paths.New(*cliPath),
 		CliConfigPath:                   paths.New(*cliConfigPath),
 		FormatterConf:                   paths.New(*formatFilePath),
+		ClangFormatPath:                 paths.New(*clangFormatPath),
+		DisableFormatOverride:           *noFormatOverride,
+		FormatOnSave:                    *formatOnSave,
+		HideUnderscoreCompletions:       *hideUnderscoreCompletions,
+		HoverShowSourceLocation:         *hoverShowSourceLocation,
+		MaxCompletions:                  *maxCompletions,
+		DisableSnippets:                 *noSnippets,
 		CliDaemonAddress:                *cliDaemonAddress,
+		CliDaemonTLSCert:                paths.New(*cliDaemonTLSCert),
+		CliDaemonToken:                  *cliDaemonToken,
 		CliInstanceNumber:               *cliDaemonInstanceNumber,
 		SkipLibrariesDiscoveryOnRebuild: *skipLibrariesDiscoveryOnRebuild,
 		DisableRealTimeDiagnostics:      *noRealTimeDiagnostics,
+		DiagnosticsMode:                 *diagnosticsMode,
+		KeepClosedDocsDiagnostics:       *keepClosedDiagnostics,
+		KeepTempFiles:                   *keepTemp,
+		FullDocumentSync:                *fullDocumentSync,
+		ClangdIdleTimeout:               time.Duration(*clangdIdleTimeout) * time.Minute,
+		SuppressedDiagnostics:           suppressedDiagnostics,
+		RebuildIgnore:                   rebuildIgnore,
+		BuildCacheSize:                  *buildCacheSize,
+		EnableClangdConfig:              *enableClangdConfig,
+		Defines:                         defines,
+		RebuildDebounce:                 time.Duration(*rebuildDebounce) * time.Millisecond,
 		Jobs:                            *jobs,
 	}
 
-	stdio := streams.NewReadWriteCloser(os.Stdin, os.Stdout)
+	var stdio io.ReadWriteCloser
+	if *socketAddress != "" {
+		listener, err := net.Listen("tcp", *socketAddress)
+		if err != nil {
+			log.Fatalf("Could not listen on %s: %s", *socketAddress, err)
+		}
+		log.Printf("Waiting for a client connection on %s", listener.Addr())
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			log.Fatalf("Error accepting client connection: %s", err)
+		}
+		log.Printf("Client connected from %s", conn.RemoteAddr())
+		stdio = conn
+	} else {
+		stdio = streams.NewReadWriteCloser(os.Stdin, os.Stdout)
+	}
 	if *enableLogging {
 		stdio = streams.LogReadWriteCloserAs(stdio, "inols.log")
 	}
 
 	inoHandler := ls.NewINOLanguageServer(stdio, stdio, config)
 
-	if isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()) {
+	if *socketAddress == "" && (isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())) {
 		fmt.Fprint(os.Stderr, `
 arduino-language-server is a language server that provides IDE-like features to editors.
 
@@ -173,3 +373,62 @@ https://microsoft.github.io/language-server-protocol/
 	}
 	inoHandler.Close()
 }
+
+// flagFromEnv sets the value of the given flag from the environment variable
+// envVar, if the flag is empty.
+func flagFromEnv(value *string, flagName, envVar string) {
+	if *value != "" {
+		return
+	}
+	if env := os.Getenv(envVar); env != "" {
+		log.Printf("Using %s=%s for the -%s flag", envVar, env, flagName)
+		*value = env
+	}
+}
+
+// stringsFlag is a flag that can be repeated to collect multiple values
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// checkClangd verifies that the given clangd path points to an executable file
+// and returns its path. A command name (like clangd-17) is searched in the PATH.
+func checkClangd(clangdPath string) (string, error) {
+	if bin, err := exec.LookPath(clangdPath); err == nil {
+		clangdPath = bin
+	}
+	info, err := os.Stat(clangdPath)
+	if err != nil {
+		return "", fmt.Errorf("clangd not found at %s: %w", clangdPath, err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("clangd path %s is a directory", clangdPath)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("clangd at %s is not executable", clangdPath)
+	}
+	return clangdPath, nil
+}
+
+// defaultCliConfigPaths returns the locations where the arduino-cli config file
+// is commonly installed, in order of preference.
+func defaultCliConfigPaths() []string {
+	candidates := []string{}
+	if user, _ := user.Current(); user != nil {
+		candidates = append(candidates,
+			path.Join(user.HomeDir, ".arduino15/arduino-cli.yaml"),
+			path.Join(user.HomeDir, "snap/arduino-cli/current/.arduino15/arduino-cli.yaml"),
+			path.Join(user.HomeDir, "Library/Arduino15/arduino-cli.yaml"))
+	}
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+		candidates = append(candidates, path.Join(xdgConfigHome, "arduino-cli/arduino-cli.yaml"))
+	}
+	return candidates
+}
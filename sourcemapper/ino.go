@@ -160,6 +160,57 @@ func (s *SketchMapper) IsPreprocessedCppLine(cppLine int) bool {
 	return preprocessed || !mapsToIno
 }
 
+// InoFiles returns the sorted list of the .ino files that compose the sketch
+func (s *SketchMapper) InoFiles() []string {
+	files := map[string]bool{}
+	for inoLine := range s.inoToCpp {
+		files[inoLine.File] = true
+	}
+	res := []string{}
+	for file := range files {
+		res = append(res, file)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// LineMapping is the correspondence between a line of the preprocessed .cpp
+// and a line of an .ino file
+type LineMapping struct {
+	CppLine      int    `json:"cppLine"`
+	InoFile      string `json:"inoFile"`
+	InoLine      int    `json:"inoLine"`
+	Preprocessed bool   `json:"preprocessed,omitempty"`
+}
+
+// CppToInoMappings returns the mapping of each line of the preprocessed .cpp,
+// sorted by .cpp line. Lines added by the preprocessor are marked as Preprocessed.
+func (s *SketchMapper) CppToInoMappings() []LineMapping {
+	res := []LineMapping{}
+	for cppLine, inoLine := range s.cppToIno {
+		_, preprocessed := s.cppPreprocessed[cppLine]
+		res = append(res, LineMapping{CppLine: cppLine, InoFile: inoLine.File, InoLine: inoLine.Line, Preprocessed: preprocessed})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CppLine < res[j].CppLine })
+	return res
+}
+
+// InoToCppMappings returns the mapping of each line of the .ino files, sorted
+// by .ino file and line.
+func (s *SketchMapper) InoToCppMappings() []LineMapping {
+	res := []LineMapping{}
+	for inoLine, cppLine := range s.inoToCpp {
+		res = append(res, LineMapping{CppLine: cppLine, InoFile: inoLine.File, InoLine: inoLine.Line})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].InoFile != res[j].InoFile {
+			return res[i].InoFile < res[j].InoFile
+		}
+		return res[i].InoLine < res[j].InoLine
+	})
+	return res
+}
+
 // CreateInoMapper create a InoMapper from the given target file
 func CreateInoMapper(targetFile []byte) *SketchMapper {
 	mapper := &SketchMapper{
@@ -255,36 +306,37 @@ func (s *SketchMapper) ApplyTextChange(inoURI lsp.DocumentURI, inoChange lsp.Tex
 
 	// Update line references
 	for deletedLines > 0 {
-		dirty = dirty || s.deleteCppLine(cppRange.Start.Line)
+		if s.deleteCppLine(cppRange.Start.Line) {
+			dirty = true
+		}
 		deletedLines--
 	}
 	addedLines := strings.Count(inoChange.Text, "\n")
 	for addedLines > 0 {
-		dirty = dirty || s.addInoLine(cppRange.Start.Line)
+		if s.addInoLine(cppRange.Start.Line) {
+			dirty = true
+		}
 		addedLines--
 	}
 	return
 }
 
 func (s *SketchMapper) addInoLine(cppLine int) (dirty bool) {
-	preprocessToShiftCpp := map[InoLine]bool{}
-
+	addedCppLine := cppLine
 	addedInoLine := s.cppToIno[cppLine]
 	carry := s.cppToIno[cppLine]
 	carry.Line++
 	for {
 		next, ok := s.cppToIno[cppLine+1]
 		s.cppToIno[cppLine+1] = carry
-		s.inoToCpp[carry] = cppLine + 1
+		if carry != NotIno {
+			s.inoToCpp[carry] = cppLine + 1
+		}
 		if !ok {
 			break
 		}
 
 		if next.File == addedInoLine.File && next.Line >= addedInoLine.Line {
-			if _, is := s.inoPreprocessed[next]; is {
-				// fmt.Println("Adding", next, "to cpp to shift")
-				preprocessToShiftCpp[next] = true
-			}
 			next.Line++
 		}
 
@@ -294,28 +346,17 @@ func (s *SketchMapper) addInoLine(cppLine int) (dirty bool) {
 
 	// dumpCppToInoMap(s.toIno)
 
-	preprocessToShiftIno := []InoLine{}
-	for inoPre := range s.inoPreprocessed {
-		// fmt.Println(">", inoPre, addedInoLine)
+	// The preprocessed lines after the added one are shifted down in the .cpp,
+	// and the ones referring to the following lines of the .ino are shifted too.
+	s.shiftPreprocessedLines(func(inoPre InoLine, l int) (InoLine, int) {
+		if l > addedCppLine {
+			l++
+		}
 		if inoPre.File == addedInoLine.File && inoPre.Line >= addedInoLine.Line {
-			preprocessToShiftIno = append(preprocessToShiftIno, inoPre)
+			inoPre.Line++
 		}
-	}
-	for inoPre := range preprocessToShiftCpp {
-		l := s.inoPreprocessed[inoPre]
-		delete(s.cppPreprocessed, l)
-		s.inoPreprocessed[inoPre] = l + 1
-		s.cppPreprocessed[l+1] = inoPre
-	}
-	for _, inoPre := range preprocessToShiftIno {
-		l := s.inoPreprocessed[inoPre]
-		delete(s.inoPreprocessed, inoPre)
-		inoPre.Line++
-		s.inoPreprocessed[inoPre] = l
-		s.cppPreprocessed[l] = inoPre
-		s.cppToIno[l] = inoPre
-	}
-
+		return inoPre, l
+	})
 	return
 }
 
@@ -348,16 +389,39 @@ func (s *SketchMapper) deleteCppLine(line int) (dirty bool) {
 		}
 		s.inoToCpp[curr] = shifted
 		s.cppToIno[shifted] = curr
+	}
 
-		if l, ok := s.inoPreprocessed[next]; ok {
-			s.inoPreprocessed[curr] = l
-			s.cppPreprocessed[l] = curr
-			delete(s.inoPreprocessed, next)
+	// The preprocessed lines after the removed one are shifted up in the .cpp,
+	// and the ones referring to the following lines of the .ino are shifted too.
+	// The preprocessed line referring to the removed line (if any) is kept until
+	// the next preprocessing, the change has been already reported as dirty.
+	s.shiftPreprocessedLines(func(inoPre InoLine, l int) (InoLine, int) {
+		if l > line {
+			l--
+		}
+		if inoPre.File == removed.File && inoPre.Line > removed.Line {
+			inoPre.Line--
+		}
+		return inoPre, l
+	})
+	return
+}
 
-			s.cppToIno[l] = curr
+// shiftPreprocessedLines updates the lines added by the preprocessor using the
+// given function to move them to the new .ino and .cpp lines.
+func (s *SketchMapper) shiftPreprocessedLines(shift func(inoPre InoLine, cppLine int) (InoLine, int)) {
+	inoPreprocessed := map[InoLine]int{}
+	cppPreprocessed := map[int]InoLine{}
+	for cppLine, inoPre := range s.cppPreprocessed {
+		newInoPre, newCppLine := shift(inoPre, cppLine)
+		cppPreprocessed[newCppLine] = newInoPre
+		s.cppToIno[newCppLine] = newInoPre
+		if l, ok := s.inoPreprocessed[inoPre]; ok && l == cppLine {
+			inoPreprocessed[newInoPre] = newCppLine
 		}
 	}
-	return
+	s.inoPreprocessed = inoPreprocessed
+	s.cppPreprocessed = cppPreprocessed
 }
 
 func dumpCppToInoMap(s map[int]InoLine) {
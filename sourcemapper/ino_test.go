@@ -17,6 +17,11 @@ package sourcemapper
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/arduino/go-paths-helper"
@@ -95,6 +100,25 @@ func TestCreateSourceMaps(t *testing.T) {
 	// dumpInoToCppMap(sourceMap.inoPreprocessed)
 }
 
+func TestLineMappings(t *testing.T) {
+	sketch := paths.New("testdata/sketch_july2a/sketch_july2a.ino").Canonical()
+	input, err := sketch.ReadFile()
+	require.NoError(t, err)
+
+	sourceMap := CreateInoMapper([]byte(input))
+	sketchJuly2a := sketch.String()
+	cppToIno := sourceMap.CppToInoMappings()
+	require.Len(t, cppToIno, 19)
+	require.Equal(t, LineMapping{CppLine: 0, InoFile: NotIno.File, InoLine: 0}, cppToIno[0])
+	require.Equal(t, LineMapping{CppLine: 5, InoFile: sketchJuly2a, InoLine: 1, Preprocessed: true}, cppToIno[5])
+	require.Equal(t, LineMapping{CppLine: 9, InoFile: sketchJuly2a, InoLine: 1}, cppToIno[9])
+
+	inoToCpp := sourceMap.InoToCppMappings()
+	require.Len(t, inoToCpp, 11)
+	require.Equal(t, LineMapping{CppLine: 3, InoFile: sketchJuly2a, InoLine: 0}, inoToCpp[0])
+	require.Equal(t, LineMapping{CppLine: 18, InoFile: sketchJuly2a, InoLine: 10}, inoToCpp[10])
+}
+
 func TestCreateMultifileSourceMap(t *testing.T) {
 	input := `#include <Arduino.h>
 #line 1 "/home/megabug/Workspace/sketchbook-cores-beta/Prova_Spazio/Prova_Spazio.ino"
@@ -222,6 +246,7 @@ void secondFunction() {
 		10: {ProvaSpazio, 22}, // vino
 		12: {SecondTab, 1},    // secondFunction
 	}, sourceMap.cppPreprocessed)
+	require.Equal(t, []string{ProvaSpazio, SecondTab}, sourceMap.InoFiles())
 	dumpCppToInoMap(sourceMap.cppToIno)
 	dumpInoToCppMap(sourceMap.inoToCpp)
 	dumpCppToInoMap(sourceMap.cppPreprocessed)
@@ -308,3 +333,107 @@ void secondFunction() {
 // 		t.Error(sourceMap.toIno)
 // 	}
 // }
+
+// randomTextChangeSketch is a synthetic sketch composed of two tabs, with the
+// prototypes added by the preprocessor, used by TestApplyTextChangeRoundTrip.
+const randomTextChangeSketch = `#include <Arduino.h>
+#line 1 "/sketch/Main/Main.ino"
+#include <SPI.h>
+
+#line 3 "/sketch/Main/Main.ino"
+void setup();
+#line 7 "/sketch/Main/Main.ino"
+void loop();
+#line 2 "/sketch/Main/Tab.ino"
+void helper();
+#line 3 "/sketch/Main/Main.ino"
+void setup() {
+  SPI.begin();
+}
+
+void loop() {
+  helper();
+}
+
+#line 1 "/sketch/Main/Tab.ino"
+
+void helper() {
+  delay(10);
+}
+`
+
+func TestApplyTextChangeRoundTrip(t *testing.T) {
+	mainIno := paths.New("/sketch/Main/Main.ino").Canonical().String()
+	tabIno := paths.New("/sketch/Main/Tab.ino").Canonical().String()
+
+	// ApplyTextChange logs every change, keep the test output readable
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for seed := int64(0); seed < 200; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		sourceMap := CreateInoMapper([]byte(randomTextChangeSketch))
+
+		// Keep track of the content of the .ino files, to check that every .ino
+		// line is mapped to a .cpp line with the same content.
+		inoText := map[string][]string{
+			mainIno: {"#include <SPI.h>", "", "void setup() {", "  SPI.begin();", "}", "", "void loop() {", "  helper();", "}", ""},
+			tabIno:  {"", "void helper() {", "  delay(10);", "}", ""},
+		}
+		for i := 0; i < 30; i++ {
+			file := mainIno
+			if rnd.Intn(2) == 0 {
+				file = tabIno
+			}
+			start := rnd.Intn(len(inoText[file]))
+			end := start + rnd.Intn(3)
+			if end >= len(inoText[file]) {
+				end = len(inoText[file]) - 1
+			}
+			// A change spanning lines that are not contiguous in the .cpp (for
+			// example across a section moved by the preprocessor) cannot be
+			// mapped incrementally: it's fixed by the next preprocessing.
+			uri := lsp.NewDocumentURI(file)
+			if sourceMap.InoToCppLine(uri, end)-sourceMap.InoToCppLine(uri, start) != end-start {
+				continue
+			}
+			newLines := make([]string, rnd.Intn(3))
+			for j := range newLines {
+				newLines[j] = fmt.Sprintf("  line%d_%d();", seed, i*10+j)
+			}
+			newText := strings.Join(newLines, "\n")
+			if len(newLines) > 0 {
+				newText += "\n"
+			}
+			change := lsp.TextDocumentContentChangeEvent{
+				Range: &lsp.Range{
+					Start: lsp.Position{Line: start, Character: 0},
+					End:   lsp.Position{Line: end, Character: 0},
+				},
+				Text: newText,
+			}
+			msg := fmt.Sprintf("seed %d, change %d: %s:%s %q", seed, i, file, change.Range, change.Text)
+			require.NotPanics(t, func() {
+				sourceMap.ApplyTextChange(uri, change)
+			}, msg)
+			lines := inoText[file]
+			updated := append([]string{}, lines[:start]...)
+			updated = append(updated, newLines...)
+			inoText[file] = append(updated, lines[end:]...)
+
+			cppLines := strings.Split(sourceMap.CppText.Text, "\n")
+			for _, inoFile := range []string{mainIno, tabIno} {
+				for inoLine := 0; inoLine < len(inoText[inoFile]); inoLine++ {
+					cppLine, ok := sourceMap.InoToCppLineOk(lsp.NewDocumentURI(inoFile), inoLine)
+					require.True(t, ok, "%s: %s:%d not mapped", msg, inoFile, inoLine)
+					require.Less(t, cppLine, len(cppLines), msg)
+					require.Equal(t, inoText[inoFile][inoLine], cppLines[cppLine], "%s: content of %s:%d", msg, inoFile, inoLine)
+
+					// InoToCppLine∘CppToInoLine is an identity on mapped lines
+					backFile, backLine := sourceMap.CppToInoLine(cppLine)
+					require.Equal(t, InoLine{inoFile, inoLine}, InoLine{backFile, backLine}, msg)
+				}
+			}
+		}
+	}
+}
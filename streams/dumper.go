@@ -19,7 +19,7 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"sync/atomic"
 
 	"github.com/arduino/go-paths-helper"
 )
@@ -27,6 +27,16 @@ import (
 // GlobalLogDirectory is the directory where logs are created
 var GlobalLogDirectory *paths.Path
 
+// dumpDisabled pauses the logging of the streams, the log files are kept open.
+var dumpDisabled atomic.Bool
+
+// SetDumpEnabled enables or disables, at runtime, the logging of the data
+// read and written by the streams created with LogReadWriteCloserAs and
+// LogReadWriteCloserToFile. Errors are always logged.
+func SetDumpEnabled(enabled bool) {
+	dumpDisabled.Store(!enabled)
+}
+
 // LogReadWriteCloserAs return a proxy for the given upstream io.ReadWriteCloser
 // that forward and logs all read/write/close operations on the given filename
 // that is created in the GlobalLogDirectory.
@@ -39,30 +49,31 @@ func LogReadWriteCloserAs(upstream io.ReadWriteCloser, filename string) io.ReadW
 
 // LogReadWriteCloserToFile return a proxy for the given upstream io.ReadWriteCloser
 // that forward and logs all read/write/close operations on the given file.
-func LogReadWriteCloserToFile(upstream io.ReadWriteCloser, file *os.File) io.ReadWriteCloser {
+func LogReadWriteCloserToFile(upstream io.ReadWriteCloser, file io.WriteCloser) io.ReadWriteCloser {
 	return &dumper{
 		upstream: upstream,
 		logfile:  file,
 	}
 }
 
-// OpenLogFileAs creates a log file in GlobalLogDirectory.
-func OpenLogFileAs(filename string) *os.File {
+// OpenLogFileAs creates a log file in GlobalLogDirectory. The log file is
+// rotated when it reaches LogFileMaxSize.
+func OpenLogFileAs(filename string) io.WriteCloser {
 	path := GlobalLogDirectory.Join(filename)
-	res, err := path.Append()
+	res, err := openRotatingLogFile(path)
 	if err != nil {
 		log.Fatalf("Error opening log file: %s", err)
 	} else {
 		abs, _ := path.Abs()
 		log.Printf("logging to %s", abs)
 	}
-	res.WriteString("\n\n\n\n\n\n\nStarted logging.\n")
+	res.Write([]byte("\n\n\n\n\n\n\nStarted logging.\n"))
 	return res
 }
 
 type dumper struct {
 	upstream io.ReadWriteCloser
-	logfile  *os.File
+	logfile  io.WriteCloser
 	reading  bool
 	writing  bool
 }
@@ -71,6 +82,9 @@ func (d *dumper) Read(buff []byte) (int, error) {
 	n, err := d.upstream.Read(buff)
 	if err != nil {
 		d.logfile.Write([]byte(fmt.Sprintf("<<< Read Error: %s\n", err)))
+	} else if dumpDisabled.Load() {
+		d.reading = false
+		d.writing = false
 	} else {
 		if !d.reading {
 			d.reading = true
@@ -86,6 +100,9 @@ func (d *dumper) Write(buff []byte) (int, error) {
 	n, err := d.upstream.Write(buff)
 	if err != nil {
 		_, _ = d.logfile.Write([]byte(fmt.Sprintf(">>> Write Error: %s\n", err)))
+	} else if dumpDisabled.Load() {
+		d.reading = false
+		d.writing = false
 	} else {
 		if !d.writing {
 			d.writing = true
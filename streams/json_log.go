@@ -0,0 +1,75 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package streams
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONLogWriter writes log entries as JSON objects, one per line, to make
+// the logs easier to parse by tools.
+type JSONLogWriter struct {
+	out io.Writer
+	mux sync.Mutex
+}
+
+// NewJSONLogWriter creates a JSONLogWriter that writes to out.
+func NewJSONLogWriter(out io.Writer) *JSONLogWriter {
+	return &JSONLogWriter{out: out}
+}
+
+type jsonLogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component,omitempty"`
+	Message   string `json:"message"`
+}
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// Log writes a log entry with the given level and component.
+func (w *JSONLogWriter) Log(level, component, message string) error {
+	data, err := json.Marshal(jsonLogEntry{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Level:     level,
+		Component: component,
+		Message:   ansiEscapeRegexp.ReplaceAllString(message, ""),
+	})
+	if err != nil {
+		return err
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	_, err = w.out.Write(append(data, '\n'))
+	return err
+}
+
+// Write implements io.Writer, so the JSONLogWriter can be used as output
+// of the standard log package: every line written is logged as an info entry.
+func (w *JSONLogWriter) Write(data []byte) (int, error) {
+	for _, line := range strings.Split(string(bytes.TrimRight(data, "\n")), "\n") {
+		if err := w.Log("info", "", line); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
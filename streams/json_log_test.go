@@ -0,0 +1,92 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package streams
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func decodeJSONLog(t *testing.T, out *bytes.Buffer) []map[string]string {
+	var entries []map[string]string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var entry map[string]string
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJSONLogWriterLog(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewJSONLogWriter(out)
+	require.NoError(t, w.Log("error", "CLANGD", "\x1b[91mclangd crashed\x1b[0m"))
+	require.NoError(t, w.Log("info", "", "no component"))
+
+	entries := decodeJSONLog(t, out)
+	require.Len(t, entries, 2)
+	_, err := time.Parse(time.RFC3339Nano, entries[0]["time"])
+	require.NoError(t, err)
+	require.Equal(t, "error", entries[0]["level"])
+	require.Equal(t, "CLANGD", entries[0]["component"])
+	// The colors are removed from the message
+	require.Equal(t, "clangd crashed", entries[0]["message"])
+	require.NotContains(t, entries[1], "component")
+	require.Equal(t, "no component", entries[1]["message"])
+}
+
+func TestJSONLogWriterWrite(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewJSONLogWriter(out)
+
+	// Each line is a record
+	data := []byte("first line\nsecond line\n")
+	n, err := w.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	// A write without the trailing newline is logged as well
+	data = []byte("partial line")
+	n, err = w.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	entries := decodeJSONLog(t, out)
+	require.Len(t, entries, 3)
+	for i, msg := range []string{"first line", "second line", "partial line"} {
+		require.Equal(t, "info", entries[i]["level"])
+		require.Equal(t, msg, entries[i]["message"])
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestJSONLogWriterWriteError(t *testing.T) {
+	w := NewJSONLogWriter(failingWriter{})
+	n, err := w.Write([]byte("lost line\n"))
+	require.EqualError(t, err, "disk full")
+	require.Zero(t, n)
+}
@@ -0,0 +1,110 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package streams
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// LogFileMaxSize is the size, in bytes, after which the log files are
+// rotated. Zero disables the rotation.
+var LogFileMaxSize int64
+
+// LogFileMaxBackups is the number of rotated log files that are kept.
+var LogFileMaxBackups = 3
+
+// rotatingLogFile is a log file that is rotated when it grows bigger
+// than LogFileMaxSize: the current file is renamed to <name>.1 (and the
+// older backups shifted to <name>.2, <name>.3, ...) and a new file is started.
+type rotatingLogFile struct {
+	path *paths.Path
+	file *os.File
+	size int64
+	mux  sync.Mutex
+}
+
+func openRotatingLogFile(path *paths.Path) (*rotatingLogFile, error) {
+	file, err := path.Append()
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &rotatingLogFile{
+		path: path,
+		file: file,
+		size: info.Size(),
+	}, nil
+}
+
+func (r *rotatingLogFile) Write(data []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if LogFileMaxSize > 0 && r.size > 0 && r.size+int64(len(data)) > LogFileMaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingLogFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	backup := func(n int) *paths.Path {
+		return paths.New(fmt.Sprintf("%s.%d", r.path, n))
+	}
+	if LogFileMaxBackups > 0 {
+		_ = backup(LogFileMaxBackups).Remove()
+		for n := LogFileMaxBackups - 1; n > 0; n-- {
+			if backup(n).Exist() {
+				_ = backup(n).Rename(backup(n + 1))
+			}
+		}
+		_ = r.path.Rename(backup(1))
+	}
+	file, err := r.path.Create()
+	if err != nil {
+		r.file = nil
+		return err
+	}
+	r.file, r.size = file, 0
+	return nil
+}
+
+func (r *rotatingLogFile) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
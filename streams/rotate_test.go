@@ -0,0 +1,94 @@
+// This file is part of arduino-language-server.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU Affero General Public License version 3,
+// which covers the main part of arduino-language-server.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/agpl-3.0.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package streams
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func setLogFileLimits(t *testing.T, maxSize int64, maxBackups int) {
+	oldMaxSize, oldMaxBackups := LogFileMaxSize, LogFileMaxBackups
+	LogFileMaxSize, LogFileMaxBackups = maxSize, maxBackups
+	t.Cleanup(func() {
+		LogFileMaxSize, LogFileMaxBackups = oldMaxSize, oldMaxBackups
+	})
+}
+
+func requireFileContent(t *testing.T, path *paths.Path, content string) {
+	data, err := path.ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+}
+
+func TestRotatingLogFile(t *testing.T) {
+	setLogFileLimits(t, 10, 2)
+	logPath := paths.New(t.TempDir()).Join("inols.log")
+	logFile, err := openRotatingLogFile(logPath)
+	require.NoError(t, err)
+	defer logFile.Close()
+
+	write := func(data string) {
+		n, err := logFile.Write([]byte(data))
+		require.NoError(t, err)
+		require.Equal(t, len(data), n)
+	}
+
+	// The writes fitting the max size go in the same file
+	write("aaaa\n")
+	write("bbbb\n")
+	requireFileContent(t, logPath, "aaaa\nbbbb\n")
+	require.False(t, logPath.Parent().Join("inols.log.1").Exist())
+
+	// The file is rotated when it would exceed the max size
+	write("cccc\n")
+	requireFileContent(t, logPath, "cccc\n")
+	requireFileContent(t, logPath.Parent().Join("inols.log.1"), "aaaa\nbbbb\n")
+
+	// The backups are shifted: .1 -> .2
+	write("dddddddd\n")
+	requireFileContent(t, logPath, "dddddddd\n")
+	requireFileContent(t, logPath.Parent().Join("inols.log.1"), "cccc\n")
+	requireFileContent(t, logPath.Parent().Join("inols.log.2"), "aaaa\nbbbb\n")
+
+	// The oldest backup is dropped
+	write("eeee\n")
+	requireFileContent(t, logPath, "eeee\n")
+	requireFileContent(t, logPath.Parent().Join("inols.log.1"), "dddddddd\n")
+	requireFileContent(t, logPath.Parent().Join("inols.log.2"), "cccc\n")
+	require.False(t, logPath.Parent().Join("inols.log.3").Exist())
+}
+
+func TestRotatingLogFileAppend(t *testing.T) {
+	setLogFileLimits(t, 10, 1)
+	logPath := paths.New(t.TempDir()).Join("inols.log")
+	require.NoError(t, logPath.WriteFile([]byte("previous\n")))
+
+	// The size of the existing log is taken into account
+	logFile, err := openRotatingLogFile(logPath)
+	require.NoError(t, err)
+	_, err = logFile.Write([]byte("new\n"))
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+	requireFileContent(t, logPath, "new\n")
+	requireFileContent(t, logPath.Parent().Join("inols.log.1"), "previous\n")
+
+	// The file can't be written after Close
+	_, err = logFile.Write([]byte("lost\n"))
+	require.Error(t, err)
+}